@@ -13,7 +13,6 @@ require (
 	github.com/coredns/coredns v1.8.1
 	github.com/davecgh/go-spew v1.1.1
 	github.com/google/uuid v1.1.2
-	github.com/hashicorp/go-reap v0.0.0-20170704170343-bf58d8a43e7b
 	github.com/insomniacslk/dhcp v0.0.0-20200601194411-4b5a011e0a4c
 	github.com/mattn/go-shellwords v1.0.11
 	github.com/mitchellh/go-ps v1.0.0
@@ -25,4 +24,5 @@ require (
 	github.com/vishvananda/netlink v1.1.0
 	github.com/vorteil/vorteil v0.0.0-20210104040243-9ef31da53e7e
 	golang.org/x/sys v0.0.0-20201214210602-f9fddec55a1e
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,23 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package backdoor
+
+// Frame are the registers of a backdoor call
+type Frame struct {
+	AX, BX, CX, DX, SI, DI, BP uint64
+}
+
+// In runs inl on the port in DX
+//go:noescape
+func In(f *Frame)
+
+// InS reads CX bytes from the port in DX to the address in DI
+//go:noescape
+func InS(f *Frame)
+
+// OutS writes CX bytes from the address in SI to the port in DX
+//go:noescape
+func OutS(f *Frame)
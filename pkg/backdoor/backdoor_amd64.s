@@ -0,0 +1,52 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+#include "textflag.h"
+
+// The backdoor functions load all registers from the frame, execute the
+// instruction and store the registers back. BP carries a cookie, the frame
+// size makes the assembler save and restore it.
+
+#define LOAD \
+	MOVQ f+0(FP), R8 \
+	MOVQ 0(R8), AX   \
+	MOVQ 8(R8), BX   \
+	MOVQ 16(R8), CX  \
+	MOVQ 24(R8), DX  \
+	MOVQ 32(R8), SI  \
+	MOVQ 40(R8), DI  \
+	MOVQ 48(R8), BP
+
+#define STORE \
+	MOVQ AX, 0(R8)  \
+	MOVQ BX, 8(R8)  \
+	MOVQ CX, 16(R8) \
+	MOVQ DX, 24(R8) \
+	MOVQ SI, 32(R8) \
+	MOVQ DI, 40(R8) \
+	MOVQ BP, 48(R8)
+
+// func In(f *Frame)
+TEXT ·In(SB), NOSPLIT, $8-8
+	LOAD
+	INL
+	STORE
+	RET
+
+// func InS(f *Frame)
+TEXT ·InS(SB), NOSPLIT, $8-8
+	LOAD
+	CLD
+	REP; INSB
+	STORE
+	RET
+
+// func OutS(f *Frame)
+TEXT ·OutS(SB), NOSPLIT, $8-8
+	LOAD
+	CLD
+	REP; OUTSB
+	STORE
+	RET
@@ -0,0 +1,9 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+// Package backdoor executes the I/O port instructions of the VMware
+// backdoor. It is separate from package vorteil because packages using cgo
+// can not contain assembly.
+package backdoor
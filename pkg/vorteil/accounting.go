@@ -0,0 +1,358 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+
+	ps "github.com/mitchellh/go-ps"
+)
+
+type doneMode int
+
+const (
+	doneAll  doneMode = iota
+	doneMain doneMode = iota
+	doneAny  doneMode = iota
+)
+
+const (
+	// kernel cmdline key, e.g. vinitd.done=main
+	doneCmdLine = "vinitd.done"
+
+	// services started by vinitd
+	serviceChrony    = "chronyd"
+	serviceFluentBit = "fluent-bit"
+	serviceTCPDump   = "tcpdump"
+)
+
+var (
+	doneModeStrings = map[doneMode]string{
+		doneAll:  "all",
+		doneMain: "main",
+		doneAny:  "any",
+	}
+
+	accounting = newProcAccounting()
+
+	doneModeValue doneMode
+	doneModeOnce  sync.Once
+)
+
+// procOwner is either a program or a vinitd service
+type procOwner struct {
+	prog    *program
+	service string
+}
+
+// procAccounting tracks processes (not threads) started by programs and
+// services. It is fed by the proc connector's fork and exit events.
+type procAccounting struct {
+	mtx sync.Mutex
+
+	// false if the proc connector is not available
+	active bool
+
+	owners map[int]procOwner
+
+	// forks with a parent not known yet, e.g. before the program's pid
+	// got registered. child to parent.
+	pending map[int]int
+}
+
+func newProcAccounting() *procAccounting {
+	return &procAccounting{
+		owners:  make(map[int]procOwner),
+		pending: make(map[int]int),
+	}
+}
+
+func (a *procAccounting) setActive(active bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.active = active
+}
+
+func (a *procAccounting) isActive() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.active
+}
+
+// procGone returns true if the process does not exist or is a zombie
+func procGone(pid int) bool {
+
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+
+	// state follows the executable name in brackets
+	s := string(b)
+	i := strings.LastIndex(s, ")")
+	if i < 0 || i+2 >= len(s) {
+		return true
+	}
+
+	return s[i+2] == 'Z'
+}
+
+func (a *procAccounting) register(pid int, owner procOwner) {
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	// the exit event might have been processed already
+	if procGone(pid) {
+		return
+	}
+
+	a.owners[pid] = owner
+	a.resolvePending()
+}
+
+func (a *procAccounting) registerProgram(pid int, p *program) {
+	a.register(pid, procOwner{prog: p})
+}
+
+func (a *procAccounting) registerService(pid int, name string) {
+	logDebug("service %s started as pid %d", name, pid)
+	a.register(pid, procOwner{service: name})
+}
+
+// resolvePending assigns owners to pending forks. Needs the lock.
+func (a *procAccounting) resolvePending() {
+
+	for changed := true; changed; {
+		changed = false
+		for child, parent := range a.pending {
+			if o, ok := a.owners[parent]; ok {
+				a.owners[child] = o
+				delete(a.pending, child)
+				changed = true
+			}
+		}
+	}
+
+}
+
+func (a *procAccounting) fork(parent, child int) {
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if o, ok := a.owners[parent]; ok {
+		a.owners[child] = o
+		return
+	}
+
+	// forks of vinitd itself are programs or services, registered later
+	if parent == 1 {
+		return
+	}
+
+	a.pending[child] = parent
+}
+
+func (a *procAccounting) exit(pid int) {
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	delete(a.owners, pid)
+	delete(a.pending, pid)
+
+	// pending forks can not be resolved through an exited parent
+	for child, parent := range a.pending {
+		if parent == pid {
+			delete(a.pending, child)
+		}
+	}
+}
+
+// running returns the number of processes of a program and its descendants
+func (a *procAccounting) running(p *program) int {
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	count := 0
+	for _, o := range a.owners {
+		if o.prog == p {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (a *procAccounting) services() map[string]int {
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	s := make(map[string]int)
+	for _, o := range a.owners {
+		if o.service != "" {
+			s[o.service]++
+		}
+	}
+
+	return s
+}
+
+func parseDoneMode(s string) (doneMode, error) {
+
+	for m, n := range doneModeStrings {
+		if n == s {
+			return m, nil
+		}
+	}
+
+	return doneAll, fmt.Errorf("unknown done mode '%s'", s)
+}
+
+func doneModeFromCmdLine() doneMode {
+
+	doneModeOnce.Do(func() {
+		s, ok := cmdLineValue(doneCmdLine)
+		if !ok {
+			return
+		}
+
+		m, err := parseDoneMode(s)
+		if err != nil {
+			logError("can not parse %s: %s", doneCmdLine, err.Error())
+			return
+		}
+		doneModeValue = m
+	})
+
+	return doneModeValue
+}
+
+// programFinished returns true if the program and all its descendants
+// have exited or the program failed to start
+func programFinished(p *program) bool {
+
+	if p.failed {
+		return true
+	}
+
+	// has not been started yet
+	if p.cmd == nil || p.cmd.Process == nil {
+		return false
+	}
+
+	return accounting.running(p) == 0
+}
+
+// psRunning is the fallback if the proc connector is not available. It counts
+// all processes which are not children of vinitd.
+func psRunning(progs []*program) bool {
+
+	rpo, _ := ps.Processes()
+	for _, p := range rpo {
+		if p.Pid() > 2 && p.PPid() > 2 &&
+			p.Executable() != serviceChrony &&
+			p.Executable() != serviceFluentBit {
+			return true
+		}
+	}
+
+	for _, p := range progs {
+		if p.failed || p.isJob() || p.isOneshot() {
+			continue
+		} else if p.cmd == nil {
+			return true
+		} else if p.cmd.ProcessState == nil && !p.reaper {
+			return true
+		} else if p.cmd.ProcessState != nil && !p.cmd.ProcessState.Exited() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vmDone decides if the instance is done based on vinitd.done. Jobs and
+// one-shot programs are not considered. Without other programs jobs keep the
+// instance running, one-shot programs until they have finished.
+func vmDone(progs []*program) bool {
+
+	var (
+		services []*program
+		hasJobs  bool
+	)
+
+	for _, p := range progs {
+		if p.isJob() {
+			hasJobs = true
+		} else if !p.isOneshot() {
+			services = append(services, p)
+		}
+	}
+
+	if len(services) == 0 && len(progs) > 0 {
+		return !hasJobs && oneshotsFinished(progs)
+	}
+	progs = services
+
+	if !accounting.isActive() {
+		return !psRunning(progs)
+	}
+
+	switch doneModeFromCmdLine() {
+	case doneMain:
+		if p := mainProgram(progs); p != nil {
+			return programFinished(p)
+		}
+	case doneAny:
+		for _, p := range progs {
+			if p.cmd != nil && programFinished(p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, p := range progs {
+		if !programFinished(p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseProcEvent updates the accounting with fork and exit events
+func parseProcEvent(hdr *ProcEventHeader, data []uint32) {
+
+	switch hdr.What {
+	case procEventFork:
+		// parent pid and tgid are in the header, child pid and tgid follow
+		if len(data) < 2 || data[0] != data[1] {
+			return
+		}
+		accounting.fork(int(hdr.ProcessTgid), int(data[0]))
+	case procEventExec:
+		logDebug("process %d exec", hdr.ProcessPid)
+	case procEventExit:
+		// threads exit with pid != tgid
+		if hdr.ProcessPid != hdr.ProcessTgid {
+			return
+		}
+		if len(data) > 0 {
+			recordExitStatus(int(hdr.ProcessPid), syscall.WaitStatus(data[0]))
+		}
+		accounting.exit(int(hdr.ProcessPid))
+	}
+
+}
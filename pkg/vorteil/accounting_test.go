@@ -0,0 +1,91 @@
+package vorteil
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcAccounting(t *testing.T) {
+
+	a := newProcAccounting()
+	p := &program{}
+	pid := os.Getpid()
+
+	// child forked before the program got registered
+	a.fork(pid, 100001)
+	a.fork(100001, 100002)
+	assert.Equal(t, 0, a.running(p))
+
+	a.registerProgram(pid, p)
+	assert.Equal(t, 3, a.running(p))
+
+	// threads of vinitd itself are not tracked
+	a.fork(1, 100003)
+	assert.Equal(t, 3, a.running(p))
+
+	a.exit(100001)
+	a.exit(pid)
+	assert.Equal(t, 1, a.running(p))
+
+	a.exit(100002)
+	assert.Equal(t, 0, a.running(p))
+
+	// registering an exited process is ignored
+	a.registerService(999999999, serviceChrony)
+	assert.Empty(t, a.services())
+
+}
+
+func TestVMDone(t *testing.T) {
+
+	old := accounting
+	defer func() { accounting = old }()
+
+	accounting = newProcAccounting()
+	accounting.setActive(true)
+
+	running := &program{progIndex: 0, cmd: &exec.Cmd{Process: &os.Process{Pid: os.Getpid()}}}
+	finished := &program{progIndex: 1, cmd: &exec.Cmd{Process: &os.Process{Pid: 100001}}}
+	accounting.registerProgram(os.Getpid(), running)
+
+	progs := []*program{running, finished}
+
+	doneModeOnce.Do(func() {})
+
+	doneModeValue = doneAll
+	assert.False(t, vmDone(progs))
+
+	doneModeValue = doneAny
+	assert.True(t, vmDone(progs))
+
+	doneModeValue = doneMain
+	assert.False(t, vmDone(progs))
+	finished.opts.main = true
+	assert.True(t, vmDone(progs))
+
+	doneModeValue = doneAll
+
+}
+
+func TestReaperExitCode(t *testing.T) {
+
+	// without proc connector the status comes from the reaper
+	assert.False(t, accounting.isActive())
+
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	assert.NoError(t, cmd.Start())
+
+	// the reaper collects the process before cmd.Wait
+	for i := 0; i < 200 && cmdExitCode(cmd) < 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, reapPending(nil))
+	}
+
+	assert.Equal(t, 3, waitExitCode(cmd))
+	assert.Nil(t, cmd.ProcessState)
+
+}
@@ -0,0 +1,379 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	azureAgentName     = "WALinuxAgent"
+	azureWireVersion   = "2012-11-30"
+	azureHealthReady   = "Ready"
+	azureHealthFailed  = "NotReady"
+	azureFailureStatus = "ProvisioningFailed"
+
+	// backoff between attempts, doubled up to azureRetryMax
+	azureRetryDelay = time.Second
+	azureRetryMax   = 30 * time.Second
+
+	azureReadyAttempts   = 10
+	azureFailureAttempts = 3
+
+	// the health is reported again on every interval with the incarnation
+	// of the current goal state
+	azureHealthInterval = 30 * time.Second
+
+	azureOVFFile = "ovf-env.xml"
+	azureOVFDir  = "ovf"
+)
+
+// devices and filesystems of the provisioning media, azure attaches an udf
+// formatted dvd
+var (
+	azureOVFDevices     = []string{"/dev/sr0", "/dev/sr1"}
+	azureOVFFilesystems = []string{"udf", "iso9660"}
+)
+
+// azureGoalState is the goal state document of the WireServer
+type azureGoalState struct {
+	Incarnation string `xml:"Incarnation"`
+	Container   struct {
+		ContainerID string `xml:"ContainerId"`
+		Instances   []struct {
+			InstanceID string `xml:"InstanceId"`
+		} `xml:"RoleInstanceList>RoleInstance"`
+	} `xml:"Container"`
+}
+
+// azureHealth is the health report posted to the WireServer
+type azureHealth struct {
+	XMLName     xml.Name          `xml:"Health"`
+	Incarnation string            `xml:"GoalStateIncarnation"`
+	ContainerID string            `xml:"Container>ContainerId"`
+	Roles       []azureRoleHealth `xml:"Container>RoleInstanceList>Role"`
+}
+
+type azureRoleHealth struct {
+	InstanceID string              `xml:"InstanceId"`
+	State      string              `xml:"Health>State"`
+	Details    *azureHealthDetails `xml:"Health>Details"`
+}
+
+type azureHealthDetails struct {
+	SubStatus   string `xml:"SubStatus"`
+	Description string `xml:"Description"`
+}
+
+// wireServer reports the health of the instance to azure's WireServer. The
+// last reported state is sent again periodically.
+type wireServer struct {
+	server     string
+	client     *http.Client
+	retryDelay time.Duration
+
+	mtx         sync.Mutex
+	incarnation string
+	state       string
+	reason      string
+}
+
+func newWireServer(server string) *wireServer {
+	return &wireServer{
+		server:     server,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		retryDelay: azureRetryDelay,
+	}
+}
+
+// request sends a request to /machine/?comp=<comp> and returns the body of
+// successful responses
+func (w *wireServer) request(method, comp string, body []byte) ([]byte, error) {
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/machine/?comp=%s", w.server, comp), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("x-ms-agent-name", azureAgentName)
+	req.Header.Add("x-ms-version", azureWireVersion)
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml;charset=utf-8")
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	r, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// gone or conflict if the goal state changed in between
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s returned %s", method, comp, resp.Status)
+	}
+
+	return r, nil
+}
+
+// goalState fetches the current goal state
+func (w *wireServer) goalState() (*azureGoalState, error) {
+
+	r, err := w.request(http.MethodGet, "goalstate", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var gs azureGoalState
+	err = xml.Unmarshal(r, &gs)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse goal state: %s", err.Error())
+	}
+
+	if gs.Incarnation == "" || gs.Container.ContainerID == "" ||
+		len(gs.Container.Instances) == 0 || gs.Container.Instances[0].InstanceID == "" {
+		return nil, fmt.Errorf("incomplete goal state")
+	}
+
+	return &gs, nil
+}
+
+// postHealth reports the state for the incarnation of the current goal state
+func (w *wireServer) postHealth(state, reason string) error {
+
+	gs, err := w.goalState()
+	if err != nil {
+		return err
+	}
+
+	w.mtx.Lock()
+	if w.incarnation != gs.Incarnation {
+		logDebug("azure goal state incarnation %s", gs.Incarnation)
+		w.incarnation = gs.Incarnation
+	}
+	w.mtx.Unlock()
+
+	rh := azureRoleHealth{
+		InstanceID: gs.Container.Instances[0].InstanceID,
+		State:      state,
+	}
+
+	if state != azureHealthReady {
+		rh.Details = &azureHealthDetails{
+			SubStatus:   azureFailureStatus,
+			Description: reason,
+		}
+	}
+
+	b, err := xml.Marshal(azureHealth{
+		Incarnation: gs.Incarnation,
+		ContainerID: gs.Container.ContainerID,
+		Roles:       []azureRoleHealth{rh},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.request(http.MethodPost, "health", append([]byte(xml.Header), b...))
+
+	return err
+}
+
+// report stores the state and posts it, failed attempts are retried with
+// backoff
+func (w *wireServer) report(state, reason string, attempts int) error {
+
+	w.mtx.Lock()
+	w.state, w.reason = state, reason
+	w.mtx.Unlock()
+
+	delay := w.retryDelay
+
+	var err error
+	for i := 0; i < attempts; i++ {
+
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+			if delay > azureRetryMax {
+				delay = azureRetryMax
+			}
+		}
+
+		err = w.postHealth(state, reason)
+		if err == nil {
+			return nil
+		}
+
+		logDebug("azure health report failed: %s", err.Error())
+	}
+
+	return err
+}
+
+// run reports the last state on every interval
+func (w *wireServer) run(interval time.Duration) {
+
+	for {
+
+		time.Sleep(interval)
+
+		w.mtx.Lock()
+		state, reason := w.state, w.reason
+		w.mtx.Unlock()
+
+		err := w.postHealth(state, reason)
+		if err != nil {
+			logDebug("azure health report failed: %s", err.Error())
+		}
+	}
+}
+
+// azureOVF is the provisioning data in ovf-env.xml of the provisioning media
+type azureOVF struct {
+	Linux struct {
+		HostName   string `xml:"HostName"`
+		UserName   string `xml:"UserName"`
+		CustomData string `xml:"CustomData"`
+		PublicKeys []struct {
+			Path  string `xml:"Path"`
+			Value string `xml:"Value"`
+		} `xml:"SSH>PublicKeys>PublicKey"`
+	} `xml:"ProvisioningSection>LinuxProvisioningConfigurationSet"`
+}
+
+// azureProvisioning are the decoded values of ovf-env.xml
+type azureProvisioning struct {
+	hostname, username string
+	userdata           string
+	sshKeys            []string
+}
+
+// parseAzureOVF decodes ovf-env.xml, custom data is base64 encoded. Keys
+// without value reference certificates and are ignored.
+func parseAzureOVF(b []byte) (*azureProvisioning, error) {
+
+	var ovf azureOVF
+	err := xml.Unmarshal(b, &ovf)
+	if err != nil {
+		return nil, err
+	}
+
+	l := ovf.Linux
+	ap := &azureProvisioning{
+		hostname: strings.TrimSpace(l.HostName),
+		username: strings.TrimSpace(l.UserName),
+	}
+
+	if cd := strings.TrimSpace(l.CustomData); cd != "" {
+		ud, err := base64.StdEncoding.DecodeString(cd)
+		if err != nil {
+			return nil, fmt.Errorf("can not decode custom data: %s", err.Error())
+		}
+		ap.userdata = string(ud)
+	}
+
+	for _, k := range l.PublicKeys {
+		if v := strings.TrimSpace(k.Value); v != "" {
+			ap.sshKeys = append(ap.sshKeys, v)
+		}
+	}
+
+	return ap, nil
+}
+
+// readAzureOVF mounts the provisioning media read-only and returns
+// ovf-env.xml
+func readAzureOVF() ([]byte, error) {
+
+	dir, err := runDir(azureOVFDir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	for _, dev := range azureOVFDevices {
+
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+
+		for _, fs := range azureOVFFilesystems {
+
+			err = syscall.Mount(dev, dir, fs, syscall.MS_RDONLY|syscall.MS_SILENT, "")
+			if err != nil {
+				continue
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, azureOVFFile))
+			syscall.Unmount(dir, 0)
+			if err == nil {
+				logDebug("read provisioning data from %s", dev)
+				return b, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no provisioning media found")
+}
+
+// provisioning returns the provisioning data, it is read once
+func (p *azureProvider) provisioning() *azureProvisioning {
+
+	p.ovfOnce.Do(func() {
+
+		b, err := p.readOVF()
+		if err != nil {
+			logDebug("can not read azure provisioning data: %s", err.Error())
+			return
+		}
+
+		p.ovf, err = parseAzureOVF(b)
+		if err != nil {
+			logWarn("can not parse %s: %s", azureOVFFile, err.Error())
+		}
+	})
+
+	return p.ovf
+}
+
+// reportReady reports Ready in the background and keeps reporting the
+// health, azure restarts instances without report
+func (p *azureProvider) reportReady() {
+
+	go func() {
+		err := p.wire.report(azureHealthReady, "", azureReadyAttempts)
+		if err != nil {
+			logError("can not report azure health: %s", err.Error())
+		}
+
+		p.wire.run(azureHealthInterval)
+	}()
+}
+
+// reportFailure reports NotReady with the reason of the failed boot
+func (p *azureProvider) reportFailure(reason string) {
+
+	err := p.wire.report(azureHealthFailed, reason, azureFailureAttempts)
+	if err != nil {
+		logError("can not report azure health: %s", err.Error())
+	}
+}
@@ -0,0 +1,178 @@
+package vorteil
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const azureGoalStateXML = `<?xml version="1.0" encoding="utf-8"?>
+<GoalState xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:noNamespaceSchemaLocation="goalstate10.xsd">
+  <Version>2012-11-30</Version>
+  <Incarnation>%s</Incarnation>
+  <Machine><ExpectedState>Started</ExpectedState></Machine>
+  <Container>
+    <ContainerId>c6d5526c-5ac2-4200-b6e2-56f2b70c5ab2</ContainerId>
+    <RoleInstanceList>
+      <RoleInstance>
+        <InstanceId>7d2798bb72a0413d9a60b355277df726.vm1</InstanceId>
+        <State>Started</State>
+      </RoleInstance>
+    </RoleInstanceList>
+  </Container>
+</GoalState>`
+
+// wireServerStub serves the goal state and records health reports. The
+// first health post after an incarnation change fails like on the platform.
+type wireServerStub struct {
+	mtx         sync.Mutex
+	incarnation string
+	goalState   string
+	stale       bool
+	reports     []azureHealth
+}
+
+func (s *wireServerStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if r.URL.Path != "/machine/" || r.Header.Get("x-ms-version") != azureWireVersion ||
+		r.Header.Get("x-ms-agent-name") != azureAgentName {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Query().Get("comp") {
+	case "goalstate":
+		w.Write([]byte(s.goalState))
+	case "health":
+		if s.stale {
+			s.stale = false
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		var h azureHealth
+		if xml.Unmarshal(b, &h) != nil || h.Incarnation != s.incarnation {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.reports = append(s.reports, h)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *wireServerStub) setIncarnation(i string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.incarnation = i
+	s.goalState = fmt.Sprintf(azureGoalStateXML, i)
+	s.stale = true
+}
+
+func TestWireServerHealth(t *testing.T) {
+
+	stub := &wireServerStub{}
+	stub.setIncarnation("1")
+	stub.stale = false
+
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	w := newWireServer(srv.URL)
+	w.retryDelay = 10 * time.Millisecond
+
+	assert.NoError(t, w.report(azureHealthReady, "", 3))
+	assert.Len(t, stub.reports, 1)
+
+	h := stub.reports[0]
+	assert.Equal(t, "1", h.Incarnation)
+	assert.Equal(t, "c6d5526c-5ac2-4200-b6e2-56f2b70c5ab2", h.ContainerID)
+	assert.Equal(t, []azureRoleHealth{{InstanceID: "7d2798bb72a0413d9a60b355277df726.vm1", State: "Ready"}}, h.Roles)
+
+	// new incarnation, the first post is rejected and retried
+	stub.setIncarnation("2")
+
+	assert.NoError(t, w.report(azureHealthFailed, "starting program failed", 3))
+	assert.Len(t, stub.reports, 2)
+
+	h = stub.reports[1]
+	assert.Equal(t, "2", h.Incarnation)
+	assert.Equal(t, "NotReady", h.Roles[0].State)
+	assert.Equal(t, &azureHealthDetails{SubStatus: "ProvisioningFailed", Description: "starting program failed"}, h.Roles[0].Details)
+
+	// incomplete goal states are errors
+	stub.goalState = "<GoalState><Incarnation>3</Incarnation></GoalState>"
+	assert.Error(t, w.report(azureHealthReady, "", 2))
+
+	stub.goalState = "not xml"
+	assert.Error(t, w.report(azureHealthReady, "", 1))
+
+}
+
+func TestAzureProvisioning(t *testing.T) {
+
+	ovf := `<?xml version="1.0" encoding="utf-8"?>
+<Environment xmlns="http://schemas.dmtf.org/ovf/environment/1" xmlns:wa="http://schemas.microsoft.com/windowsazure">
+  <wa:ProvisioningSection>
+    <wa:Version>1.0</wa:Version>
+    <LinuxProvisioningConfigurationSet xmlns="http://schemas.microsoft.com/windowsazure">
+      <ConfigurationSetType>LinuxProvisioningConfiguration</ConfigurationSetType>
+      <HostName>vm1</HostName>
+      <UserName>azureuser</UserName>
+      <DisableSshPasswordAuthentication>true</DisableSshPasswordAuthentication>
+      <SSH>
+        <PublicKeys>
+          <PublicKey>
+            <Fingerprint>EB0C0AB4B2D5FC35F2F0658D19F44C8283E2DD62</Fingerprint>
+            <Path>/home/azureuser/.ssh/authorized_keys</Path>
+            <Value>ssh-rsa AAAA ovf</Value>
+          </PublicKey>
+          <PublicKey>
+            <Fingerprint>0B1C0AB4B2D5FC35F2F0658D19F44C8283E2DD62</Fingerprint>
+            <Path>/home/azureuser/.ssh/id_rsa</Path>
+          </PublicKey>
+        </PublicKeys>
+      </SSH>
+      <CustomData>` + base64.StdEncoding.EncodeToString([]byte(`{"MODE": "prod"}`)) + `</CustomData>
+    </LinuxProvisioningConfigurationSet>
+  </wa:ProvisioningSection>
+</Environment>`
+
+	srv := metadataStub(t, "Metadata", "True", map[string]string{
+		"/metadata/instance/compute/publicKeys?api-version=2019-02-01&format=json": `[{"keyData": "ssh-rsa AAAA ovf"}, {"keyData": "ssh-rsa BBBB imds"}]`,
+	})
+	defer srv.Close()
+
+	p := newAzureProvider(srv.URL, "")
+	p.readOVF = func() ([]byte, error) {
+		return []byte(ovf), nil
+	}
+
+	ap := p.provisioning()
+	assert.Equal(t, "vm1", ap.hostname)
+	assert.Equal(t, "azureuser", ap.username)
+
+	ud, err := p.Userdata()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"MODE": "prod"}`, ud)
+
+	keys, err := p.SSHKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ssh-rsa AAAA ovf", "ssh-rsa BBBB imds"}, keys)
+
+	_, err = parseAzureOVF([]byte("<Environment><ProvisioningSection><LinuxProvisioningConfigurationSet>" +
+		"<CustomData>!</CustomData></LinuxProvisioningConfigurationSet></ProvisioningSection></Environment>"))
+	assert.Error(t, err)
+
+}
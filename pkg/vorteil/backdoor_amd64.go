@@ -0,0 +1,190 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/vorteil/vinitd/pkg/backdoor"
+)
+
+const (
+	vmMagic = 0x564D5868
+
+	vmPortCmd = 0x5658
+	vmPortRPC = 0x5659
+
+	vmCmdRPC = 0x1e
+
+	// sub-commands of vmCmdRPC
+	vmRPCOpen      = 0x00
+	vmRPCSetLength = 0x01
+	vmRPCGetLength = 0x03
+	vmRPCGetEnd    = 0x05
+	vmRPCClose     = 0x06
+
+	vmRPCFlagCookie = 0x80000000
+	vmRPCEnhData    = 0x00010000
+
+	vmRPCReplySuccess = 0x0001
+	vmRPCReplyDoRecv  = 0x0002
+
+	// the host is not trusted with the allocation size
+	vmRPCMaxLength = 1 << 20
+)
+
+// backdoorTransport is the VMware backdoor. The instructions fault on other
+// hypervisors, the system vendor is checked before opening a channel.
+type backdoorTransport struct{}
+
+// backdoorChannel is an open RPC channel of the backdoor
+type backdoorChannel struct {
+	id               uint16
+	cookie1, cookie2 uint32
+}
+
+func newRPCTransport() rpcTransport {
+	return backdoorTransport{}
+}
+
+// backdoorStatus returns the high word of CX
+func backdoorStatus(f *backdoor.Frame) uint16 {
+	return uint16(f.CX >> 16)
+}
+
+func (backdoorTransport) open(proto uint32) (rpcChannel, error) {
+
+	if dmiValue("sys_vendor") != vmwareVendor {
+		return nil, fmt.Errorf("not running on vmware")
+	}
+
+	f := backdoor.Frame{
+		AX: vmMagic,
+		BX: uint64(proto | vmRPCFlagCookie),
+		CX: vmCmdRPC | vmRPCOpen<<16,
+		DX: vmPortCmd,
+	}
+	backdoor.In(&f)
+
+	if backdoorStatus(&f) != 1 || uint16(f.DX) != 0 {
+		return nil, fmt.Errorf("opening rpc channel failed")
+	}
+
+	return &backdoorChannel{
+		id:      uint16(f.DX >> 16),
+		cookie1: uint32(f.SI),
+		cookie2: uint32(f.DI),
+	}, nil
+}
+
+// command returns the frame of a command on the command port
+func (c *backdoorChannel) command(cmd uint16, bx uint32) backdoor.Frame {
+	return backdoor.Frame{
+		AX: vmMagic,
+		BX: uint64(bx),
+		CX: vmCmdRPC | uint64(cmd)<<16,
+		DX: vmPortCmd | uint64(c.id)<<16,
+		SI: uint64(c.cookie1),
+		DI: uint64(c.cookie2),
+	}
+}
+
+// send sends the length and the data with enhanced RPC, an empty message
+// sends the length only
+func (c *backdoorChannel) send(data []byte) error {
+
+	f := c.command(vmRPCSetLength, uint32(len(data)))
+	backdoor.In(&f)
+
+	if backdoorStatus(&f)&vmRPCReplySuccess == 0 {
+		return fmt.Errorf("sending rpc length failed")
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	f = backdoor.Frame{
+		AX: vmMagic,
+		BX: vmRPCEnhData,
+		CX: uint64(len(data)),
+		DX: vmPortRPC | uint64(c.id)<<16,
+		SI: uint64(uintptr(unsafe.Pointer(&data[0]))),
+		DI: uint64(c.cookie2),
+		BP: uint64(c.cookie1),
+	}
+	backdoor.OutS(&f)
+	runtime.KeepAlive(data)
+
+	if uint32(f.BX) != vmRPCEnhData {
+		return fmt.Errorf("sending rpc data failed")
+	}
+
+	return nil
+}
+
+// receive returns the pending message, nil if there is none
+func (c *backdoorChannel) receive() ([]byte, error) {
+
+	f := c.command(vmRPCGetLength, 0)
+	backdoor.In(&f)
+
+	if backdoorStatus(&f)&vmRPCReplySuccess == 0 {
+		return nil, fmt.Errorf("receiving rpc length failed")
+	}
+
+	if backdoorStatus(&f)&vmRPCReplyDoRecv == 0 || uint32(f.BX) == 0 {
+		return nil, nil
+	}
+
+	length := uint32(f.BX)
+	dataID := uint32(f.DX >> 16)
+
+	if length > vmRPCMaxLength {
+		return nil, fmt.Errorf("rpc message too long: %d bytes", length)
+	}
+
+	buf := make([]byte, length)
+
+	f = backdoor.Frame{
+		AX: vmMagic,
+		BX: vmRPCEnhData,
+		CX: uint64(length),
+		DX: vmPortRPC | uint64(c.id)<<16,
+		SI: uint64(c.cookie1),
+		DI: uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		BP: uint64(c.cookie2),
+	}
+	backdoor.InS(&f)
+	runtime.KeepAlive(buf)
+
+	if uint32(f.BX) != vmRPCEnhData {
+		return nil, fmt.Errorf("receiving rpc data failed")
+	}
+
+	f = c.command(vmRPCGetEnd, dataID)
+	backdoor.In(&f)
+
+	if backdoorStatus(&f) == 0 {
+		return nil, fmt.Errorf("acknowledging rpc data failed")
+	}
+
+	return buf, nil
+}
+
+func (c *backdoorChannel) close() error {
+
+	f := c.command(vmRPCClose, 0)
+	backdoor.In(&f)
+
+	if backdoorStatus(&f) == 0 || uint16(f.CX) != 0 {
+		return fmt.Errorf("closing rpc channel failed")
+	}
+
+	return nil
+}
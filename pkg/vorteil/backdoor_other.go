@@ -0,0 +1,22 @@
+//go:build !amd64
+// +build !amd64
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import "fmt"
+
+// noTransport is used on architectures without VMware backdoor
+type noTransport struct{}
+
+func newRPCTransport() rpcTransport {
+	return noTransport{}
+}
+
+func (noTransport) open(proto uint32) (rpcChannel, error) {
+	return nil, fmt.Errorf("vmware backdoor not supported")
+}
@@ -0,0 +1,382 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-shellwords"
+)
+
+const (
+	// step options before the arguments, e.g. WAIT_PORT --timeout=30s 8080
+	bootstrapOptTimeout   = "--timeout="
+	bootstrapOptOnFailure = "--on-failure="
+
+	// interval for steps waiting for a condition
+	bootstrapPollInterval = time.Second
+
+	// log a warning every n polls
+	bootstrapWarnPolls = 30
+)
+
+// bootstrapHandler runs a bootstrap step. args do not contain the step name.
+type bootstrapHandler func(ctx context.Context, args []string, p *program) error
+
+type bootstrapStep struct {
+	name      string
+	args      []string
+	timeout   time.Duration
+	onFailure failurePolicy
+}
+
+var (
+	bootstrapHandlers = make(map[string]bootstrapHandler)
+)
+
+func registerBootstrap(name string, h bootstrapHandler) {
+	bootstrapHandlers[name] = h
+}
+
+func init() {
+	registerBootstrap(bootstrapSleep, bootstrapSleepStep)
+	registerBootstrap(bootstrapWaitFile, bootstrapWaitForFile)
+	registerBootstrap(bootstrapWaitPort, bootstrapWaitForPort)
+	registerBootstrap(bootstrapGet, bootstrapFetch)
+	registerBootstrap(bootstrapFandR, bootstrapReplace)
+	registerBootstrap(bootstrapDefine, bootstrapNotdefined)
+	registerBootstrap(bootstrapWaitDNS, bootstrapWaitForDNS)
+	registerBootstrap(bootstrapWaitHTTP, bootstrapWaitForHTTP)
+	registerBootstrap(bootstrapExec, bootstrapExecCommand)
+	registerBootstrap(bootstrapMkdir, bootstrapMakeDir)
+	registerBootstrap(bootstrapChown, bootstrapChangeOwner)
+	registerBootstrap(bootstrapChmod, bootstrapChangeMode)
+	registerBootstrap(bootstrapWriteFile, bootstrapWriteEnvFile)
+	registerBootstrap(bootstrapSymlink, bootstrapCreateSymlink)
+	registerBootstrap(bootstrapUntar, bootstrapExtractTar)
+}
+
+// parseBootstrapStep splits a bootstrap line with shell quoting rules and
+// extracts the step options
+func parseBootstrapStep(line string) (*bootstrapStep, error) {
+
+	parser := shellwords.NewParser()
+	parser.ParseBacktick = false
+	parser.ParseEnv = false
+
+	bs, err := parser.Parse(line)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bs) == 0 {
+		return nil, fmt.Errorf("empty bootstrap step")
+	}
+
+	step := &bootstrapStep{
+		name: bs[0],
+		// bootstrap errors have been logged only before
+		onFailure: failurePolicy{action: failDegrade},
+	}
+
+	bs = bs[1:]
+	for len(bs) > 0 {
+		if strings.HasPrefix(bs[0], bootstrapOptTimeout) {
+			d, err := parseDuration(strings.TrimPrefix(bs[0], bootstrapOptTimeout))
+			if err != nil {
+				return nil, fmt.Errorf("can not parse timeout: %v", err)
+			}
+			step.timeout = d
+		} else if strings.HasPrefix(bs[0], bootstrapOptOnFailure) {
+			fp, err := parseFailurePolicy(strings.TrimPrefix(bs[0], bootstrapOptOnFailure))
+			if err != nil {
+				return nil, err
+			}
+			step.onFailure = fp
+		} else {
+			break
+		}
+		bs = bs[1:]
+	}
+
+	step.args = bs
+
+	return step, nil
+}
+
+func (p *program) bootstrap() error {
+
+	for _, b := range p.vcfgProg.Bootstrap {
+
+		step, err := parseBootstrapStep(b)
+		if err != nil {
+			logError("can not parse bootstrap %s: %v", b, err)
+			continue
+		}
+
+		h, ok := bootstrapHandlers[step.name]
+		if !ok {
+			logError("unknown bootstrap command: %s", step.name)
+			continue
+		}
+
+		logDebug("bootstrap %s %v", step.name, redactArgs(step.args, p.env))
+
+		err = handleFailurePolicy(fmt.Sprintf("bootstrap '%s'", step.name), step.onFailure, func() error {
+			ctx := context.Background()
+			if step.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, step.timeout)
+				defer cancel()
+			}
+			return h(ctx, step.args, p)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keyValues separates key=value arguments for the given keys from the others
+func keyValues(args []string, keys ...string) ([]string, map[string]string) {
+
+	var rest []string
+	kv := make(map[string]string)
+
+	for _, a := range args {
+		found := false
+		for _, k := range keys {
+			if strings.HasPrefix(a, k+"=") {
+				kv[k] = strings.TrimPrefix(a, k+"=")
+				found = true
+				break
+			}
+		}
+		if !found {
+			rest = append(rest, a)
+		}
+	}
+
+	return rest, kv
+}
+
+// waitFor calls fn until it succeeds or the context is done
+func waitFor(ctx context.Context, name string, fn func() error) error {
+
+	count := 0
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if count%bootstrapWarnPolls == 0 && count > 0 {
+			logWarn("bootstrap '%s' still waiting: %v", name, err)
+		}
+		count++
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out: %v", err)
+		case <-time.After(bootstrapPollInterval):
+		}
+	}
+
+}
+
+func bootstrapSleepStep(ctx context.Context, args []string, p *program) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("bootstrap 'SLEEP' needs one value")
+	}
+
+	s, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("can not parse sleep bootstrap %s", args[0])
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(s) * time.Millisecond):
+	}
+
+	return nil
+}
+
+// bootstrapWaitForFile hangs process until the file appears
+// warns every 30 seconds.
+func bootstrapWaitForFile(ctx context.Context, args []string, p *program) error {
+
+	// check length of args to see atleast one path
+	if len(args) != 1 {
+		return fmt.Errorf("bootstrap 'WAIT_FILE' needs one value")
+	}
+
+	return waitFor(ctx, bootstrapWaitFile, func() error {
+		_, err := os.Stat(args[0])
+		return err
+	})
+
+}
+
+func bootstrapNotdefined(ctx context.Context, vals []string, p *program) error {
+
+	// if this is not a pair, we ignore
+	if len(vals) != 2 {
+		return fmt.Errorf("bootstrap 'DEFINE_IF_NOT_DEFINED' needs two values")
+	}
+
+	// check if it has been set
+	for _, val := range p.env {
+		if strings.HasPrefix(val, fmt.Sprintf("%s=", vals[0])) {
+			return nil
+		}
+	}
+
+	val := vals[1]
+	for k, v := range p.vinitd.hypervisorInfo.envs {
+		logDebug("replacing %s with %s", fmt.Sprintf(replaceString, k), redactValue(k, v))
+		val = strings.ReplaceAll(val, fmt.Sprintf(replaceString, k), v)
+	}
+
+	s := fmt.Sprintf(environString, vals[0], val)
+	logDebug("bootstrap not definded: %s", redactEnv([]string{s})[0])
+	p.env = append(p.env, s)
+
+	// we need to repace it in the arguments if required
+	pArgs, err := p.vcfgProg.ProgramArgs()
+	if err == nil && len(pArgs) > 1 {
+		p.args = args(pArgs[1:], p.env)
+	}
+
+	return nil
+}
+
+func bootstrapReplace(ctx context.Context, args []string, p *program) error {
+
+	if len(args) != 3 {
+		return fmt.Errorf("bootstrap 'FIND_AND_REPLACE' needs three values")
+	}
+
+	_, m := keyValues(args, "find", "replace", "file")
+
+	txt, err := ioutil.ReadFile(m["file"])
+	if err != nil {
+		return fmt.Errorf("file %s does does not exist to replace text", m["file"])
+	}
+
+	// check if it has been set
+	for _, val := range p.env {
+		s := strings.SplitN(val, "=", 2)
+		m["replace"] = strings.ReplaceAll(m["replace"], fmt.Sprintf(replaceString, s[0]), s[1])
+	}
+
+	content := strings.Replace(string(txt), m["find"], m["replace"], -1)
+	return ioutil.WriteFile(m["file"], []byte(content), 0)
+
+}
+
+// bootstrapWaitForDNS waits until all names can be resolved
+func bootstrapWaitForDNS(ctx context.Context, args []string, p *program) error {
+
+	if len(args) == 0 {
+		return fmt.Errorf("bootstrap 'WAIT_DNS' needs at least one name")
+	}
+
+	for _, name := range args {
+		err := waitFor(ctx, bootstrapWaitDNS, func() error {
+			_, err := net.DefaultResolver.LookupHost(ctx, name)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bootstrapWaitForHTTP waits until the url returns the expected status,
+// any 2xx if not set
+func bootstrapWaitForHTTP(ctx context.Context, args []string, p *program) error {
+
+	args, kv := keyValues(args, "status")
+
+	if len(args) != 1 {
+		return fmt.Errorf("bootstrap 'WAIT_HTTP' needs one url")
+	}
+
+	expected := 0
+	if s, ok := kv["status"]; ok {
+		var err error
+		expected, err = strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("can not parse status %s", s)
+		}
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+
+	return waitFor(ctx, bootstrapWaitHTTP, func() error {
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, args[0], nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if (expected == 0 && resp.StatusCode/100 == 2) || resp.StatusCode == expected {
+			return nil
+		}
+
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	})
+
+}
+
+// bootstrapExecCommand runs a command with the program's environment
+func bootstrapExecCommand(ctx context.Context, args []string, p *program) error {
+
+	if len(args) == 0 {
+		return fmt.Errorf("bootstrap 'EXEC' needs a command")
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = p.env
+	cmd.Dir = p.vcfgProg.Cwd
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	code := waitExitCode(cmd)
+	if code != 0 {
+		return fmt.Errorf("%s exited with %d", args[0], code)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package vorteil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBootstrapStep(t *testing.T) {
+
+	step, err := parseBootstrapStep("WAIT_FILE --timeout=30s --on-failure=fatal '/data/my file'")
+	assert.NoError(t, err)
+	assert.Equal(t, bootstrapWaitFile, step.name)
+	assert.Equal(t, 30*time.Second, step.timeout)
+	assert.Equal(t, failFatal, step.onFailure.action)
+	assert.Equal(t, []string{"/data/my file"}, step.args)
+
+	step, err = parseBootstrapStep(`FIND_AND_REPLACE "find=a b" replace=$HOSTNAME file=/etc/x`)
+	assert.NoError(t, err)
+	assert.Equal(t, failDegrade, step.onFailure.action)
+	assert.Equal(t, []string{"find=a b", "replace=$HOSTNAME", "file=/etc/x"}, step.args)
+
+	_, err = parseBootstrapStep("SLEEP --timeout=soon 100")
+	assert.Error(t, err)
+
+	_, err = parseBootstrapStep("SLEEP --on-failure=later 100")
+	assert.Error(t, err)
+
+	_, err = parseBootstrapStep("WAIT_FILE 'unterminated")
+	assert.Error(t, err)
+
+}
+
+func TestBootstrapFileSteps(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bootstrap")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	p := &program{
+		env: []string{"CONFIG=hello world", "CERT=" + base64.StdEncoding.EncodeToString([]byte("cert"))},
+	}
+
+	d := filepath.Join(dir, "a", "b")
+	assert.NoError(t, bootstrapMakeDir(ctx, []string{d, "mode=0700"}, p))
+	fi, err := os.Stat(d)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	f := filepath.Join(d, "config")
+	assert.NoError(t, bootstrapWriteEnvFile(ctx, []string{f, "CONFIG"}, p))
+	b, err := ioutil.ReadFile(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+
+	c := filepath.Join(d, "cert")
+	assert.NoError(t, bootstrapWriteEnvFile(ctx, []string{c, "CERT", "mode=0600", "base64"}, p))
+	b, err = ioutil.ReadFile(c)
+	assert.NoError(t, err)
+	assert.Equal(t, "cert", string(b))
+
+	assert.Error(t, bootstrapWriteEnvFile(ctx, []string{f, "MISSING"}, p))
+
+	assert.NoError(t, bootstrapChangeMode(ctx, []string{"-R", "0750", filepath.Join(dir, "a")}, p))
+	fi, err = os.Stat(f)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+
+	l := filepath.Join(dir, "link")
+	assert.NoError(t, bootstrapCreateSymlink(ctx, []string{f, l}, p))
+	assert.NoError(t, bootstrapCreateSymlink(ctx, []string{c, l}, p))
+	target, err := os.Readlink(l)
+	assert.NoError(t, err)
+	assert.Equal(t, c, target)
+
+}
+
+func TestUntar(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "untar")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive := func(name string) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("data"))
+		tw.Close()
+		return buf
+	}
+
+	assert.NoError(t, untar(context.Background(), archive("dir/file"), dir))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dir", "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(b))
+
+	assert.Error(t, untar(context.Background(), archive("../escape"), dir))
+
+	// a symlink out of the destination followed by a nested entry below it
+	outside, err := ioutil.TempDir("", "outside")
+	assert.NoError(t, err)
+	defer os.RemoveAll(outside)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "a", Linkname: outside, Mode: 0777, Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "a/b/c", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("data"))
+	tw.Close()
+
+	assert.Error(t, untar(context.Background(), buf, dir))
+	_, err = os.Stat(filepath.Join(outside, "b"))
+	assert.True(t, os.IsNotExist(err))
+
+	// hard links must not be created through the symlink either
+	buf = new(bytes.Buffer)
+	tw = tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "l", Linkname: "a/secret", Typeflag: tar.TypeLink})
+	tw.Close()
+
+	assert.Error(t, untar(context.Background(), buf, dir))
+
+}
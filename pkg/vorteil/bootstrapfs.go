@@ -0,0 +1,403 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseMode parses octal file modes like 0755
+func parseMode(s string) (os.FileMode, error) {
+
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("can not parse mode %s", s)
+	}
+
+	return os.FileMode(m), nil
+}
+
+// recursive returns the arguments without -R and if it was set
+func recursive(args []string) ([]string, bool) {
+
+	if len(args) > 0 && args[0] == "-R" {
+		return args[1:], true
+	}
+
+	return args, false
+}
+
+// walkOrSingle calls fn for the path or for everything below it
+func walkOrSingle(path string, r bool, fn func(string) error) error {
+
+	if !r {
+		return fn(path)
+	}
+
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(p)
+	})
+
+}
+
+// lookupOwner resolves user[:group] to ids. Numeric values are used as is.
+func lookupOwner(owner string) (int, int, error) {
+
+	s := strings.SplitN(owner, ":", 2)
+
+	uid, err := strconv.Atoi(s[0])
+	if err != nil {
+		u, err := user.Lookup(s[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	// group defaults to the user's id
+	gid := uid
+	if len(s) == 2 {
+		gid, err = strconv.Atoi(s[1])
+		if err != nil {
+			g, err := user.LookupGroup(s[1])
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+func bootstrapMakeDir(ctx context.Context, args []string, p *program) error {
+
+	args, kv := keyValues(args, "mode")
+
+	if len(args) != 1 {
+		return fmt.Errorf("bootstrap 'MKDIR' needs one path")
+	}
+
+	mode := os.FileMode(0755)
+	if m, ok := kv["mode"]; ok {
+		var err error
+		mode, err = parseMode(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(args[0], mode)
+	if err != nil {
+		return err
+	}
+
+	// MkdirAll applies the umask
+	return os.Chmod(args[0], mode)
+}
+
+func bootstrapChangeOwner(ctx context.Context, args []string, p *program) error {
+
+	args, r := recursive(args)
+
+	if len(args) != 2 {
+		return fmt.Errorf("bootstrap 'CHOWN' needs owner and path")
+	}
+
+	uid, gid, err := lookupOwner(args[0])
+	if err != nil {
+		return err
+	}
+
+	return walkOrSingle(args[1], r, func(path string) error {
+		return os.Lchown(path, uid, gid)
+	})
+
+}
+
+func bootstrapChangeMode(ctx context.Context, args []string, p *program) error {
+
+	args, r := recursive(args)
+
+	if len(args) != 2 {
+		return fmt.Errorf("bootstrap 'CHMOD' needs mode and path")
+	}
+
+	mode, err := parseMode(args[0])
+	if err != nil {
+		return err
+	}
+
+	return walkOrSingle(args[1], r, func(path string) error {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		// symlinks have no mode of their own
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(path, mode)
+	})
+
+}
+
+// bootstrapWriteEnvFile writes the value of an environment variable to a file
+func bootstrapWriteEnvFile(ctx context.Context, args []string, p *program) error {
+
+	args, kv := keyValues(args, "mode")
+
+	decode := false
+	if len(args) == 3 && args[2] == "base64" {
+		decode = true
+		args = args[:2]
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("bootstrap 'WRITE_FILE' needs path and variable")
+	}
+
+	mode := os.FileMode(0644)
+	if m, ok := kv["mode"]; ok {
+		var err error
+		mode, err = parseMode(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		val   string
+		found bool
+	)
+	for _, e := range p.env {
+		if strings.HasPrefix(e, args[1]+"=") {
+			val = strings.TrimPrefix(e, args[1]+"=")
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("variable %s not defined", args[1])
+	}
+
+	b := []byte(val)
+	if decode {
+		var err error
+		b, err = base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return fmt.Errorf("can not decode %s: %v", args[1], err)
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(args[0]), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(args[0], os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(b)
+	if err != nil {
+		return err
+	}
+
+	return f.Chmod(mode)
+}
+
+func bootstrapCreateSymlink(ctx context.Context, args []string, p *program) error {
+
+	if len(args) != 2 {
+		return fmt.Errorf("bootstrap 'SYMLINK' needs target and link")
+	}
+
+	err := os.MkdirAll(filepath.Dir(args[1]), 0755)
+	if err != nil {
+		return err
+	}
+
+	// replace existing links but not files or directories
+	if fi, err := os.Lstat(args[1]); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		os.Remove(args[1])
+	}
+
+	return os.Symlink(args[0], args[1])
+}
+
+// bootstrapExtractTar extracts a tar archive, gzip compressed or not
+func bootstrapExtractTar(ctx context.Context, args []string, p *program) error {
+
+	if len(args) != 2 {
+		return fmt.Errorf("bootstrap 'UNTAR' needs archive and destination")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return untar(ctx, f, args[1])
+}
+
+func untar(ctx context.Context, r io.Reader, dest string) error {
+
+	br := bufio.NewReader(r)
+
+	// gzip magic number
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	dest, err = filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dest, hdr.Name)
+		if target != dest && !strings.HasPrefix(target, dest+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry %s outside of %s", hdr.Name, dest)
+		}
+
+		// symlinks extracted before must not lead out of the destination
+		err = checkArchivePath(dest, target)
+		if err != nil {
+			return err
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode)
+		case tar.TypeReg:
+			// never write through an existing link
+			os.Remove(target)
+			err = untarFile(tr, target, mode)
+		case tar.TypeSymlink:
+			os.Remove(target)
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeLink:
+			link := filepath.Join(dest, hdr.Linkname)
+			if !strings.HasPrefix(link, dest+string(os.PathSeparator)) {
+				return fmt.Errorf("archive link %s outside of %s", hdr.Linkname, dest)
+			}
+			err = checkArchivePath(dest, link)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			err = os.Link(link, target)
+		default:
+			logDebug("skipping archive entry %s", hdr.Name)
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+	}
+
+}
+
+// checkArchivePath returns an error if a directory of path below dest is a
+// symlink. Entries are never written through links, the parent directories
+// which do not exist yet are created by the extraction.
+func checkArchivePath(dest, path string) error {
+
+	rel, err := filepath.Rel(dest, path)
+	if err != nil {
+		return err
+	}
+
+	dir := dest
+	parts := strings.Split(rel, string(os.PathSeparator))
+	for _, p := range parts[:len(parts)-1] {
+
+		dir = filepath.Join(dir, p)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive path %s leads through symlink %s", rel, dir)
+		}
+	}
+
+	return nil
+}
+
+func untarFile(r io.Reader, target string, mode os.FileMode) error {
+
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+
+	return err
+}
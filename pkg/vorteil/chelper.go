@@ -7,7 +7,6 @@ package vorteil
 
 // #cgo CFLAGS: -g -Wall
 // #include "helper.h"
-// #include "vmtools.h"
 // #include <stdlib.h>
 import "C"
 import (
@@ -17,42 +16,14 @@ import (
 	"unsafe"
 )
 
-//export RebootForTools
-func RebootForTools() {
-	shutdown(syscall.LINUX_REBOOT_CMD_RESTART)
-}
-
-//export ShutdownForTools
-func ShutdownForTools() {
-	shutdown(syscall.LINUX_REBOOT_CMD_POWER_OFF)
-}
-
-//export UptimeForTools
-func UptimeForTools() C.int {
-	var d1, d2 uint64
-	up := uptime()
-	fmt.Sscanf(fmt.Sprintf("%f", up), "%d.%d", &d1, &d2)
-	return C.int(d1*100 + d2)
-}
-
-func startVMTools(cards int, hostname string) {
-	hn := C.CString(hostname)
-	defer C.free(unsafe.Pointer(hn))
-	C.vmtools_start(C.int(cards), hn)
-}
-
-func addVirtualRouting(dev, ip string) error {
+func outb(port uint16, value byte) error {
 
-	direct := C.CString(dev)
-	defer C.free(unsafe.Pointer(direct))
-
-	target := C.CString(ip)
-	defer C.free(unsafe.Pointer(target))
-
-	C.helper_add_gcp_virtual_route(direct, target)
+	err := C.helper_outb(C.int(port), C.int(value))
+	if err != 0 {
+		return syscall.Errno(err)
+	}
 
 	return nil
-
 }
 
 func addNetworkRoute4(dst, mask, gw net.IP, dev string, flags int) error {
@@ -0,0 +1,425 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// CloudHints are the values providers use to detect the platform
+type CloudHints struct {
+	// BIOSVendor from /sys/devices/virtual/dmi/id/bios_vendor
+	BIOSVendor string
+
+	// HypervisorUUID from /sys/hypervisor/uuid, starts with ec2 on Xen
+	// based EC2 instances
+	HypervisorUUID string
+
+	// DHCPAzure is set if the DHCP server sent azure's endpoint option
+	DHCPAzure bool
+
+	// DMI values from /sys/devices/virtual/dmi/id
+	SysVendor       string
+	ProductName     string
+	ChassisAssetTag string
+
+	// VolumeLabels are the lower case labels of iso9660 and vfat volumes,
+	// e.g. config-2
+	VolumeLabels []string
+}
+
+// hasVolume returns true if a volume with the label is attached
+func (h CloudHints) hasVolume(label string) bool {
+	for _, l := range h.VolumeLabels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// CloudProvider provides the instance metadata of a cloud platform. Values
+// which are not available are returned as empty values without error.
+type CloudProvider interface {
+	// Name is the value of CLOUD_PROVIDER, e.g. GCP
+	Name() string
+
+	// Detect returns true if the instance runs on this platform
+	Detect(hints CloudHints) bool
+
+	// ExternalIP returns the public address of the interface with the index
+	ExternalIP(idx int) (string, error)
+
+	Userdata() (string, error)
+	Hostname() (string, error)
+	Region() (string, error)
+	InstanceID() (string, error)
+	Tags() (map[string]string, error)
+	SSHKeys() ([]string, error)
+}
+
+// interfaceUpdater is implemented by providers which configure interfaces
+// from metadata, e.g. forwarded IPs of GCP load balancers. It is called
+// after setup and on every metadata refresh.
+type interfaceUpdater interface {
+	updateInterface(name string, idx int)
+}
+
+// changeWaiter is implemented by providers which can block until the
+// metadata changes. It returns the new version of the metadata, an empty
+// version returns immediately.
+type changeWaiter interface {
+	waitForChange(version string, timeout time.Duration) (string, error)
+}
+
+// metadataCacher is implemented by providers which read all values with
+// one expensive request. cloudEnvs caches it for the accessors of a pass.
+type metadataCacher interface {
+	cacheMetadata()
+	clearMetadata()
+}
+
+// readyReporter is implemented by providers which expect the instance to
+// report it has booted
+type readyReporter interface {
+	reportReady()
+}
+
+// failureReporter is implemented by providers which show failed boots in
+// the platform
+type failureReporter interface {
+	reportFailure(reason string)
+}
+
+// time to report a failed boot before the instance powers off
+const failureReportTimeout = 10 * time.Second
+
+var cloudProviders []CloudProvider
+
+// reportBootFailure tells the platform the instance failed to boot
+func reportBootFailure(reason string) {
+
+	if debugVinitd == nil {
+		return
+	}
+
+	if r, ok := debugVinitd.hypervisorInfo.provider.(failureReporter); ok {
+		reportFailureWithin(r, reason, failureReportTimeout)
+	}
+}
+
+// reportFailureWithin reports the failure and gives up after the timeout so
+// an unreachable platform does not delay the power off
+func reportFailureWithin(r failureReporter, reason string, timeout time.Duration) bool {
+
+	done := make(chan struct{})
+	go func() {
+		r.reportFailure(reason)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		logWarn("reporting boot failure timed out after %v", timeout)
+		return false
+	}
+}
+
+// RegisterCloudProvider adds a provider. Providers are detected in the order
+// they have been registered.
+func RegisterCloudProvider(p CloudProvider) {
+	cloudProviders = append(cloudProviders, p)
+}
+
+func init() {
+	RegisterCloudProvider(newGCPProvider(metadataURL))
+	RegisterCloudProvider(newEC2Provider(metadataURL))
+	RegisterCloudProvider(newAzureProvider(metadataURL, "http://"+azureWireServer))
+	RegisterCloudProvider(newDigitalOceanProvider(metadataURL))
+	RegisterCloudProvider(newOracleProvider(metadataURL))
+	RegisterCloudProvider(newOpenStackProvider(metadataURL))
+	RegisterCloudProvider(newHetznerProvider(metadataURL))
+	RegisterCloudProvider(newVMwareProvider(newRPCTransport()))
+}
+
+// errMetadataNotFound is returned if the metadata server has no value, it
+// is not set and not a failure
+var errMetadataNotFound = errors.New("metadata not found")
+
+// metadata requests time out so a stalled connection does not block the
+// watchers polling the metadata server
+var metadataHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// metadataClient requests values from a metadata server
+type metadataClient struct {
+	server        string
+	header, query map[string]string
+}
+
+func (c *metadataClient) get(path string) (string, error) {
+	return doMetadataRequest(c.server+path, c.header, c.query)
+}
+
+// getJSON requests a value with an additional query and decodes it
+func (c *metadataClient) getJSON(path string, query map[string]string, out interface{}) error {
+
+	q := make(map[string]string)
+	for k, val := range c.query {
+		q[k] = val
+	}
+	for k, val := range query {
+		q[k] = val
+	}
+
+	r, err := doMetadataRequest(c.server+path, c.header, q)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(r), out)
+}
+
+// hypervisorUUID returns the content of /sys/hypervisor/uuid
+func hypervisorUUID() string {
+
+	uuid, err := ioutil.ReadFile("/sys/hypervisor/uuid")
+	if err != nil {
+		return ""
+	}
+
+	logDebug("uuid value: %s", strings.TrimSpace(string(uuid)))
+
+	return strings.TrimSpace(string(uuid))
+}
+
+// dmiValue returns a DMI value, e.g. sys_vendor
+func dmiValue(name string) string {
+
+	b, err := ioutil.ReadFile(filepath.Join("/sys/devices/virtual/dmi/id", name))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// cloudHints collects the values for detection
+func cloudHints(bios string, dhcpAzure bool) CloudHints {
+
+	hints := CloudHints{
+		BIOSVendor:      strings.TrimSpace(bios),
+		HypervisorUUID:  hypervisorUUID(),
+		DHCPAzure:       dhcpAzure,
+		SysVendor:       dmiValue("sys_vendor"),
+		ProductName:     dmiValue("product_name"),
+		ChassisAssetTag: dmiValue("chassis_asset_tag"),
+	}
+
+	for l := range volumeLabels() {
+		hints.VolumeLabels = append(hints.VolumeLabels, l)
+	}
+	sort.Strings(hints.VolumeLabels)
+
+	logDebug("cloud hints: vendor '%s', product '%s', asset tag '%s', volumes %v",
+		hints.SysVendor, hints.ProductName, hints.ChassisAssetTag, hints.VolumeLabels)
+
+	return hints
+}
+
+// detectCloudProvider returns the first registered provider detecting the
+// platform
+func detectCloudProvider(hints CloudHints) CloudProvider {
+
+	for _, p := range cloudProviders {
+		if p.Detect(hints) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// cloudFromName returns the cloud constant of a provider name
+func cloudFromName(name string) cloud {
+
+	for c, s := range cloudStrings {
+		if s == name {
+			return c
+		}
+	}
+
+	return cpUnknown
+}
+
+// tagEnv converts a tag name to an environment variable name
+func tagEnv(k string) string {
+
+	return fmt.Sprintf(envTag, strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || (!unicode.IsLetter(r) && !unicode.IsDigit(r)) {
+			return '_'
+		}
+		return unicode.ToUpper(r)
+	}, k))
+}
+
+// setUserdata adds the userdata. JSON objects are used as environment
+// variables as well.
+func setUserdata(envs map[string]string, userdata string) {
+
+	// trying to marshal json, if it is key/value we will use it as envs
+	// otherwise we add it as USERDATA
+	var kv map[string]string
+	err := json.Unmarshal([]byte(userdata), &kv)
+
+	// set these as envs
+	if err == nil {
+		for key, value := range kv {
+			logDebug("setting metadata userdata %s to %s", key, redactValue(key, value))
+			envs[key] = value
+		}
+	}
+
+	logDebug("setting metadata userdata (%d bytes)", len(userdata))
+	envs[envUserData] = userdata
+}
+
+// cloudEnvs returns the environment variables of the provider's metadata.
+// Values which are not available or failed are missing, the error lists
+// the failed requests.
+func cloudEnvs(p CloudProvider, ifcs map[string]*ifc) (map[string]string, error) {
+
+	var failed []string
+
+	// values which are not set are missing without failure
+	fail := func(name string, err error) {
+		if !errors.Is(err, errMetadataNotFound) {
+			failed = append(failed, name)
+		}
+	}
+
+	envs := make(map[string]string)
+
+	if c, ok := p.(metadataCacher); ok {
+		c.cacheMetadata()
+		defer c.clearMetadata()
+	}
+
+	for _, ifc := range ifcs {
+
+		ip, err := p.ExternalIP(ifc.idx)
+		if err != nil {
+			logWarn("error requesting metadata: %s", err.Error())
+			fail(fmt.Sprintf(envExtIP, ifc.idx), err)
+			continue
+		}
+
+		if ip != "" {
+			logDebug("setting metadata %s to %s", fmt.Sprintf(envExtIP, ifc.idx), ip)
+			envs[fmt.Sprintf(envExtIP, ifc.idx)] = ip
+		}
+	}
+
+	userdata, err := p.Userdata()
+	if err != nil {
+		logDebug("error requesting metadata userdata: %s", err.Error())
+		fail(envUserData, err)
+	} else if userdata != "" {
+		setUserdata(envs, userdata)
+	}
+
+	values := []struct {
+		env string
+		fn  func() (string, error)
+	}{
+		{envExtHostname, p.Hostname},
+		{envRegion, p.Region},
+		{envInstanceID, p.InstanceID},
+	}
+
+	for _, val := range values {
+		s, err := val.fn()
+		if err != nil {
+			logDebug("error requesting metadata %s: %s", val.env, err.Error())
+			fail(val.env, err)
+			continue
+		}
+		if s != "" {
+			logDebug("setting metadata %s to %s", val.env, s)
+			envs[val.env] = s
+		}
+	}
+
+	tags, err := p.Tags()
+	if err != nil {
+		logDebug("error requesting metadata tags: %s", err.Error())
+		fail("tags", err)
+	}
+
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		logDebug("setting metadata %s to %s", tagEnv(k), redactValue(k, tags[k]))
+		envs[tagEnv(k)] = tags[k]
+	}
+
+	sshKeys, err := p.SSHKeys()
+	if err != nil {
+		logDebug("error requesting metadata ssh keys: %s", err.Error())
+		fail(envSSHKeys, err)
+	} else if len(sshKeys) > 0 {
+		logDebug("setting metadata %s (%d keys)", envSSHKeys, len(sshKeys))
+		envs[envSSHKeys] = strings.Join(sshKeys, "\n")
+	}
+
+	if len(failed) > 0 {
+		return envs, fmt.Errorf("requesting %s failed", strings.Join(failed, ", "))
+	}
+
+	return envs, nil
+}
+
+// updateInterfaces lets the provider configure the interfaces
+func updateInterfaces(p CloudProvider, ifcs map[string]*ifc) {
+
+	u, ok := p.(interfaceUpdater)
+	if !ok {
+		return
+	}
+
+	for _, ifc := range ifcs {
+		u.updateInterface(ifc.name, ifc.idx)
+	}
+}
+
+// probeCloud sets the environment variables from the provider's metadata
+func probeCloud(p CloudProvider, v *Vinitd) {
+
+	// failures have been logged, the values are missing
+	v.hypervisorInfo.metadata, _ = cloudEnvs(p, v.ifcs)
+
+	for k, val := range v.hypervisorInfo.metadata {
+		v.hypervisorInfo.envs[k] = val
+	}
+
+	go updateInterfaces(p, v.ifcs)
+}
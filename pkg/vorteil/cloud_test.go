@@ -0,0 +1,288 @@
+package vorteil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// metadataStub serves paths and checks a required header
+func metadataStub(t *testing.T, header, value string, paths map[string]string) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Header.Get(header) != value {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		p := r.URL.Path
+		if r.URL.RawQuery != "" {
+			p += "?" + r.URL.RawQuery
+		}
+
+		val, ok := paths[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(val))
+	}))
+
+}
+
+func TestDetectCloudProvider(t *testing.T) {
+
+	for name, hints := range map[string]CloudHints{
+		"GCP":   {BIOSVendor: "Google"},
+		"EC2":   {BIOSVendor: "Xen", HypervisorUUID: "ec2e1916-9099-7caf-fd21-012345abcdef"},
+		"AZURE": {BIOSVendor: "American Megatrends Inc.", DHCPAzure: true},
+
+		"DIGITALOCEAN": {BIOSVendor: "DigitalOcean", SysVendor: "DigitalOcean"},
+		"ORACLE":       {BIOSVendor: "SeaBIOS", ChassisAssetTag: "OracleCloud.com"},
+		"OPENSTACK":    {BIOSVendor: "SeaBIOS", VolumeLabels: []string{"config-2"}},
+		"HETZNER":      {BIOSVendor: "SeaBIOS", SysVendor: "Hetzner"},
+	} {
+		p := detectCloudProvider(hints)
+		if assert.NotNil(t, p, name) {
+			assert.Equal(t, name, p.Name())
+		}
+	}
+
+	assert.Nil(t, detectCloudProvider(CloudHints{BIOSVendor: "Xen"}))
+	assert.Nil(t, detectCloudProvider(CloudHints{BIOSVendor: "American Megatrends Inc."}))
+
+}
+
+func TestGCPProvider(t *testing.T) {
+
+	srv := metadataStub(t, "Metadata-Flavor", "Google", map[string]string{
+		"/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip": "35.1.2.3",
+		"/computeMetadata/v1/instance/attributes/user-data":                              "#cloud-config\n",
+		"/computeMetadata/v1/instance/hostname":                                          "vm.c.project.internal",
+		"/computeMetadata/v1/instance/zone":                                              "projects/123/zones/europe-west1-b",
+		"/computeMetadata/v1/instance/id":                                                "4711",
+		"/computeMetadata/v1/instance/attributes/?recursive=true":                        `{"env": "prod", "ssh-keys": "x"}`,
+		"/computeMetadata/v1/instance/attributes/ssh-keys":                               "admin:ssh-ed25519 AAAA admin\n",
+	})
+	defer srv.Close()
+
+	v := &Vinitd{
+		ifcs:           map[string]*ifc{"eth0": {name: "eth0", idx: 0}},
+		hypervisorInfo: hv{envs: make(map[string]string)},
+	}
+
+	probeCloud(newGCPProvider(srv.URL), v)
+
+	envs := v.hypervisorInfo.envs
+	assert.Equal(t, "35.1.2.3", envs["EXT_IP0"])
+	assert.Equal(t, "#cloud-config", envs[envUserData])
+	assert.Equal(t, "vm.c.project.internal", envs[envExtHostname])
+	assert.Equal(t, "europe-west1", envs[envRegion])
+	assert.Equal(t, "4711", envs[envInstanceID])
+	assert.Equal(t, "prod", envs["CLOUD_TAG_ENV"])
+	assert.NotContains(t, envs, "CLOUD_TAG_SSH_KEYS")
+	assert.Equal(t, "ssh-ed25519 AAAA admin", envs[envSSHKeys])
+
+}
+
+func TestEC2Provider(t *testing.T) {
+
+	srv := metadataStub(t, "Metadata", "true", map[string]string{
+		"/latest/meta-data/public-ipv4":               `52.1.2.3`,
+		"/latest/user-data":                           `{"PORT": "80"}`,
+		"/latest/meta-data/public-hostname":           "ec2-52-1-2-3.compute.amazonaws.com",
+		"/latest/dynamic/instance-identity/document":  `{"region": "eu-west-1", "instanceId": "i-123"}`,
+		"/latest/meta-data/tags/instance":             "Name\nteam",
+		"/latest/meta-data/tags/instance/Name":        "web",
+		"/latest/meta-data/tags/instance/team":        "ops",
+		"/latest/meta-data/public-keys/":              "0=my-key",
+		"/latest/meta-data/public-keys/0/openssh-key": "ssh-rsa AAAA my-key",
+	})
+	defer srv.Close()
+
+	v := &Vinitd{
+		ifcs: map[string]*ifc{
+			"eth0": {name: "eth0", idx: 0},
+			"eth1": {name: "eth1", idx: 1},
+		},
+		hypervisorInfo: hv{envs: map[string]string{"EXT_IP1": "10.0.1.5"}},
+	}
+
+	probeCloud(newEC2Provider(srv.URL), v)
+
+	envs := v.hypervisorInfo.envs
+	assert.Equal(t, "52.1.2.3", envs["EXT_IP0"])
+	assert.Equal(t, "10.0.1.5", envs["EXT_IP1"])
+	assert.Equal(t, "80", envs["PORT"])
+	assert.Equal(t, "eu-west-1", envs[envRegion])
+	assert.Equal(t, "i-123", envs[envInstanceID])
+	assert.Equal(t, "web", envs["CLOUD_TAG_NAME"])
+	assert.Equal(t, "ops", envs["CLOUD_TAG_TEAM"])
+	assert.Equal(t, "ssh-rsa AAAA my-key", envs[envSSHKeys])
+
+}
+
+func TestAzureProvider(t *testing.T) {
+
+	q := "?api-version=2019-02-01&format=text"
+
+	srv := metadataStub(t, "Metadata", "True", map[string]string{
+		"/metadata/instance/network/interface/0/ipv4/ipAddress/0/publicIpAddress" + q: "20.1.2.3",
+		"/metadata/instance/compute/location" + q:                                     "westeurope",
+		"/metadata/instance/compute/vmId" + q:                                         "0d7e8e42",
+		"/metadata/instance/compute/tags" + q:                                         "env:prod;cost-center:42",
+		"/metadata/instance/compute/publicKeys?api-version=2019-02-01&format=json":    `[{"keyData": "ssh-rsa AAAA\r\n", "path": "/home/a/.ssh/authorized_keys"}]`,
+	})
+	defer srv.Close()
+
+	p := newAzureProvider(srv.URL, "")
+	p.readOVF = func() ([]byte, error) {
+		return nil, os.ErrNotExist
+	}
+
+	tags, err := p.Tags()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"env": "prod", "cost-center": "42"}, tags)
+
+	v := &Vinitd{
+		ifcs:           map[string]*ifc{"eth0": {name: "eth0", idx: 0}},
+		hypervisorInfo: hv{envs: map[string]string{envExtHostname: "vorteil-1"}},
+	}
+
+	probeCloud(p, v)
+
+	envs := v.hypervisorInfo.envs
+	assert.Equal(t, "20.1.2.3", envs["EXT_IP0"])
+	assert.Equal(t, "vorteil-1", envs[envExtHostname])
+	assert.Equal(t, "westeurope", envs[envRegion])
+	assert.Equal(t, "0d7e8e42", envs[envInstanceID])
+	assert.Equal(t, "42", envs["CLOUD_TAG_COST_CENTER"])
+	assert.Equal(t, "ssh-rsa AAAA", envs[envSSHKeys])
+	assert.NotContains(t, envs, envUserData)
+
+}
+
+func TestOtherProviders(t *testing.T) {
+
+	srv := metadataStub(t, "Authorization", "Bearer Oracle", map[string]string{
+		"/opc/v2/instance/": `{"id": "ocid1.instance.oc1", "hostname": "oci-1", "canonicalRegionName": "eu-frankfurt-1",
+			"metadata": {"ssh_authorized_keys": "ssh-rsa AAAA", "user_data": "I2Nsb3VkLWNvbmZpZw=="},
+			"freeformTags": {"env": "prod"}, "definedTags": {"ops": {"team": "sre"}}}`,
+	})
+	defer srv.Close()
+
+	oracle := newOracleProvider(srv.URL)
+	ud, err := oracle.Userdata()
+	assert.NoError(t, err)
+	assert.Equal(t, "#cloud-config", ud)
+
+	tags, err := oracle.Tags()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"env": "prod", "ops.team": "sre"}, tags)
+
+	for _, tc := range []struct {
+		provider func(string) CloudProvider
+		paths    map[string]string
+	}{
+		{
+			func(s string) CloudProvider { return newDigitalOceanProvider(s) },
+			map[string]string{
+				"/metadata/v1/interfaces/public/0/ipv4/address": "1.2.3.4",
+				"/metadata/v1/hostname":                         "host",
+				"/metadata/v1/region":                           "region",
+				"/metadata/v1/id":                               "id",
+				"/metadata/v1/tags/":                            "env",
+				"/metadata/v1/public-keys":                      "ssh-rsa AAAA",
+			},
+		},
+		{
+			func(s string) CloudProvider { return newOpenStackProvider(s) },
+			map[string]string{
+				"/latest/meta-data/public-ipv4": "1.2.3.4",
+				"/openstack/latest/meta_data.json": `{"uuid": "id", "hostname": "host", "availability_zone": "region",
+					"public_keys": {"key": "ssh-rsa AAAA\n"}, "meta": {"env": "true"}}`,
+			},
+		},
+		{
+			func(s string) CloudProvider { return newHetznerProvider(s) },
+			map[string]string{
+				"/hetzner/v1/metadata/public-ipv4": "1.2.3.4",
+				"/hetzner/v1/metadata/hostname":    "host",
+				"/hetzner/v1/metadata/region":      "region",
+				"/hetzner/v1/metadata/instance-id": "id",
+				"/hetzner/v1/metadata/public-keys": `["ssh-rsa AAAA"]`,
+			},
+		},
+	} {
+
+		srv := metadataStub(t, "", "", tc.paths)
+		p := tc.provider(srv.URL)
+
+		v := &Vinitd{
+			ifcs:           map[string]*ifc{"eth0": {name: "eth0", idx: 0}},
+			hypervisorInfo: hv{envs: make(map[string]string)},
+		}
+		probeCloud(p, v)
+		srv.Close()
+
+		envs := v.hypervisorInfo.envs
+		assert.Equal(t, "1.2.3.4", envs["EXT_IP0"], p.Name())
+		assert.Equal(t, "host", envs[envExtHostname], p.Name())
+		assert.Equal(t, "region", envs[envRegion], p.Name())
+		assert.Equal(t, "id", envs[envInstanceID], p.Name())
+		assert.Equal(t, "ssh-rsa AAAA", envs[envSSHKeys], p.Name())
+		if p.Name() != "HETZNER" {
+			assert.Equal(t, "true", envs["CLOUD_TAG_ENV"], p.Name())
+		}
+	}
+
+}
+
+type blockingReporter struct {
+	release chan struct{}
+}
+
+func (r *blockingReporter) reportFailure(reason string) {
+	<-r.release
+}
+
+func TestReportFailureWithin(t *testing.T) {
+
+	r := &blockingReporter{release: make(chan struct{})}
+	defer close(r.release)
+
+	start := time.Now()
+	assert.False(t, reportFailureWithin(r, "starting program failed", 100*time.Millisecond))
+	assert.True(t, time.Since(start) < time.Second)
+
+	done := &blockingReporter{release: make(chan struct{})}
+	close(done.release)
+	assert.True(t, reportFailureWithin(done, "starting program failed", time.Second))
+
+}
+
+func TestMetadataClientTimeout(t *testing.T) {
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	defer func(c *http.Client) { metadataHTTPClient = c }(metadataHTTPClient)
+	metadataHTTPClient = &http.Client{Timeout: 100 * time.Millisecond}
+
+	c := &metadataClient{server: srv.URL}
+
+	start := time.Now()
+	_, err := c.get("/stalled")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+}
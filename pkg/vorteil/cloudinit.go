@@ -0,0 +1,592 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	cloudConfigHeader = "#cloud-config"
+	cloudScriptHeader = "#!"
+
+	cloudConfigType = "text/cloud-config"
+	cloudScriptType = "text/x-shellscript"
+
+	cloudInitDir = "cloud-init"
+)
+
+// shell used for runcmd string entries if the image has one
+var cloudShell = "/bin/sh"
+
+// cloudFile is an entry of write_files
+type cloudFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Encoding    string `yaml:"encoding"`
+	Owner       string `yaml:"owner"`
+	Permissions string `yaml:"permissions"`
+	Append      bool   `yaml:"append"`
+}
+
+// cloudConfig is the supported subset of #cloud-config. env is a vinitd
+// extension and adds variables to all programs.
+type cloudConfig struct {
+	Hostname         string        `yaml:"hostname"`
+	FQDN             string        `yaml:"fqdn"`
+	PreserveHostname bool          `yaml:"preserve_hostname"`
+	WriteFiles       []cloudFile   `yaml:"write_files"`
+	RunCmd           []interface{} `yaml:"runcmd"`
+
+	NTP struct {
+		Servers []string `yaml:"servers"`
+		Pools   []string `yaml:"pools"`
+	} `yaml:"ntp"`
+
+	ResolvConf struct {
+		Nameservers   []string `yaml:"nameservers"`
+		SearchDomains []string `yaml:"searchdomains"`
+	} `yaml:"resolv_conf"`
+
+	Env map[string]string `yaml:"env"`
+}
+
+// cloudInit is the merged content of all userdata parts
+type cloudInit struct {
+	config  cloudConfig
+	scripts [][]byte
+}
+
+func hasPrefix(b []byte, prefix ...string) bool {
+	for _, p := range prefix {
+		if bytes.HasPrefix(b, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMultipart(b []byte) bool {
+	return hasPrefix(b, "Content-Type:", "MIME-Version:")
+}
+
+// decodeUserdata removes gzip compression and base64 encoding, e.g. azure's
+// customData is always base64 encoded
+func decodeUserdata(b []byte) []byte {
+
+	if hasPrefix(b, "\x1f\x8b") {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return b
+		}
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			return b
+		}
+		return decodeUserdata(d)
+	}
+
+	if isCloudInit(b) {
+		return b
+	}
+
+	d, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err == nil && (isCloudInit(d) || hasPrefix(d, "\x1f\x8b")) {
+		return decodeUserdata(d)
+	}
+
+	return b
+}
+
+// isCloudInit returns true if the userdata is a cloud-config, script or
+// multipart message
+func isCloudInit(b []byte) bool {
+	return hasPrefix(b, cloudConfigHeader, cloudScriptHeader) || isMultipart(b)
+}
+
+// parseCloudInit parses cloud-init userdata
+func parseCloudInit(b []byte) (*cloudInit, error) {
+
+	ci := &cloudInit{}
+
+	err := ci.parsePart("", nil, decodeUserdata(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return ci, nil
+}
+
+// parsePart adds a part of the userdata. Without content type the type is
+// detected from the first line.
+func (ci *cloudInit) parsePart(ct string, params map[string]string, b []byte) error {
+
+	b = decodeUserdata(b)
+
+	switch {
+	case ct == cloudConfigType || (ct == "" && hasPrefix(b, cloudConfigHeader)):
+		var cc cloudConfig
+		err := yaml.Unmarshal(b, &cc)
+		if err != nil {
+			return fmt.Errorf("can not parse cloud-config: %v", err)
+		}
+		ci.config.merge(cc)
+	case ct == cloudScriptType || (ct == "" && hasPrefix(b, cloudScriptHeader)):
+		ci.scripts = append(ci.scripts, b)
+	case strings.HasPrefix(ct, "multipart/"):
+		return ci.parseMultipart(bytes.NewReader(b), params["boundary"])
+	case ct == "" && isMultipart(b):
+		msg, err := mail.ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil || !strings.HasPrefix(mt, "multipart/") {
+			return fmt.Errorf("userdata is not a multipart message")
+		}
+		return ci.parseMultipart(msg.Body, params["boundary"])
+	case ct == "text/plain" && isCloudInit(b):
+		return ci.parsePart("", nil, b)
+	default:
+		logWarn("cloud-init: unsupported userdata part %s", ct)
+	}
+
+	return nil
+}
+
+func (ci *cloudInit) parseMultipart(r io.Reader, boundary string) error {
+
+	if boundary == "" {
+		return fmt.Errorf("multipart message without boundary")
+	}
+
+	mr := multipart.NewReader(r, boundary)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			return err
+		}
+
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			b, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(b)), ""))
+			if err != nil {
+				return fmt.Errorf("can not decode part: %v", err)
+			}
+		}
+
+		ct, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+
+		err = ci.parsePart(ct, params, b)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// merge adds another cloud-config. Values are replaced, lists are appended.
+func (c *cloudConfig) merge(o cloudConfig) {
+
+	if o.Hostname != "" {
+		c.Hostname = o.Hostname
+	}
+	if o.FQDN != "" {
+		c.FQDN = o.FQDN
+	}
+	c.PreserveHostname = c.PreserveHostname || o.PreserveHostname
+
+	c.WriteFiles = append(c.WriteFiles, o.WriteFiles...)
+	c.RunCmd = append(c.RunCmd, o.RunCmd...)
+
+	c.NTP.Servers = append(c.NTP.Servers, o.NTP.Servers...)
+	c.NTP.Pools = append(c.NTP.Pools, o.NTP.Pools...)
+
+	c.ResolvConf.Nameservers = append(c.ResolvConf.Nameservers, o.ResolvConf.Nameservers...)
+	c.ResolvConf.SearchDomains = append(c.ResolvConf.SearchDomains, o.ResolvConf.SearchDomains...)
+
+	for k, val := range o.Env {
+		if c.Env == nil {
+			c.Env = make(map[string]string)
+		}
+		c.Env[k] = val
+	}
+}
+
+// content returns the decoded content of the file
+func (f cloudFile) content() ([]byte, error) {
+
+	var b64, gz bool
+
+	switch strings.ToLower(f.Encoding) {
+	case "", "text/plain":
+		return []byte(f.Content), nil
+	case "b64", "base64":
+		b64 = true
+	case "gz", "gzip":
+		gz = true
+	case "gz+b64", "gz+base64", "gzip+b64", "gzip+base64":
+		b64, gz = true, true
+	default:
+		return nil, fmt.Errorf("unknown encoding %s", f.Encoding)
+	}
+
+	b := []byte(f.Content)
+	if b64 {
+		var err error
+		b, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(f.Content), ""))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if gz {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	return b, nil
+}
+
+func (f cloudFile) write() error {
+
+	if !filepath.IsAbs(f.Path) {
+		return fmt.Errorf("path %s is not absolute", f.Path)
+	}
+
+	b, err := f.content()
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Path, err)
+	}
+
+	mode := os.FileMode(0644)
+	if f.Permissions != "" {
+		mode, err = parseMode(strings.TrimPrefix(f.Permissions, "0o"))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(f.Path), 0755)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if f.Append {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(f.Path, flags, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(b)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// existing files keep their mode otherwise
+	if !f.Append {
+		err = os.Chmod(f.Path, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.Owner != "" {
+		uid, gid, err := lookupOwner(f.Owner)
+		if err != nil {
+			return err
+		}
+		return os.Lchown(f.Path, uid, gid)
+	}
+
+	return nil
+}
+
+// shellQuote quotes an argument for shellwords
+func shellQuote(s string) string {
+
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`|&;<>()*?[]#~") {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// cloudCommands converts runcmd entries into command lines. Lists are
+// executed directly, strings with the shell or split with shell rules if
+// there is none. With a shell all entries run in one script like cloud-init
+// does.
+func cloudCommands(runcmd []interface{}, shell bool) ([]string, error) {
+
+	var cmds []string
+
+	for i, c := range runcmd {
+		switch c := c.(type) {
+		case string:
+			cmds = append(cmds, c)
+		case []interface{}:
+			var args []string
+			for _, a := range c {
+				args = append(args, shellQuote(fmt.Sprint(a)))
+			}
+			cmds = append(cmds, strings.Join(args, " "))
+		default:
+			return nil, fmt.Errorf("runcmd entry %d is neither string nor list", i)
+		}
+	}
+
+	if shell && len(cmds) > 0 {
+		return []string{strings.Join(cmds, "\n") + "\n"}, nil
+	}
+
+	return cmds, nil
+}
+
+// addCloudProgram adds a one-shot program after the VCFG programs
+func (v *Vinitd) addCloudProgram(binary, args string) error {
+
+	err := v.prepProgram(vcfg.Program{
+		Binary:    binary,
+		Args:      args,
+		Env:       []string{fmt.Sprintf(environString, optionType, programOneshot)},
+		Privilege: vcfg.RootPrivilege,
+	}, len(v.programs))
+	if err != nil {
+		return err
+	}
+
+	v.programs[len(v.programs)-1].cloudInit = true
+
+	return nil
+}
+
+// writeCloudScript stores a script in the run directory
+func writeCloudScript(name string, b []byte) (string, error) {
+
+	dir, err := runDir(cloudInitDir)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+
+	return path, ioutil.WriteFile(path, b, 0755)
+}
+
+// applyHostname sets hostname or fqdn of the cloud-config
+func (v *Vinitd) applyHostname(cc cloudConfig) error {
+
+	name := cc.FQDN
+	if name == "" {
+		name = cc.Hostname
+	}
+
+	if name == "" || cc.PreserveHostname {
+		return nil
+	}
+
+	hn, err := setHostname(name)
+	if err != nil {
+		return err
+	}
+
+	if hn == v.hostname {
+		return nil
+	}
+
+	err = procsys("kernel/hostname", hn)
+	if err != nil {
+		return err
+	}
+
+	logDebug("changed hostname from %s to %s", v.hostname, hn)
+	v.hostname = hn
+	v.hypervisorInfo.envs[envHostname] = hn
+	v.hypervisorInfo.envs[envExtHostname] = hn
+
+	if v.readOnly {
+		return nil
+	}
+
+	os.Remove("/etc/hosts")
+	os.Remove("/etc/hostname")
+
+	return genHostnameFile(hn)
+}
+
+// applyResolvConf adds nameservers before the ones from DHCP and search
+// domains
+func (v *Vinitd) applyResolvConf(cc cloudConfig) error {
+
+	// a retry must not add them twice
+	var ips []net.IP
+	for _, ns := range cc.ResolvConf.Nameservers {
+		ip := net.ParseIP(ns)
+		if ip == nil {
+			logWarn("cloud-init: invalid nameserver %s", ns)
+			continue
+		}
+		if !containsIP(v.dns, ip) && !containsIP(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	v.dns = append(ips, v.dns...)
+
+	if len(cc.ResolvConf.SearchDomains) == 0 {
+		return nil
+	}
+
+	for _, d := range cc.ResolvConf.SearchDomains {
+		if !containsString(v.searchDomains, d) {
+			v.searchDomains = append(v.searchDomains, d)
+		}
+	}
+
+	if v.readOnly {
+		return nil
+	}
+
+	return writeSearchDomains(v.searchDomains)
+}
+
+// applyPrograms adds scripts and runcmd as one-shot programs. Scripts run
+// first like cloud-init's scripts-user.
+func (v *Vinitd) applyPrograms(ci *cloudInit) error {
+
+	for i, s := range ci.scripts {
+		path, err := writeCloudScript(fmt.Sprintf("part-%03d", i), s)
+		if err != nil {
+			return err
+		}
+		err = v.addCloudProgram(path, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := os.Stat(cloudShell)
+	shell := err == nil
+
+	cmds, err := cloudCommands(ci.config.RunCmd, shell)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range cmds {
+
+		if !shell {
+			err = v.addCloudProgram("", c)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		path, err := writeCloudScript("runcmd", []byte(c))
+		if err != nil {
+			return err
+		}
+		err = v.addCloudProgram(cloudShell, shellQuote(path))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// processCloudInit applies cloud-init userdata. It runs after the metadata
+// has been fetched and before DNS and NTP are started.
+func (v *Vinitd) processCloudInit() error {
+
+	ud, ok := v.hypervisorInfo.envs[envUserData]
+	if !ok || !isCloudInit(decodeUserdata([]byte(ud))) {
+		return nil
+	}
+
+	ci, err := parseCloudInit([]byte(ud))
+	if err != nil {
+		return err
+	}
+
+	cc := ci.config
+
+	logDebug("cloud-init: %d files, %d commands, %d scripts", len(cc.WriteFiles),
+		len(cc.RunCmd), len(ci.scripts))
+
+	for k, val := range cc.Env {
+		logDebug("setting cloud-init env %s to %s", k, redactValue(k, val))
+		v.hypervisorInfo.envs[k] = val
+	}
+
+	if v.readOnly && len(cc.WriteFiles) > 0 {
+		logWarn("filesystem read-only, can not write cloud-init files")
+	} else {
+		for _, f := range cc.WriteFiles {
+			logDebug("cloud-init: writing %s", f.Path)
+			err = f.write()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = v.applyHostname(cc)
+	if err != nil {
+		return err
+	}
+
+	err = v.applyResolvConf(cc)
+	if err != nil {
+		return err
+	}
+
+	// a retry must not add the programs twice
+	n := len(v.programs)
+	err = v.applyPrograms(ci)
+	if err != nil {
+		v.programs = v.programs[:n]
+		return err
+	}
+
+	// chrony uses them like servers from DHCP
+	for _, s := range append(cc.NTP.Servers, cc.NTP.Pools...) {
+		if !containsString(v.vcfg.System.NTP, s) {
+			v.vcfg.System.NTP = append(v.vcfg.System.NTP, s)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package vorteil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+const testCloudConfig = `#cloud-config
+hostname: web-1
+write_files:
+- path: /etc/app.conf
+  content: aGVsbG8=
+  encoding: b64
+  permissions: '0600'
+runcmd:
+- [echo, "hello world"]
+- echo $HOSTNAME > /tmp/host
+ntp:
+  servers: [10.0.0.1]
+resolv_conf:
+  nameservers: [10.0.0.53]
+  searchdomains: [internal]
+env:
+  PORT: 8080
+`
+
+func TestParseCloudInit(t *testing.T) {
+
+	ci, err := parseCloudInit([]byte(testCloudConfig))
+	assert.NoError(t, err)
+
+	cc := ci.config
+	assert.Equal(t, "web-1", cc.Hostname)
+	assert.Equal(t, "8080", cc.Env["PORT"])
+	assert.Equal(t, []string{"10.0.0.1"}, cc.NTP.Servers)
+	assert.Equal(t, []string{"internal"}, cc.ResolvConf.SearchDomains)
+	assert.Len(t, cc.WriteFiles, 1)
+
+	cmds, err := cloudCommands(cc.RunCmd, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo 'hello world'", "echo $HOSTNAME > /tmp/host"}, cmds)
+
+	cmds, err = cloudCommands(cc.RunCmd, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo 'hello world'\necho $HOSTNAME > /tmp/host\n"}, cmds)
+
+	// azure passes customData base64 encoded
+	ci, err = parseCloudInit([]byte(base64.StdEncoding.EncodeToString([]byte(testCloudConfig))))
+	assert.NoError(t, err)
+	assert.Equal(t, "web-1", ci.config.Hostname)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("#!/bin/sh\necho hi\n"))
+	w.Close()
+	ci, err = parseCloudInit(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("#!/bin/sh\necho hi\n")}, ci.scripts)
+
+	assert.False(t, isCloudInit(decodeUserdata([]byte(`{"PORT": "80"}`))))
+
+}
+
+func TestParseCloudInitMultipart(t *testing.T) {
+
+	script := base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\necho part\n"))
+
+	ud := "Content-Type: multipart/mixed; boundary=\"BOUNDARY\"\r\n" +
+		"MIME-Version: 1.0\r\n\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: text/cloud-config; charset=\"us-ascii\"\r\n\r\n" +
+		"#cloud-config\nhostname: first\nruncmd: [a]\n\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: text/x-shellscript\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		script + "\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: text/cloud-config\r\n\r\n" +
+		"#cloud-config\nhostname: second\nruncmd: [b]\n\r\n" +
+		"--BOUNDARY--\r\n"
+
+	ci, err := parseCloudInit([]byte(ud))
+	assert.NoError(t, err)
+	assert.Equal(t, "second", ci.config.Hostname)
+	assert.Equal(t, []interface{}{"a", "b"}, ci.config.RunCmd)
+	assert.Equal(t, [][]byte{[]byte("#!/bin/sh\necho part\n")}, ci.scripts)
+
+}
+
+func TestCloudWriteFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "cloudinit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "etc", "app.conf")
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("compressed"))
+	w.Close()
+
+	for _, f := range []cloudFile{
+		{Path: path, Content: "aGVsbG8=", Encoding: "b64", Permissions: "0600"},
+		{Path: path, Content: "\nworld", Append: true},
+		{Path: path + ".gz", Content: base64.StdEncoding.EncodeToString(buf.Bytes()), Encoding: "gz+b64"},
+	} {
+		assert.NoError(t, f.write())
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "hello\nworld", string(b))
+
+	fi, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	b, _ = ioutil.ReadFile(path + ".gz")
+	assert.Equal(t, "compressed", string(b))
+
+	assert.Error(t, cloudFile{Path: "relative"}.write())
+	assert.Error(t, cloudFile{Path: path, Encoding: "rot13"}.write())
+
+}
+
+func TestCloudResolvConfRetry(t *testing.T) {
+
+	v := &Vinitd{readOnly: true, dns: []net.IP{net.IPv4(10, 0, 0, 2)}}
+
+	var cc cloudConfig
+	cc.ResolvConf.Nameservers = []string{"1.1.1.1", "10.0.0.2"}
+	cc.ResolvConf.SearchDomains = []string{"example.com"}
+
+	// a retry of the cloud-init step applies the config again
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, v.applyResolvConf(cc))
+	}
+
+	assert.Equal(t, []net.IP{net.ParseIP("1.1.1.1"), net.IPv4(10, 0, 0, 2)}, v.dns)
+	assert.Equal(t, []string{"example.com"}, v.searchDomains)
+
+}
+
+func TestCloudProgramPolicy(t *testing.T) {
+
+	v := &Vinitd{}
+	assert.NoError(t, v.addCloudProgram("/bin/sh", "-c 'exit 1'"))
+	assert.NoError(t, v.prepProgram(vcfg.Program{
+		Binary: "/bin/true",
+		Env:    []string{"VINITD_TYPE=oneshot"},
+	}, 1))
+
+	assert.Equal(t, failureCloud, v.programs[0].oneshotFailure())
+	assert.Equal(t, failureOneshot, v.programs[1].oneshotFailure())
+	assert.Equal(t, failDegrade, failureDefaults[failureCloud].action)
+
+}
@@ -0,0 +1,929 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	gcpMetadataHeader = map[string]string{
+		"Host":            "metadata.google.internal",
+		"Metadata-Flavor": "Google",
+	}
+
+	ec2MetadataHeader = map[string]string{
+		"Host":     "metadata.ec2.internal",
+		"Metadata": "true",
+	}
+
+	azureMetadataHeader = map[string]string{
+		"Metadata": "True",
+		"Host":     "metadata.azure.internal",
+	}
+
+	azureMetadataQuery = map[string]string{
+		"format":      "text",
+		"api-version": "2019-02-01",
+	}
+)
+
+// lines splits a metadata listing
+func lines(s string) []string {
+
+	var ls []string
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			ls = append(ls, l)
+		}
+	}
+
+	return ls
+}
+
+type gcpProvider struct {
+	metadataClient
+
+	// updates of local routes from boot and the metadata watcher
+	routeMtx sync.Mutex
+}
+
+func newGCPProvider(server string) *gcpProvider {
+	return &gcpProvider{
+		metadataClient: metadataClient{server: server, header: gcpMetadataHeader},
+	}
+}
+
+func (p *gcpProvider) Name() string {
+	return cloudStrings[cpGCP]
+}
+
+func (p *gcpProvider) Detect(hints CloudHints) bool {
+	return strings.HasPrefix(hints.BIOSVendor, "Google")
+}
+
+func (p *gcpProvider) ExternalIP(idx int) (string, error) {
+	return p.get(fmt.Sprintf("/computeMetadata/v1/instance/network-interfaces/%d/access-configs/0/external-ip", idx))
+}
+
+// Userdata uses the vorteil attribute and user-data like cloud-init
+func (p *gcpProvider) Userdata() (string, error) {
+
+	ud, err := p.get("/computeMetadata/v1/instance/attributes/vorteil")
+	if err != nil {
+		return p.get("/computeMetadata/v1/instance/attributes/user-data")
+	}
+
+	return ud, nil
+}
+
+func (p *gcpProvider) Hostname() (string, error) {
+	return p.get("/computeMetadata/v1/instance/hostname")
+}
+
+// Region is the zone without its suffix, e.g. us-central1 for
+// projects/123/zones/us-central1-a
+func (p *gcpProvider) Region() (string, error) {
+
+	zone, err := p.get("/computeMetadata/v1/instance/zone")
+	if err != nil {
+		return "", err
+	}
+
+	zone = path.Base(zone)
+	if i := strings.LastIndexByte(zone, '-'); i > 0 {
+		zone = zone[:i]
+	}
+
+	return zone, nil
+}
+
+func (p *gcpProvider) InstanceID() (string, error) {
+	return p.get("/computeMetadata/v1/instance/id")
+}
+
+// Tags returns the custom metadata of the instance
+func (p *gcpProvider) Tags() (map[string]string, error) {
+
+	var attrs map[string]string
+	err := p.getJSON("/computeMetadata/v1/instance/attributes/", map[string]string{"recursive": "true"}, &attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range []string{"vorteil", "user-data", "ssh-keys", "sshKeys", "startup-script"} {
+		delete(attrs, k)
+	}
+
+	return attrs, nil
+}
+
+// SSHKeys returns the keys of project and instance, entries are
+// user:key
+func (p *gcpProvider) SSHKeys() ([]string, error) {
+
+	var keys []string
+
+	for _, u := range []string{
+		"/computeMetadata/v1/project/attributes/ssh-keys",
+		"/computeMetadata/v1/instance/attributes/ssh-keys",
+	} {
+		r, err := p.get(u)
+		if err != nil {
+			continue
+		}
+		for _, l := range lines(r) {
+			if i := strings.IndexByte(l, ':'); i > 0 && !strings.Contains(l[:i], " ") {
+				l = l[i+1:]
+			}
+			keys = append(keys, l)
+		}
+	}
+
+	return keys, nil
+}
+
+// waitForChange long-polls the metadata server. The version is the ETag of
+// the instance and project metadata.
+func (p *gcpProvider) waitForChange(etag string, timeout time.Duration) (string, error) {
+
+	req, err := http.NewRequest(http.MethodGet, p.server+"/computeMetadata/v1/", nil)
+	if err != nil {
+		return "", err
+	}
+
+	for k, v := range p.header {
+		req.Header.Add(k, v)
+	}
+
+	q := req.URL.Query()
+	q.Add("recursive", "true")
+	if etag != "" {
+		q.Add("wait_for_change", "true")
+		q.Add("last_etag", etag)
+		q.Add("timeout_sec", strconv.Itoa(int(timeout.Seconds())))
+	}
+	req.URL.RawQuery = q.Encode()
+
+	client := &http.Client{
+		Timeout: timeout + 10*time.Second,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata wait failed with status %d", resp.StatusCode)
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// interruption returns preemptions and host maintenance. Preempted
+// instances are stopped after 30 seconds, maintenance terminating the
+// instance happens after 60 seconds.
+func (p *gcpProvider) interruption() (*interruption, error) {
+
+	r, err := p.get("/computeMetadata/v1/instance/preempted")
+	if err != nil {
+		return nil, err
+	}
+
+	if r == "TRUE" {
+		return &interruption{
+			kind:     interruptionPreemption,
+			shutdown: true,
+			deadline: time.Now().Add(30 * time.Second),
+			id:       "preempted",
+		}, nil
+	}
+
+	r, err = p.get("/computeMetadata/v1/instance/maintenance-event")
+	if err != nil {
+		return nil, err
+	}
+
+	switch r {
+	case "", "NONE":
+		return nil, nil
+	case "TERMINATE_ON_HOST_MAINTENANCE":
+		return &interruption{
+			kind:     interruptionMaintenance,
+			shutdown: true,
+			deadline: time.Now().Add(60 * time.Second),
+			id:       r,
+		}, nil
+	}
+
+	return &interruption{kind: interruptionMaintenance, id: r}, nil
+}
+
+type ec2Provider struct {
+	metadataClient
+
+	identityOnce sync.Once
+	identity     map[string]interface{}
+	identityErr  error
+}
+
+func newEC2Provider(server string) *ec2Provider {
+	return &ec2Provider{
+		metadataClient: metadataClient{server: server, header: ec2MetadataHeader},
+	}
+}
+
+// get uses IMDSv2 tokens if available
+func (p *ec2Provider) get(path string) (string, error) {
+	return imdsGet(p.server, path)
+}
+
+func (p *ec2Provider) Name() string {
+	return cloudStrings[cpEC2]
+}
+
+func (p *ec2Provider) Detect(hints CloudHints) bool {
+	return strings.HasPrefix(hints.BIOSVendor, "Amazon") ||
+		(strings.HasPrefix(hints.BIOSVendor, "Xen") && strings.HasPrefix(hints.HypervisorUUID, "ec2"))
+}
+
+// ExternalIP returns the public address of the primary interface only
+func (p *ec2Provider) ExternalIP(idx int) (string, error) {
+
+	if idx > 0 {
+		return "", nil
+	}
+
+	return p.get("/latest/meta-data/public-ipv4")
+}
+
+func (p *ec2Provider) Userdata() (string, error) {
+	return p.get("/latest/user-data")
+}
+
+func (p *ec2Provider) Hostname() (string, error) {
+	return p.get("/latest/meta-data/public-hostname")
+}
+
+// identityValue returns a value of the instance identity document
+func (p *ec2Provider) identityValue(key string) (string, error) {
+
+	p.identityOnce.Do(func() {
+		var r string
+		r, p.identityErr = p.get("/latest/dynamic/instance-identity/document")
+		if p.identityErr == nil {
+			p.identityErr = json.Unmarshal([]byte(r), &p.identity)
+		}
+	})
+
+	if p.identityErr != nil {
+		return "", p.identityErr
+	}
+
+	s, _ := p.identity[key].(string)
+
+	return s, nil
+}
+
+func (p *ec2Provider) Region() (string, error) {
+	return p.identityValue("region")
+}
+
+func (p *ec2Provider) InstanceID() (string, error) {
+	return p.identityValue("instanceId")
+}
+
+// Tags are only available if tags in instance metadata are enabled
+func (p *ec2Provider) Tags() (map[string]string, error) {
+
+	r, err := p.get("/latest/meta-data/tags/instance")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for _, k := range lines(r) {
+		val, err := p.get("/latest/meta-data/tags/instance/" + k)
+		if err != nil {
+			return nil, err
+		}
+		tags[k] = val
+	}
+
+	return tags, nil
+}
+
+// SSHKeys returns the key pair of the instance, listed as 0=name
+func (p *ec2Provider) SSHKeys() ([]string, error) {
+
+	r, err := p.get("/latest/meta-data/public-keys/")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, l := range lines(r) {
+		idx := strings.SplitN(l, "=", 2)[0]
+		key, err := p.get(fmt.Sprintf("/latest/meta-data/public-keys/%s/openssh-key", idx))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// ec2SpotAction is spot/instance-action
+type ec2SpotAction struct {
+	Action string `json:"action"`
+	Time   string `json:"time"`
+}
+
+// ec2Event is an entry of events/maintenance/scheduled
+type ec2Event struct {
+	EventID   string `json:"EventId"`
+	Code      string `json:"Code"`
+	State     string `json:"State"`
+	NotBefore string `json:"NotBefore"`
+}
+
+// interruption returns spot interruptions and scheduled events. Scheduled
+// events are announced days before and only notify programs. Hibernated
+// spot instances keep running after resume.
+func (p *ec2Provider) interruption() (*interruption, error) {
+
+	// 404 if there is no action
+	if r, err := p.get("/latest/meta-data/spot/instance-action"); err == nil {
+
+		var a ec2SpotAction
+		err = json.Unmarshal([]byte(r), &a)
+		if err != nil {
+			return nil, err
+		}
+
+		t, _ := time.Parse(time.RFC3339, a.Time)
+
+		return &interruption{
+			kind:     interruptionPreemption,
+			shutdown: a.Action != "hibernate",
+			deadline: t,
+			id:       a.Action,
+		}, nil
+	}
+
+	r, err := p.get("/latest/meta-data/events/maintenance/scheduled")
+	if err != nil {
+		return nil, nil
+	}
+
+	var events []ec2Event
+	err = json.Unmarshal([]byte(r), &events)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+
+		if e.State != "active" {
+			continue
+		}
+
+		t, _ := time.Parse("2 Jan 2006 15:04:05 MST", e.NotBefore)
+
+		return &interruption{
+			kind:     interruptionMaintenance,
+			deadline: t,
+			id:       fmt.Sprintf("%s %s", e.Code, e.EventID),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+type azureProvider struct {
+	metadataClient
+
+	nameOnce sync.Once
+	name     string
+
+	wire *wireServer
+
+	// provisioning data of ovf-env.xml
+	readOVF func() ([]byte, error)
+	ovfOnce sync.Once
+	ovf     *azureProvisioning
+}
+
+// azureEvents is the scheduledevents document
+type azureEvents struct {
+	Events []struct {
+		EventID     string   `json:"EventId"`
+		EventType   string   `json:"EventType"`
+		Resources   []string `json:"Resources"`
+		EventStatus string   `json:"EventStatus"`
+		NotBefore   string   `json:"NotBefore"`
+	} `json:"Events"`
+}
+
+func newAzureProvider(server, wire string) *azureProvider {
+	return &azureProvider{
+		metadataClient: metadataClient{server: server, header: azureMetadataHeader, query: azureMetadataQuery},
+		wire:           newWireServer(wire),
+		readOVF:        readAzureOVF,
+	}
+}
+
+func (p *azureProvider) Name() string {
+	return cloudStrings[cpAzure]
+}
+
+// Detect needs the DHCP option, the BIOS is the same on Hyper-V
+func (p *azureProvider) Detect(hints CloudHints) bool {
+	return hints.DHCPAzure && strings.HasPrefix(hints.BIOSVendor, "American Megatrends Inc.")
+}
+
+func (p *azureProvider) ExternalIP(idx int) (string, error) {
+	return p.get(fmt.Sprintf("/metadata/instance/network/interface/%d/ipv4/ipAddress/0/publicIpAddress", idx))
+}
+
+// Userdata is the custom data of the provisioning media, the metadata
+// server is used if there is none
+func (p *azureProvider) Userdata() (string, error) {
+
+	if ovf := p.provisioning(); ovf != nil && ovf.userdata != "" {
+		return ovf.userdata, nil
+	}
+
+	return p.get("/metadata/instance/compute/customData")
+}
+
+// Hostname is not available, the instance name is no DNS name
+func (p *azureProvider) Hostname() (string, error) {
+	return "", nil
+}
+
+func (p *azureProvider) Region() (string, error) {
+	return p.get("/metadata/instance/compute/location")
+}
+
+func (p *azureProvider) InstanceID() (string, error) {
+	return p.get("/metadata/instance/compute/vmId")
+}
+
+// Tags are returned as name:value;name:value
+func (p *azureProvider) Tags() (map[string]string, error) {
+
+	r, err := p.get("/metadata/instance/compute/tags")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for _, t := range strings.Split(r, ";") {
+		if t == "" {
+			continue
+		}
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+
+	return tags, nil
+}
+
+func (p *azureProvider) SSHKeys() ([]string, error) {
+
+	var pks []struct {
+		KeyData string `json:"keyData"`
+	}
+
+	var keys []string
+	if ovf := p.provisioning(); ovf != nil {
+		keys = append(keys, ovf.sshKeys...)
+	}
+
+	err := p.getJSON("/metadata/instance/compute/publicKeys", map[string]string{"format": "json"}, &pks)
+	if err != nil && len(keys) == 0 {
+		return nil, err
+	}
+
+	for _, k := range pks {
+		if key := strings.TrimSpace(k.KeyData); !containsString(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// interruption returns scheduled events of this instance. Preempt and
+// Terminate stop the instance, Reboot, Redeploy and Freeze are handled by
+// the platform.
+func (p *azureProvider) interruption() (*interruption, error) {
+
+	p.nameOnce.Do(func() {
+		p.name, _ = p.get("/metadata/instance/compute/name")
+	})
+
+	var events azureEvents
+	err := p.getJSON("/metadata/scheduledevents",
+		map[string]string{"format": "json", "api-version": "2020-07-01"}, &events)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events.Events {
+
+		// events of other instances in the availability set
+		if p.name != "" && len(e.Resources) > 0 && !containsString(e.Resources, p.name) {
+			continue
+		}
+
+		i := &interruption{
+			kind: interruptionMaintenance,
+			id:   fmt.Sprintf("%s %s", e.EventType, e.EventID),
+		}
+
+		switch e.EventType {
+		case "Preempt":
+			i.kind = interruptionPreemption
+			i.shutdown = true
+		case "Terminate":
+			i.kind = interruptionTermination
+			i.shutdown = true
+		}
+
+		// empty once the event started
+		i.deadline, _ = time.Parse(time.RFC1123, e.NotBefore)
+
+		return i, nil
+	}
+
+	return nil, nil
+}
+
+type digitalOceanProvider struct {
+	metadataClient
+}
+
+func newDigitalOceanProvider(server string) *digitalOceanProvider {
+	return &digitalOceanProvider{
+		metadataClient{server: server},
+	}
+}
+
+func (p *digitalOceanProvider) Name() string {
+	return cloudStrings[cpDigitalOcean]
+}
+
+func (p *digitalOceanProvider) Detect(hints CloudHints) bool {
+	return hints.SysVendor == "DigitalOcean"
+}
+
+// ExternalIP returns the public address of the first interface, the second
+// one is the private network
+func (p *digitalOceanProvider) ExternalIP(idx int) (string, error) {
+
+	if idx > 0 {
+		return "", nil
+	}
+
+	return p.get("/metadata/v1/interfaces/public/0/ipv4/address")
+}
+
+func (p *digitalOceanProvider) Userdata() (string, error) {
+	return p.get("/metadata/v1/user-data")
+}
+
+func (p *digitalOceanProvider) Hostname() (string, error) {
+	return p.get("/metadata/v1/hostname")
+}
+
+func (p *digitalOceanProvider) Region() (string, error) {
+	return p.get("/metadata/v1/region")
+}
+
+func (p *digitalOceanProvider) InstanceID() (string, error) {
+	return p.get("/metadata/v1/id")
+}
+
+// Tags have no values, they are set to true
+func (p *digitalOceanProvider) Tags() (map[string]string, error) {
+
+	r, err := p.get("/metadata/v1/tags/")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for _, t := range lines(r) {
+		tags[t] = "true"
+	}
+
+	return tags, nil
+}
+
+func (p *digitalOceanProvider) SSHKeys() ([]string, error) {
+
+	r, err := p.get("/metadata/v1/public-keys")
+	if err != nil {
+		return nil, err
+	}
+
+	return lines(r), nil
+}
+
+type oracleProvider struct {
+	metadataClient
+
+	instanceOnce sync.Once
+	instance     oracleInstance
+	instanceErr  error
+}
+
+// oracleInstance is the instance document of OCI's metadata service
+type oracleInstance struct {
+	ID                  string `json:"id"`
+	Hostname            string `json:"hostname"`
+	CanonicalRegionName string `json:"canonicalRegionName"`
+
+	Metadata struct {
+		SSHAuthorizedKeys string `json:"ssh_authorized_keys"`
+		UserData          string `json:"user_data"`
+	} `json:"metadata"`
+
+	FreeformTags map[string]string            `json:"freeformTags"`
+	DefinedTags  map[string]map[string]string `json:"definedTags"`
+}
+
+func newOracleProvider(server string) *oracleProvider {
+	return &oracleProvider{
+		metadataClient: metadataClient{
+			server: server,
+			header: map[string]string{"Authorization": "Bearer Oracle"},
+		},
+	}
+}
+
+func (p *oracleProvider) Name() string {
+	return cloudStrings[cpOracle]
+}
+
+func (p *oracleProvider) Detect(hints CloudHints) bool {
+	return hints.ChassisAssetTag == "OracleCloud.com"
+}
+
+func (p *oracleProvider) getInstance() (*oracleInstance, error) {
+
+	p.instanceOnce.Do(func() {
+		p.instanceErr = p.getJSON("/opc/v2/instance/", nil, &p.instance)
+	})
+
+	return &p.instance, p.instanceErr
+}
+
+// ExternalIP is not available, OCI's metadata only has private addresses
+func (p *oracleProvider) ExternalIP(idx int) (string, error) {
+	return "", nil
+}
+
+// Userdata is base64 encoded in the instance metadata
+func (p *oracleProvider) Userdata() (string, error) {
+
+	i, err := p.getInstance()
+	if err != nil || i.Metadata.UserData == "" {
+		return "", err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(i.Metadata.UserData)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (p *oracleProvider) Hostname() (string, error) {
+	i, err := p.getInstance()
+	return i.Hostname, err
+}
+
+func (p *oracleProvider) Region() (string, error) {
+	i, err := p.getInstance()
+	return i.CanonicalRegionName, err
+}
+
+func (p *oracleProvider) InstanceID() (string, error) {
+	i, err := p.getInstance()
+	return i.ID, err
+}
+
+// Tags are the freeform tags and the defined tags as namespace.name
+func (p *oracleProvider) Tags() (map[string]string, error) {
+
+	i, err := p.getInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for k, val := range i.FreeformTags {
+		tags[k] = val
+	}
+	for ns, t := range i.DefinedTags {
+		for k, val := range t {
+			tags[ns+"."+k] = val
+		}
+	}
+
+	return tags, nil
+}
+
+func (p *oracleProvider) SSHKeys() ([]string, error) {
+
+	i, err := p.getInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	return lines(i.Metadata.SSHAuthorizedKeys), nil
+}
+
+type openStackProvider struct {
+	metadataClient
+
+	metaOnce sync.Once
+	meta     openStackMeta
+	metaErr  error
+}
+
+// openStackMeta is openstack/latest/meta_data.json
+type openStackMeta struct {
+	UUID             string            `json:"uuid"`
+	Hostname         string            `json:"hostname"`
+	AvailabilityZone string            `json:"availability_zone"`
+	PublicKeys       map[string]string `json:"public_keys"`
+	Meta             map[string]string `json:"meta"`
+}
+
+func newOpenStackProvider(server string) *openStackProvider {
+	return &openStackProvider{
+		metadataClient: metadataClient{server: server},
+	}
+}
+
+func (p *openStackProvider) Name() string {
+	return cloudStrings[cpOpenStack]
+}
+
+// Detect uses DMI values of nova or an attached config drive
+func (p *openStackProvider) Detect(hints CloudHints) bool {
+	return strings.HasPrefix(hints.ProductName, "OpenStack") ||
+		hints.SysVendor == "OpenStack Foundation" ||
+		hints.hasVolume("config-2")
+}
+
+func (p *openStackProvider) getMeta() (*openStackMeta, error) {
+
+	p.metaOnce.Do(func() {
+		p.metaErr = p.getJSON("/openstack/latest/meta_data.json", nil, &p.meta)
+	})
+
+	return &p.meta, p.metaErr
+}
+
+// ExternalIP uses the EC2 compatible API which only knows the floating IP
+// of the first interface
+func (p *openStackProvider) ExternalIP(idx int) (string, error) {
+
+	if idx > 0 {
+		return "", nil
+	}
+
+	return p.get("/latest/meta-data/public-ipv4")
+}
+
+func (p *openStackProvider) Userdata() (string, error) {
+	return p.get("/openstack/latest/user_data")
+}
+
+func (p *openStackProvider) Hostname() (string, error) {
+	m, err := p.getMeta()
+	return m.Hostname, err
+}
+
+// Region is the availability zone, the metadata has no region
+func (p *openStackProvider) Region() (string, error) {
+	m, err := p.getMeta()
+	return m.AvailabilityZone, err
+}
+
+func (p *openStackProvider) InstanceID() (string, error) {
+	m, err := p.getMeta()
+	return m.UUID, err
+}
+
+// Tags are the instance's metadata key value pairs
+func (p *openStackProvider) Tags() (map[string]string, error) {
+	m, err := p.getMeta()
+	return m.Meta, err
+}
+
+func (p *openStackProvider) SSHKeys() ([]string, error) {
+
+	m, err := p.getMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for n := range m.PublicKeys {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var keys []string
+	for _, n := range names {
+		keys = append(keys, strings.TrimSpace(m.PublicKeys[n]))
+	}
+
+	return keys, nil
+}
+
+type hetznerProvider struct {
+	metadataClient
+}
+
+func newHetznerProvider(server string) *hetznerProvider {
+	return &hetznerProvider{
+		metadataClient{server: server},
+	}
+}
+
+func (p *hetznerProvider) Name() string {
+	return cloudStrings[cpHetzner]
+}
+
+func (p *hetznerProvider) Detect(hints CloudHints) bool {
+	return hints.SysVendor == "Hetzner"
+}
+
+func (p *hetznerProvider) ExternalIP(idx int) (string, error) {
+
+	if idx > 0 {
+		return "", nil
+	}
+
+	return p.get("/hetzner/v1/metadata/public-ipv4")
+}
+
+func (p *hetznerProvider) Userdata() (string, error) {
+	return p.get("/hetzner/v1/userdata")
+}
+
+func (p *hetznerProvider) Hostname() (string, error) {
+	return p.get("/hetzner/v1/metadata/hostname")
+}
+
+func (p *hetznerProvider) Region() (string, error) {
+	return p.get("/hetzner/v1/metadata/region")
+}
+
+func (p *hetznerProvider) InstanceID() (string, error) {
+	return p.get("/hetzner/v1/metadata/instance-id")
+}
+
+// Tags are not available, labels are not part of the metadata
+func (p *hetznerProvider) Tags() (map[string]string, error) {
+	return nil, nil
+}
+
+// SSHKeys are a JSON list
+func (p *hetznerProvider) SSHKeys() ([]string, error) {
+
+	var keys []string
+	err := p.getJSON("/hetzner/v1/metadata/public-keys", nil, &keys)
+
+	return keys, err
+}
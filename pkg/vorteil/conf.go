@@ -14,10 +14,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
 	"syscall"
-	"time"
 
 	"golang.org/x/sys/unix"
 
@@ -37,59 +35,12 @@ const (
 	minFds = 1024
 )
 
-type cloudReq struct {
-	server string
-
-	interfaceURL  string
-	customDataURL string
-	hostnameURL   string
-
-	header, query map[string]string
-}
-
 type sysVal struct {
 	name  string
 	value int
 }
 
 var (
-	azureReq = cloudReq{
-		server:        metadataURL,
-		interfaceURL:  "%s/metadata/instance/network/interface/%d/ipv4/ipAddress/0/publicIpAddress",
-		customDataURL: "%s/metadata/instance/compute/customData",
-		hostnameURL:   "",
-		header: map[string]string{
-			"Metadata": "True",
-			"Host":     "metadata.azure.internal",
-		},
-		query: map[string]string{
-			"format":      "text",
-			"api-version": "2019-02-01",
-		},
-	}
-
-	gcpReq = cloudReq{
-		server:        metadataURL,
-		interfaceURL:  "%s/computeMetadata/v1/instance/network-interfaces/%d/access-configs/0/external-ip",
-		customDataURL: "%s/computeMetadata/v1/instance/attributes/vorteil",
-		hostnameURL:   "%s/computeMetadata/v1/instance/hostname",
-		header: map[string]string{
-			"Host":            "metadata.google.internal",
-			"Metadata-Flavor": "Google",
-		},
-	}
-
-	ec2Req = cloudReq{
-		server:        metadataURL,
-		interfaceURL:  "%s/latest/meta-data/public-ipv4",
-		customDataURL: "%s/latest/user-data",
-		hostnameURL:   "%s/latest/meta-data/public-hostname",
-		header: map[string]string{
-			"Host":     "metadata.ec2.internal",
-			"Metadata": "true",
-		},
-	}
-
 	vals = []sysVal{
 		{"vm/max_map_count", 1048575},
 		{"vm/swappiness", 0},
@@ -290,20 +241,10 @@ func rlimit(k int, v uint64) error {
 }
 
 // this seems ot be the only way to check if that instance is running on EC2
-func uuidHasEc2() bool {
-
-	uuid, err := ioutil.ReadFile("/sys/hypervisor/uuid")
-
-	logDebug("uuid value: %s", strings.TrimSpace(string(uuid)))
-
-	if err == nil && strings.HasPrefix(string(uuid), "ec2") {
-		return true
-	}
-
-	return false
-}
-
 func (hv hv) cloudString() string {
+	if hv.provider != nil {
+		return hv.provider.Name()
+	}
 	return cloudStrings[hv.cloud]
 }
 
@@ -311,89 +252,18 @@ func (hv hv) hypervisorString() string {
 	return hypervisorStrings[hv.hypervisor]
 }
 
-// azure needs this function to accept it as a running vm
-func updateHealthAzure() {
-
-	logDebug("update azure health")
-
-	client := &http.Client{}
-	req, _ := http.NewRequest(getRequest, fmt.Sprintf("http://%s/machine/", azureWireServer), nil)
-	req.Header.Add("x-ms-agent-name", "WALinuxAgent")
-	req.Header.Add("x-ms-version", "2012-11-30")
-
-	q := req.URL.Query()
-	q.Add("comp", "goalstate")
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := client.Do(req)
-	if err != nil {
-		logError("error updating machine status: %s", err.Error())
-		return
-	}
-
-	defer resp.Body.Close()
-	r, err := ioutil.ReadAll(resp.Body)
-
-	if resp.StatusCode == 200 && err == nil {
-
-		var (
-			cid, iid string
-		)
-
-		re := regexp.MustCompile(`<ContainerId>([^<]*)</ContainerId>`)
-		result := re.FindAllStringSubmatch(string(r), -1)
-
-		if result[0] == nil {
-			logError("can not report VM as healthy, no container-id")
-		}
-		cid = result[0][1]
-
-		re = regexp.MustCompile(`<InstanceId>([^<]*)</InstanceId>`)
-		result = re.FindAllStringSubmatch(string(r), -1)
-		if result[0] == nil {
-			logError("can not report VM as healthy, no instance-id")
-		}
-		iid = result[0][1]
-
-		xml := fmt.Sprintf("<?xml version=\"1.0\" encoding=\"utf-8\"?><Health xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" xmlns:xsd=\"http://www.w3.org/2001/XMLSchema\"><GoalStateIncarnation>1</GoalStateIncarnation><Container><ContainerId>%s</ContainerId><RoleInstanceList><Role><InstanceId>%s</InstanceId><Health><State>Ready</State></Health></Role></RoleInstanceList></Container></Health>", cid, iid)
-
-		req, _ = http.NewRequest("POST", fmt.Sprintf("http://%s/machine/", azureWireServer), strings.NewReader(xml))
-
-		req.Header.Set("Content-Type", "text/xml;charset=utf-8")
-		req.Header.Set("Content-Length", fmt.Sprintf("%d", len(xml)))
-
-		req.Header.Add("x-ms-agent-name", "WALinuxAgent")
-		req.Header.Add("x-ms-version", "2012-11-30")
-
-		q := req.URL.Query()
-		q.Add("comp", "health")
-		req.URL.RawQuery = q.Encode()
-
-		resp, err := client.Do(req)
-		if err != nil {
-			logError("error updating machine status: %s", err.Error())
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			logError("can not report VM as healthy, final post failed")
-		}
-
-	}
-
-}
-
 func doMetadataRequest(url string, header, query map[string]string) (string, error) {
-	var (
-		err error
-	)
+	r, _, err := metadataRequest(metadataHTTPClient, getRequest, url, header, query)
+	return r, err
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest(getRequest, url, nil)
+// metadataRequest returns the trimmed body and the status code. Responses
+// other than 200 are errors.
+func metadataRequest(client *http.Client, method, url string, header, query map[string]string) (string, int, error) {
 
+	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	for k, v := range header {
@@ -411,172 +281,25 @@ func doMetadataRequest(url string, header, query map[string]string) (string, err
 	resp, err := client.Do(req)
 	if err != nil {
 		logWarn("error requesting metadata %s: %s", url, err.Error())
-		return "", err
+		return "", 0, err
 	}
 
 	defer resp.Body.Close()
 	respByte, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		logWarn("error reading metadata %s: %s", url, err.Error())
-		return "", err
-	}
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("metadata not found")
-	}
-
-	return strings.TrimSpace(string(respByte)), nil
-}
-
-func pollGCP(creq cloudReq, name string, idx int) {
-
-	start := time.Now().Add(30 * time.Minute)
-
-	for {
-
-		<-time.After(30 * time.Second)
-
-		if time.Now().After(start) {
-			logDebug("no GCP LB found")
-			return
-		}
-
-		lburl := fmt.Sprintf("%s/computeMetadata/v1/instance/network-interfaces/%d/forwarded-ips/", creq.server, idx)
-		r, err := doMetadataRequest(lburl, creq.header, creq.query)
-		if err != nil {
-			logWarn("error requesting list of forward ips: %s", err.Error())
-			continue
-		}
-
-		ss := strings.Split(r, "\n") //jens
-		for _, s := range ss {
-			lburl = fmt.Sprintf("%s/computeMetadata/v1/instance/network-interfaces/%d/forwarded-ips/%s", creq.server, idx, s)
-			r, err = doMetadataRequest(lburl, creq.header, creq.query)
-			if err != nil {
-				logWarn("error requesting forward ip: %s", err.Error())
-				continue
-			}
-
-			addVirtualRouting(name, r)
-		}
-	}
-
-}
-
-func probe(creq cloudReq, v *Vinitd) {
-
-	for _, ifc := range v.ifcs {
-
-		var url string
-		if v.hypervisorInfo.cloud == cpEC2 {
-			url = fmt.Sprintf(creq.interfaceURL, creq.server)
-		} else {
-			url = fmt.Sprintf(creq.interfaceURL, creq.server, ifc.idx)
-		}
-
-		logDebug("probe ip url %s", url)
-		r, err := doMetadataRequest(url, creq.header, creq.query)
-		if err != nil {
-			logWarn("error requesting metadata: %s", err.Error())
-			continue
-		}
-		logDebug("setting metadata %s to %s", fmt.Sprintf(envExtIP, ifc.idx), r)
-		v.hypervisorInfo.envs[fmt.Sprintf(envExtIP, ifc.idx)] = r
-
-		// at the moment ec2 is only one network card
-		if v.hypervisorInfo.cloud == cpEC2 {
-			break
-		}
-
-		// for GCP we get network-interfaces/<index>/forwarded-ips/ and set the routing
-		// accrodingly. This is needed if the device is behind an internal TCP proxy
-		// which is not a proxy but rather a virtual network:
-		// https://cloud.google.com/load-balancing/docs/internal#how_ilb_works
-		// https://cloudplatform.googleblog.com/2015/07/Debugging-Health-Checks-in-Load-Balancing-on-Google-Compute-Engine.html
-		if v.hypervisorInfo.cloud == cpGCP {
-			go pollGCP(creq, ifc.name, ifc.idx)
-		}
-
+		return "", resp.StatusCode, err
 	}
 
-	url := fmt.Sprintf(creq.customDataURL, creq.server)
-	logDebug("probe custom url %s", url)
-
-	userdata, err := doMetadataRequest(url, creq.header, creq.query)
-
-	if err != nil {
-		logDebug("error requesting metadata vorteil: %s", err.Error())
-	} else {
-
-		// trying to marshal json, if it is key/value we will use it as envs
-		// otherwise we add it as USERDATA
-		var envs map[string]string
-		err := json.Unmarshal([]byte(userdata), &envs)
-
-		logDebug("setting metadata userdata to %s", userdata)
-		v.hypervisorInfo.envs[envUserData] = userdata
-
-		// set these as envs
-		if err == nil {
-			for key, value := range envs {
-				logDebug("setting metadata userdata to %s %v", key, value)
-				v.hypervisorInfo.envs[key] = value
-			}
-		}
-
-		logDebug("setting metadata userdata to %s", userdata)
-		v.hypervisorInfo.envs[envUserData] = userdata
-	}
-
-	// azure doesnt have this value
-	if len(creq.hostnameURL) > 0 {
-		url := fmt.Sprintf(creq.hostnameURL, creq.server)
-		logDebug("probe hostname url %s", url)
-		hn, err := doMetadataRequest(url, creq.header, creq.query)
-		if err != nil {
-			logDebug("error requesting metadata hostname: %s", err.Error())
-		} else {
-			logDebug("setting metadata ENV_EXT_HOSTNAME %s", hn)
-			v.hypervisorInfo.envs[envExtHostname] = hn
-		}
-
+	if resp.StatusCode == http.StatusNotFound {
+		return "", resp.StatusCode, errMetadataNotFound
 	}
 
-	// get instance id and region for AWS
-	// region is not in metadadata really so we are using
-	// http://169.254.169.254/latest/dynamic/instance-identity/document
-	// and parse it
-	if v.hypervisorInfo.cloud == cpEC2 {
-
-		url := fmt.Sprintf("%s/latest/dynamic/instance-identity/document", creq.server)
-		logAlways("probe aws identity url %s", url)
-		hn, err := doMetadataRequest(url, creq.header, creq.query)
-		if err != nil {
-			logDebug("error requesting identy: %s", err.Error())
-		}
-
-		var d map[string]interface{}
-		err = json.Unmarshal([]byte(hn), &d)
-		if err != nil {
-			logDebug("error requesting identy: %s", err.Error())
-		}
-
-		vals := map[string]string{
-			"region":     envRegion,
-			"instanceId": envInstanceID,
-		}
-
-		for k, vv := range vals {
-			if val, ok := d[k]; ok {
-				switch sv := val.(type) {
-				case string:
-					v.hypervisorInfo.envs[vv] = sv
-				}
-			}
-		}
-
+	if resp.StatusCode != 200 {
+		return "", resp.StatusCode, fmt.Errorf("metadata request failed with status %d", resp.StatusCode)
 	}
 
+	return strings.TrimSpace(string(respByte)), resp.StatusCode, nil
 }
 
 func basicEnv(v *Vinitd) {
@@ -590,6 +313,12 @@ func basicEnv(v *Vinitd) {
 	v.hypervisorInfo.envs[envExtHostname] = v.hostname
 
 	for _, ifc := range v.ifcs {
+
+		// interface not configured or failed
+		if ifc.addr == nil {
+			continue
+		}
+
 		v.hypervisorInfo.envs[fmt.Sprintf(envIP, ifc.idx)] = ifc.addr.IP.String()
 
 		// we set the env variables with internal so they are never empty
@@ -604,56 +333,61 @@ func fetchCloudMetadata(v *Vinitd) {
 
 	logDebug("cloud values: %s %s", v.hypervisorInfo.hypervisorString(), v.hypervisorInfo.cloudString())
 
-	if v.hypervisorInfo.cloud == cpAzure {
-		updateHealthAzure()
-		probe(azureReq, v)
-	} else if v.hypervisorInfo.cloud == cpGCP {
-		probe(gcpReq, v)
-	} else if v.hypervisorInfo.cloud == cpEC2 {
-		probe(ec2Req, v)
+	p := v.hypervisorInfo.provider
+	if p == nil {
+		return
+	}
 
+	if r, ok := p.(readyReporter); ok {
+		r.reportReady()
 	}
+
+	probeCloud(p, v)
 }
 
 func hypervisorGuess(v *Vinitd, bios string) (hypervisor, cloud) {
 
 	logDebug("guessing hypervisor: %s", strings.TrimSpace(bios))
 	hv := hvUnknown
-	cloud := cpUnknown
 
-	if strings.HasPrefix(bios, "SeaBIOS") {
+	if strings.HasPrefix(bios, "SeaBIOS") || strings.HasPrefix(bios, "Google") ||
+		strings.HasPrefix(bios, "Amazon") {
 		hv = hvKVM
-		cloud = cpNone
 	} else if strings.HasPrefix(bios, "innotek GmbH") {
 		hv = hvVBox
-		cloud = cpNone
 	} else if strings.HasPrefix(bios, "Phoenix Technologies LTD") {
 		// start guestinfo vmtools
-		startVMTools(len(v.ifcs), v.hostname)
+		startVMTools(v.hostname)
 		hv = hvVMWare
-		cloud = cpNone
-	} else if strings.HasPrefix(bios, "Google") {
-		hv = hvKVM
-		cloud = cpGCP
-	} else if strings.HasPrefix(bios, "Amazon") {
-		hv = hvKVM
-		cloud = cpEC2
-	} else if strings.HasPrefix(bios, "Xen") && !uuidHasEc2() {
+	} else if strings.HasPrefix(bios, "Xen") {
 		hv = hvXen
-		cloud = cpNone
-	} else if strings.HasPrefix(bios, "Xen") && uuidHasEc2() {
-		hv = hvXen
-		cloud = cpEC2
-	} else if strings.HasPrefix(bios, "American Megatrends Inc.") && v.hypervisorInfo.cloud != cpAzure {
-		hv = hvHyperV
-		cloud = cpNone
-	} else if strings.HasPrefix(bios, "American Megatrends Inc.") && v.hypervisorInfo.cloud == cpAzure {
-		// the cloud value has been set by DHCP already, option 245
+	} else if strings.HasPrefix(bios, "American Megatrends Inc.") {
 		hv = hvHyperV
-		cloud = cpAzure
 	}
 
-	return hv, cloud
+	// the cloud value has been set by DHCP already for azure, option 245
+	p := detectCloudProvider(cloudHints(bios, v.hypervisorInfo.cloud == cpAzure))
+
+	// the config drive is used instead of the metadata server of the same
+	// platform and provides metadata if there is no cloud
+	if d := v.configDrive; d != nil && (p == nil || p.Name() == d.Name()) {
+		p = d
+	}
+
+	if p != nil {
+		// all other clouds are KVM based
+		if hv == hvUnknown {
+			hv = hvKVM
+		}
+		v.hypervisorInfo.provider = p
+		return hv, cloudFromName(p.Name())
+	}
+
+	if hv == hvUnknown {
+		return hv, cpUnknown
+	}
+
+	return hv, cpNone
 
 }
 
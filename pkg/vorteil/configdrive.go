@@ -0,0 +1,545 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	noCloudLabel     = "cidata"
+	configDriveLabel = "config-2"
+
+	configDriveDir = "configdrive"
+)
+
+// configNetwork is a static IPv4 configuration of an interface. Interfaces
+// are matched by MAC address, ethN name or the order in the config.
+type configNetwork struct {
+	mac, name         string
+	ip, mask, gateway string
+}
+
+// configDrive is the metadata of an attached NoCloud (cidata) or OpenStack
+// config drive (config-2) volume. It provides the metadata for platforms
+// without metadata server.
+type configDrive struct {
+	label string
+	cloud cloud
+
+	instanceID, hostname, region string
+	userdata                     string
+
+	tags    map[string]string
+	sshKeys []string
+
+	networks    []configNetwork
+	dns, search []string
+}
+
+// noCloudMeta is meta-data of a NoCloud drive
+type noCloudMeta struct {
+	InstanceID    string      `yaml:"instance-id"`
+	LocalHostname string      `yaml:"local-hostname"`
+	Hostname      string      `yaml:"hostname"`
+	PublicKeys    interface{} `yaml:"public-keys"`
+}
+
+// noCloudSubnet is a subnet of a version 1 network-config
+type noCloudSubnet struct {
+	Type           string   `yaml:"type"`
+	Address        string   `yaml:"address"`
+	Netmask        string   `yaml:"netmask"`
+	Gateway        string   `yaml:"gateway"`
+	DNSNameservers []string `yaml:"dns_nameservers"`
+	DNSSearch      []string `yaml:"dns_search"`
+}
+
+// noCloudNameservers are the nameservers of a version 2 network-config
+type noCloudNameservers struct {
+	Addresses []string `yaml:"addresses"`
+	Search    []string `yaml:"search"`
+}
+
+// noCloudNetwork is network-config version 1 or 2, optionally nested in a
+// network key
+type noCloudNetwork struct {
+	Version int `yaml:"version"`
+
+	Config []struct {
+		Type       string          `yaml:"type"`
+		Name       string          `yaml:"name"`
+		MACAddress string          `yaml:"mac_address"`
+		Subnets    []noCloudSubnet `yaml:"subnets"`
+		Address    interface{}     `yaml:"address"`
+		Search     []string        `yaml:"search"`
+	} `yaml:"config"`
+
+	Ethernets map[string]struct {
+		Match struct {
+			MACAddress string `yaml:"macaddress"`
+		} `yaml:"match"`
+		SetName     string             `yaml:"set-name"`
+		Addresses   []string           `yaml:"addresses"`
+		Gateway4    string             `yaml:"gateway4"`
+		Nameservers noCloudNameservers `yaml:"nameservers"`
+		Routes      []struct {
+			To  string `yaml:"to"`
+			Via string `yaml:"via"`
+		} `yaml:"routes"`
+	} `yaml:"ethernets"`
+
+	Network *noCloudNetwork `yaml:"network"`
+}
+
+// openStackNetworkData is openstack/latest/network_data.json
+type openStackNetworkData struct {
+	Links []struct {
+		ID  string `json:"id"`
+		MAC string `json:"ethernet_mac_address"`
+	} `json:"links"`
+	Networks []struct {
+		Link      string `json:"link"`
+		Type      string `json:"type"`
+		IPAddress string `json:"ip_address"`
+		Netmask   string `json:"netmask"`
+		Routes    []struct {
+			Network string `json:"network"`
+			Gateway string `json:"gateway"`
+		} `json:"routes"`
+	} `json:"networks"`
+	Services []struct {
+		Type    string `json:"type"`
+		Address string `json:"address"`
+	} `json:"services"`
+}
+
+// stringList returns strings of a YAML value which can be a single string,
+// a list or a map
+func stringList(val interface{}) []string {
+
+	var s []string
+
+	switch v := val.(type) {
+	case string:
+		s = append(s, v)
+	case []interface{}:
+		for _, e := range v {
+			s = append(s, stringList(e)...)
+		}
+	case map[interface{}]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, fmt.Sprintf("%v", k))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s = append(s, stringList(v[k])...)
+		}
+	}
+
+	return s
+}
+
+// staticAddress returns address and dotted mask of an IPv4 address in CIDR
+// notation or with a separate mask
+func staticAddress(addr, mask string) (string, string, error) {
+
+	if strings.Contains(addr, "/") {
+		ip, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return "", "", err
+		}
+		if ip.To4() == nil {
+			return "", "", fmt.Errorf("%s is not an IPv4 address", addr)
+		}
+		return ip.String(), net.IP(n.Mask).String(), nil
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() == nil {
+		return "", "", fmt.Errorf("%s is not an IPv4 address", addr)
+	}
+
+	if net.ParseIP(mask) == nil {
+		return "", "", fmt.Errorf("invalid netmask %s for %s", mask, addr)
+	}
+
+	return ip.String(), mask, nil
+}
+
+func (d *configDrive) addNetwork(mac, name, addr, mask, gw string) {
+
+	ip, mask, err := staticAddress(addr, mask)
+	if err != nil {
+		logWarn("ignoring config drive address: %s", err.Error())
+		return
+	}
+
+	if gw == "" {
+		logWarn("ignoring config drive address %s without gateway", ip)
+		return
+	}
+
+	d.networks = append(d.networks, configNetwork{
+		mac:     strings.ToLower(mac),
+		name:    name,
+		ip:      ip,
+		mask:    mask,
+		gateway: gw,
+	})
+}
+
+// parseNoCloudNetwork reads network-config version 1 and 2
+func (d *configDrive) parseNoCloudNetwork(b []byte) error {
+
+	var nc noCloudNetwork
+	err := yaml.Unmarshal(b, &nc)
+	if err != nil {
+		return err
+	}
+
+	if nc.Network != nil {
+		nc = *nc.Network
+	}
+
+	switch nc.Version {
+	case 1:
+		for _, c := range nc.Config {
+			switch c.Type {
+			case "physical":
+				for _, s := range c.Subnets {
+					if s.Type != "static" {
+						continue
+					}
+					d.addNetwork(c.MACAddress, c.Name, s.Address, s.Netmask, s.Gateway)
+					d.dns = append(d.dns, s.DNSNameservers...)
+					d.search = append(d.search, s.DNSSearch...)
+				}
+			case "nameserver":
+				d.dns = append(d.dns, stringList(c.Address)...)
+				d.search = append(d.search, c.Search...)
+			}
+		}
+	case 2:
+		var ids []string
+		for id := range nc.Ethernets {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			e := nc.Ethernets[id]
+			name := e.SetName
+			if name == "" {
+				name = id
+			}
+			gw := e.Gateway4
+			for _, r := range e.Routes {
+				if r.To == "default" || r.To == "0.0.0.0/0" {
+					gw = r.Via
+				}
+			}
+			for _, a := range e.Addresses {
+				d.addNetwork(e.Match.MACAddress, name, a, "", gw)
+			}
+			d.dns = append(d.dns, e.Nameservers.Addresses...)
+			d.search = append(d.search, e.Nameservers.Search...)
+		}
+	default:
+		return fmt.Errorf("unsupported network-config version %d", nc.Version)
+	}
+
+	return nil
+}
+
+// readNoCloud reads meta-data, user-data and network-config of a NoCloud
+// drive
+func (d *configDrive) readNoCloud(dir string) error {
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta-data"))
+	if err != nil {
+		return err
+	}
+
+	var meta noCloudMeta
+	err = yaml.Unmarshal(b, &meta)
+	if err != nil {
+		return fmt.Errorf("can not parse meta-data: %s", err.Error())
+	}
+
+	d.instanceID = meta.InstanceID
+	d.hostname = meta.LocalHostname
+	if d.hostname == "" {
+		d.hostname = meta.Hostname
+	}
+	d.sshKeys = stringList(meta.PublicKeys)
+
+	if b, err = ioutil.ReadFile(filepath.Join(dir, "user-data")); err == nil {
+		d.userdata = string(b)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "network-config"))
+	if err != nil {
+		return nil
+	}
+
+	err = d.parseNoCloudNetwork(b)
+	if err != nil {
+		return fmt.Errorf("can not parse network-config: %s", err.Error())
+	}
+
+	return nil
+}
+
+// readOpenStack reads meta_data.json, user_data and network_data.json of an
+// OpenStack config drive
+func (d *configDrive) readOpenStack(dir string) error {
+
+	dir = filepath.Join(dir, "openstack", "latest")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta_data.json"))
+	if err != nil {
+		return err
+	}
+
+	var meta openStackMeta
+	err = json.Unmarshal(b, &meta)
+	if err != nil {
+		return fmt.Errorf("can not parse meta_data.json: %s", err.Error())
+	}
+
+	d.instanceID = meta.UUID
+	d.hostname = meta.Hostname
+	d.region = meta.AvailabilityZone
+	d.tags = meta.Meta
+
+	var names []string
+	for n := range meta.PublicKeys {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		d.sshKeys = append(d.sshKeys, meta.PublicKeys[n])
+	}
+
+	if b, err = ioutil.ReadFile(filepath.Join(dir, "user_data")); err == nil {
+		d.userdata = string(b)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "network_data.json"))
+	if err != nil {
+		return nil
+	}
+
+	var nd openStackNetworkData
+	err = json.Unmarshal(b, &nd)
+	if err != nil {
+		return fmt.Errorf("can not parse network_data.json: %s", err.Error())
+	}
+
+	macs := make(map[string]string)
+	for _, l := range nd.Links {
+		macs[l.ID] = l.MAC
+	}
+
+	for _, n := range nd.Networks {
+		if n.Type != "ipv4" {
+			continue
+		}
+		var gw string
+		for _, r := range n.Routes {
+			if r.Network == "0.0.0.0" {
+				gw = r.Gateway
+			}
+		}
+		d.addNetwork(macs[n.Link], "", n.IPAddress, n.Netmask, gw)
+	}
+
+	for _, s := range nd.Services {
+		if s.Type == "dns" {
+			d.dns = append(d.dns, s.Address)
+		}
+	}
+
+	return nil
+}
+
+// readConfigDrive reads the metadata of a mounted config drive
+func readConfigDrive(dir, label string) (*configDrive, error) {
+
+	d := &configDrive{
+		label: label,
+	}
+
+	var err error
+
+	switch label {
+	case noCloudLabel:
+		d.cloud = cpNoCloud
+		err = d.readNoCloud(dir)
+	case configDriveLabel:
+		d.cloud = cpOpenStack
+		err = d.readOpenStack(dir)
+	default:
+		err = fmt.Errorf("unknown config drive %s", label)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// mountConfigDrive mounts the volume read-only and reads the metadata
+func mountConfigDrive(vol volume, label string) (*configDrive, error) {
+
+	dir, err := runDir(configDriveDir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	logDebug("mounting config drive %s to %s", vol.dev, dir)
+	err = syscall.Mount(vol.dev, dir, vol.fs, syscall.MS_RDONLY|syscall.MS_SILENT, "")
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Unmount(dir, 0)
+
+	return readConfigDrive(dir, label)
+}
+
+// ethIndexes maps MAC addresses to the index of the interface in
+// networkSetup
+func ethIndexes() map[string]int {
+
+	idx := make(map[string]int)
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return idx
+	}
+
+	ic := 0
+	for _, i := range ifaces {
+		if networkDeviceType(i.Name) != devtypeNet {
+			continue
+		}
+		idx[strings.ToLower(i.HardwareAddr.String())] = ic
+		ic++
+	}
+
+	return idx
+}
+
+// applyConfigDrive sets hostname, static addresses and DNS of the config
+// drive before setup
+func (v *Vinitd) applyConfigDrive(macs map[string]int) {
+
+	d := v.configDrive
+
+	if d.hostname != "" {
+		logDebug("config drive hostname %s", d.hostname)
+		v.vcfg.System.Hostname = d.hostname
+	}
+
+	for i, n := range d.networks {
+
+		idx, ok := macs[n.mac]
+		if !ok {
+			if _, err := fmt.Sscanf(n.name, "eth%d", &idx); err != nil {
+				idx = i
+			}
+		}
+
+		if idx >= len(v.vcfg.Networks) {
+			logWarn("config drive network %s/%s for eth%d not in vcfg", n.ip, n.mask, idx)
+			continue
+		}
+
+		logDebug("config drive network eth%d: %s/%s/%s", idx, n.ip, n.mask, n.gateway)
+		v.vcfg.Networks[idx].IP = n.ip
+		v.vcfg.Networks[idx].Mask = n.mask
+		v.vcfg.Networks[idx].Gateway = n.gateway
+	}
+
+	v.vcfg.System.DNS = append(v.vcfg.System.DNS, d.dns...)
+	v.searchDomains = append(v.searchDomains, d.search...)
+}
+
+// loadConfigDrive reads the first attached NoCloud or OpenStack config drive
+func (v *Vinitd) loadConfigDrive() {
+
+	vols := volumeLabels()
+
+	for _, label := range []string{noCloudLabel, configDriveLabel} {
+
+		vol, ok := vols[label]
+		if !ok {
+			continue
+		}
+
+		d, err := mountConfigDrive(vol, label)
+		if err != nil {
+			logWarn("can not read config drive %s: %s", vol.dev, err.Error())
+			continue
+		}
+
+		v.configDrive = d
+		v.applyConfigDrive(ethIndexes())
+
+		return
+	}
+}
+
+func (d *configDrive) Name() string {
+	return cloudStrings[d.cloud]
+}
+
+func (d *configDrive) Detect(hints CloudHints) bool {
+	return hints.hasVolume(d.label)
+}
+
+// ExternalIP is not available, config drives have internal addresses only
+func (d *configDrive) ExternalIP(idx int) (string, error) {
+	return "", nil
+}
+
+func (d *configDrive) Userdata() (string, error) {
+	return d.userdata, nil
+}
+
+func (d *configDrive) Hostname() (string, error) {
+	return d.hostname, nil
+}
+
+func (d *configDrive) Region() (string, error) {
+	return d.region, nil
+}
+
+func (d *configDrive) InstanceID() (string, error) {
+	return d.instanceID, nil
+}
+
+func (d *configDrive) Tags() (map[string]string, error) {
+	return d.tags, nil
+}
+
+func (d *configDrive) SSHKeys() ([]string, error) {
+	return d.sshKeys, nil
+}
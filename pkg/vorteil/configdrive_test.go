@@ -0,0 +1,168 @@
+package vorteil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// writeDrive creates the files of a config drive in a temporary directory
+func writeDrive(t *testing.T, files map[string]string) string {
+
+	dir, err := ioutil.TempDir("", "configdrive")
+	assert.NoError(t, err)
+
+	for n, c := range files {
+		p := filepath.Join(dir, n)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(c), 0644))
+	}
+
+	return dir
+}
+
+const noCloudNetworkV1 = `version: 1
+config:
+  - type: physical
+    name: eth1
+    mac_address: "52:54:00:12:34:01"
+    subnets:
+      - type: static
+        address: 10.0.1.5
+        netmask: 255.255.255.0
+        gateway: 10.0.1.1
+  - type: physical
+    name: eth0
+    subnets:
+      - type: dhcp
+  - type: nameserver
+    address: [1.1.1.1]
+    search: [example.com]
+`
+
+const noCloudNetworkV2 = `network:
+  version: 2
+  ethernets:
+    eth0:
+      addresses: [192.168.1.10/24, "fd00::10/64"]
+      routes:
+        - to: default
+          via: 192.168.1.1
+      nameservers:
+        addresses: [192.168.1.2]
+`
+
+func TestReadNoCloud(t *testing.T) {
+
+	dir := writeDrive(t, map[string]string{
+		"meta-data":      "instance-id: iid-local01\nlocal-hostname: app01\npublic-keys:\n  - ssh-rsa AAAA one\n  - ssh-rsa BBBB two\n",
+		"user-data":      "#cloud-config\nhostname: app02\n",
+		"network-config": noCloudNetworkV1,
+	})
+	defer os.RemoveAll(dir)
+
+	d, err := readConfigDrive(dir, noCloudLabel)
+	assert.NoError(t, err)
+	assert.Equal(t, "NOCLOUD", d.Name())
+	assert.Equal(t, "iid-local01", d.instanceID)
+	assert.Equal(t, "app01", d.hostname)
+	assert.Equal(t, []string{"ssh-rsa AAAA one", "ssh-rsa BBBB two"}, d.sshKeys)
+	assert.Equal(t, "#cloud-config\nhostname: app02\n", d.userdata)
+	assert.Equal(t, []configNetwork{
+		{mac: "52:54:00:12:34:01", name: "eth1", ip: "10.0.1.5", mask: "255.255.255.0", gateway: "10.0.1.1"},
+	}, d.networks)
+	assert.Equal(t, []string{"1.1.1.1"}, d.dns)
+	assert.Equal(t, []string{"example.com"}, d.search)
+
+	// version 2, ipv6 addresses are ignored
+	err = ioutil.WriteFile(filepath.Join(dir, "network-config"), []byte(noCloudNetworkV2), 0644)
+	assert.NoError(t, err)
+
+	d, err = readConfigDrive(dir, noCloudLabel)
+	assert.NoError(t, err)
+	assert.Equal(t, []configNetwork{
+		{name: "eth0", ip: "192.168.1.10", mask: "255.255.255.0", gateway: "192.168.1.1"},
+	}, d.networks)
+	assert.Equal(t, []string{"192.168.1.2"}, d.dns)
+
+	// meta-data is required
+	os.Remove(filepath.Join(dir, "meta-data"))
+	_, err = readConfigDrive(dir, noCloudLabel)
+	assert.Error(t, err)
+
+}
+
+func TestReadOpenStackDrive(t *testing.T) {
+
+	dir := writeDrive(t, map[string]string{
+		"openstack/latest/meta_data.json": `{"uuid": "d8e02d56", "hostname": "web.novalocal",
+			"availability_zone": "nova", "public_keys": {"mykey": "ssh-ed25519 AAAA"},
+			"meta": {"role": "web"}}`,
+		"openstack/latest/user_data": "ENV=prod",
+		"openstack/latest/network_data.json": `{
+			"links": [{"id": "tap0", "ethernet_mac_address": "FA:16:3E:00:00:01"}],
+			"networks": [
+				{"link": "tap0", "type": "ipv4", "ip_address": "10.0.0.5", "netmask": "255.255.255.0",
+				 "routes": [{"network": "0.0.0.0", "netmask": "0.0.0.0", "gateway": "10.0.0.1"}]},
+				{"link": "tap0", "type": "ipv6_dhcp"}
+			],
+			"services": [{"type": "dns", "address": "10.0.0.2"}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	d, err := readConfigDrive(dir, configDriveLabel)
+	assert.NoError(t, err)
+	assert.Equal(t, "OPENSTACK", d.Name())
+	assert.True(t, d.Detect(CloudHints{VolumeLabels: []string{"config-2"}}))
+	assert.Equal(t, "nova", d.region)
+	assert.Equal(t, map[string]string{"role": "web"}, d.tags)
+	assert.Equal(t, []configNetwork{
+		{mac: "fa:16:3e:00:00:01", ip: "10.0.0.5", mask: "255.255.255.0", gateway: "10.0.0.1"},
+	}, d.networks)
+	assert.Equal(t, []string{"10.0.0.2"}, d.dns)
+
+	_, err = readConfigDrive(dir, "other")
+	assert.Error(t, err)
+
+}
+
+func TestApplyConfigDrive(t *testing.T) {
+
+	dir := writeDrive(t, map[string]string{
+		"meta-data":      "instance-id: iid-local01\nlocal-hostname: app01\n",
+		"user-data":      `{"MODE": "test"}`,
+		"network-config": noCloudNetworkV1,
+	})
+	defer os.RemoveAll(dir)
+
+	d, err := readConfigDrive(dir, noCloudLabel)
+	assert.NoError(t, err)
+
+	v := &Vinitd{
+		ifcs:           map[string]*ifc{"eth0": {name: "eth0", idx: 0}},
+		hypervisorInfo: hv{envs: make(map[string]string)},
+		configDrive:    d,
+	}
+	v.vcfg.Networks = []vcfg.NetworkInterface{{IP: "dhcp"}, {IP: "dhcp"}}
+
+	// interface matched by mac address
+	v.applyConfigDrive(map[string]int{"52:54:00:12:34:00": 0, "52:54:00:12:34:01": 1})
+
+	assert.Equal(t, "app01", v.vcfg.System.Hostname)
+	assert.Equal(t, "dhcp", v.vcfg.Networks[0].IP)
+	assert.Equal(t, "10.0.1.5", v.vcfg.Networks[1].IP)
+	assert.Equal(t, "255.255.255.0", v.vcfg.Networks[1].Mask)
+	assert.Equal(t, "10.0.1.1", v.vcfg.Networks[1].Gateway)
+	assert.Equal(t, []string{"1.1.1.1"}, v.vcfg.System.DNS)
+	assert.Equal(t, []string{"example.com"}, v.searchDomains)
+
+	probeCloud(d, v)
+	assert.Equal(t, "iid-local01", v.hypervisorInfo.envs[envInstanceID])
+	assert.Equal(t, "app01", v.hypervisorInfo.envs[envExtHostname])
+	assert.Equal(t, "test", v.hypervisorInfo.envs["MODE"])
+
+}
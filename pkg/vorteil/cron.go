@@ -0,0 +1,208 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule returns the next activation time after the given time
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+// everySchedule runs in fixed intervals, e.g. @every 10m
+type everySchedule struct {
+	interval time.Duration
+}
+
+// cronSchedule is a standard five field cron expression. Each field is a
+// bitmask of allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// day of month and day of week are or'ed if both are restricted
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+}
+
+var (
+	cronFields = []cronField{
+		{0, 59}, // minute
+		{0, 23}, // hour
+		{1, 31}, // day of month
+		{1, 12}, // month
+		{0, 7},  // day of week, 0 and 7 are sunday
+	}
+
+	cronDescriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// parseSchedule parses cron expressions, descriptors like @daily and
+// @every <duration>
+func parseSchedule(spec string) (schedule, error) {
+
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := parseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("interval %v too short", d)
+		}
+		return everySchedule{interval: d}, nil
+	}
+
+	if d, ok := cronDescriptors[spec]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule '%s' needs %d fields", spec, len(cronFields))
+	}
+
+	var (
+		s    cronSchedule
+		bits [5]uint64
+	)
+
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("can not parse '%s': %v", f, err)
+		}
+		bits[i] = b
+	}
+
+	s.minute, s.hour, s.dom, s.month, s.dow = bits[0], bits[1], bits[2], bits[3], bits[4]
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+
+	// sunday can be 0 or 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	return s, nil
+}
+
+// parseCronField parses lists of values, ranges and steps, e.g. 1,5-10,*/15
+func parseCronField(f string, cf cronField) (uint64, error) {
+
+	var bits uint64
+
+	for _, part := range strings.Split(f, ",") {
+
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid step '%s'", part[i+1:])
+			}
+			step = s
+			part = part[:i]
+		}
+
+		from, to := cf.min, cf.max
+
+		if part != "*" {
+			rs := strings.SplitN(part, "-", 2)
+			v, err := strconv.Atoi(rs[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", rs[0])
+			}
+			from, to = v, v
+
+			if len(rs) == 2 {
+				to, err = strconv.Atoi(rs[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value '%s'", rs[1])
+				}
+			} else if step > 1 {
+				// 5/10 means starting at 5
+				to = cf.max
+			}
+		}
+
+		if from < cf.min || to > cf.max || from > to {
+			return 0, fmt.Errorf("value out of range %d-%d", cf.min, cf.max)
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
+
+func (s cronSchedule) next(t time.Time) time.Time {
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// no match within five years, e.g. 30th of february
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,71 @@
+package vorteil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronSchedule(t *testing.T) {
+
+	start := time.Date(2020, time.March, 14, 10, 7, 30, 0, time.UTC)
+
+	s, err := parseSchedule("*/15 * * * *")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2020, time.March, 14, 10, 15, 0, 0, time.UTC), s.next(start))
+
+	s, err = parseSchedule("30 2 * * *")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2020, time.March, 15, 2, 30, 0, 0, time.UTC), s.next(start))
+
+	// day of month or day of week, 14th of march 2020 is a saturday
+	s, err = parseSchedule("0 0 1 * 1-5")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2020, time.March, 16, 0, 0, 0, 0, time.UTC), s.next(start))
+
+	s, err = parseSchedule("0 0 * * 7")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2020, time.March, 15, 0, 0, 0, 0, time.UTC), s.next(start))
+
+	s, err = parseSchedule("@monthly")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC), s.next(start))
+
+	s, err = parseSchedule("0 0 30 2 *")
+	assert.NoError(t, err)
+	assert.True(t, s.next(start).IsZero())
+
+	s, err = parseSchedule("@every 90s")
+	assert.NoError(t, err)
+	assert.Equal(t, start.Add(90*time.Second), s.next(start))
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "@every 10ms", "@sometimes"} {
+		_, err = parseSchedule(spec)
+		assert.Error(t, err, spec)
+	}
+
+}
+
+func TestJobOptions(t *testing.T) {
+
+	opts, _, err := parseProgramOptions([]string{
+		"VINITD_TYPE=job",
+		"VINITD_SCHEDULE=@hourly",
+		"VINITD_OVERLAP=replace",
+		"VINITD_TIMEOUT=5m",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, programJob, opts.progType)
+	assert.Equal(t, overlapReplace, opts.overlap)
+	assert.Equal(t, 5*time.Minute, opts.timeout)
+	assert.NotNil(t, opts.schedule)
+
+	_, _, err = parseProgramOptions([]string{"VINITD_TYPE=job"})
+	assert.Error(t, err)
+
+	p := &program{opts: opts}
+	assert.True(t, p.isJob())
+	assert.False(t, vmDone([]*program{p}))
+
+}
@@ -0,0 +1,209 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+const (
+	// kernel cmdline flag, can be set via system.kernel-args in the VCFG
+	debugCmdLine = "vinitd.debug"
+)
+
+var (
+	// instance used by SystemPanic which has no receiver
+	debugVinitd *Vinitd
+
+	debugShellOnce sync.Once
+)
+
+// debugEnabled returns true if vinitd.debug is on the kernel cmdline or in
+// the kernel args of the VCFG, which is read before the cmdline is
+// available on some platforms
+func debugEnabled() bool {
+
+	if hasCmdLineString(debugCmdLine) {
+		return true
+	}
+
+	if debugVinitd != nil {
+		return containsString(strings.Fields(debugVinitd.vcfg.System.KernelArgs), debugCmdLine)
+	}
+
+	return false
+}
+
+// debugConsole returns the console to run the shell on, ttyS0 preferred
+func debugConsole() (*os.File, error) {
+
+	if debugVinitd != nil {
+		if debugVinitd.ttyS != nil {
+			return debugVinitd.ttyS, nil
+		}
+		if debugVinitd.tty != nil {
+			return debugVinitd.tty, nil
+		}
+	}
+
+	// failed before setupVtty
+	f, err := enableTTYS()
+	if err == nil {
+		return f, nil
+	}
+
+	return enableTTY()
+}
+
+func printDebugSection(w io.Writer, title string, fn func() error) {
+	fmt.Fprintf(w, "\r\n=== %s ===\r\n", title)
+	if err := fn(); err != nil {
+		fmt.Fprintf(w, "can not get %s: %v\r\n", title, err)
+	}
+}
+
+func printDebugFile(w io.Writer, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	w.Write([]byte(strings.ReplaceAll(string(b), "\n", "\r\n")))
+	return nil
+}
+
+func printDiagnostics(w io.Writer) {
+
+	printDebugSection(w, "interfaces", func() error {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, i := range ifaces {
+			fmt.Fprintf(w, "%s (%s, %s)\r\n", i.Name, i.HardwareAddr, i.Flags)
+			addrs, err := i.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				fmt.Fprintf(w, "    %s\r\n", a.String())
+			}
+		}
+		return nil
+	})
+
+	printDebugSection(w, "routes", func() error {
+		return printDebugFile(w, "/proc/net/route")
+	})
+
+	printDebugSection(w, "mounts", func() error {
+		return printDebugFile(w, "/proc/mounts")
+	})
+
+	printDebugSection(w, "services", func() error {
+		for n, c := range accounting.services() {
+			fmt.Fprintf(w, "%s: %d processes\r\n", n, c)
+		}
+		return nil
+	})
+
+	printDebugSection(w, "vcfg", func() error {
+		if debugVinitd == nil {
+			return fmt.Errorf("vcfg not loaded")
+		}
+		// program environments can contain credentials
+		c := debugVinitd.vcfg
+		c.Programs = make([]vcfg.Program, len(debugVinitd.vcfg.Programs))
+		for i, p := range debugVinitd.vcfg.Programs {
+			p.Env = redactEnv(p.Env)
+			c.Programs[i] = p
+		}
+		b, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		w.Write([]byte(strings.ReplaceAll(string(b), "\n", "\r\n")))
+		return nil
+	})
+
+	printDebugSection(w, "logs", func() error {
+		w.Write([]byte(strings.ReplaceAll(string(logHistory.Bytes()), "\n", "\r\n")))
+		return nil
+	})
+
+}
+
+// debugShell prints diagnostics and runs busybox' shell on the console if
+// vinitd.debug is set. It blocks until the shell exits.
+func debugShell() {
+
+	debugShellOnce.Do(func() {
+
+		if !debugEnabled() {
+			return
+		}
+
+		console, err := debugConsole()
+		if err != nil {
+			logAlways("can not open console for debug shell: %v", err)
+			return
+		}
+
+		printDiagnostics(console)
+
+		if _, err := os.Stat(busboxScript); err != nil {
+			fmt.Fprintf(console, "\r\nno busybox available for debug shell\r\n")
+			return
+		}
+
+		// applets might not be linked if we failed early
+		if err := runBusyboxScript(); err != nil {
+			logAlways("can not install busybox applets: %v", err)
+		}
+
+		fmt.Fprintf(console, "\r\nstarting debug shell, system powers off on exit\r\n")
+
+		cmd := exec.Command(busboxScript, "sh")
+		cmd.Stdin = console
+		cmd.Stdout = console
+		cmd.Stderr = console
+		cmd.Dir = "/"
+		cmd.Env = []string{
+			"PATH=/bin:/usr/bin:/sbin:/usr/sbin",
+			"HOME=/",
+			"TERM=linux",
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+			Ctty:    0,
+		}
+
+		err = cmd.Start()
+		if err != nil {
+			logAlways("can not start debug shell: %v", err)
+			return
+		}
+
+		// returns ECHILD if the reaper collected the shell first
+		err = cmd.Wait()
+		if err != nil {
+			logAlways("debug shell exited: %v", err)
+		}
+
+	})
+
+}
@@ -0,0 +1,46 @@
+package vorteil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugEnabled(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "cmdline")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.Close()
+
+	defer func(s string) { cmdLineFile = s }(cmdLineFile)
+	cmdLineFile = f.Name()
+
+	for cmdline, enabled := range map[string]bool{
+		"console=ttyS0 vinitd.debug\n":   true,
+		"vinitd.debug console=ttyS0":     true,
+		"console=ttyS0\n":                false,
+		"vinitd.debugger vinitd.debug=0": false,
+	} {
+		assert.NoError(t, ioutil.WriteFile(f.Name(), []byte(cmdline), 0644))
+		assert.Equal(t, enabled, debugEnabled(), cmdline)
+	}
+
+	// no shell without the flag
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte("console=ttyS0"), 0644))
+	debugShell()
+
+	cmdLineFile = "/nonexistent"
+	assert.False(t, debugEnabled())
+
+	// kernel args of the VCFG enable it as well
+	defer func(v *Vinitd) { debugVinitd = v }(debugVinitd)
+	debugVinitd = &Vinitd{}
+	debugVinitd.vcfg.System.KernelArgs = "console=ttyS0 vinitd.debugger"
+	assert.False(t, debugEnabled())
+	debugVinitd.vcfg.System.KernelArgs = "console=ttyS0 vinitd.debug"
+	assert.True(t, debugEnabled())
+
+}
@@ -82,6 +82,39 @@ func mountFs(target, fstype, options string) error {
 	return syscall.Mount("none", target, fstype, 0, options)
 }
 
+// setupRunDir mounts a tmpfs on the run directory, metadata, userdata and
+// mounted config drives must not survive a reboot on the root disk. If that
+// fails the directory gets emptied.
+func setupRunDir(dir string) error {
+
+	err := mountFs(dir, "tmpfs", "mode=0755")
+	if err == nil {
+		return nil
+	}
+
+	logWarn("can not mount tmpfs on %s: %s", dir, err.Error())
+
+	return clearDir(dir)
+}
+
+// clearDir removes the content of a directory
+func clearDir(dir string) error {
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		err = os.RemoveAll(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func changeDiskScheduler(vdisk string) {
 
 	// it is always /dev/DISKNAME so this is safe
@@ -3,6 +3,7 @@ package vorteil
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -33,3 +34,20 @@ func TestSetupBasicDirectories(t *testing.T) {
 	assert.True(t, len(f) > 0)
 
 }
+
+func TestClearDir(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "run")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "metadata", "tags"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "metadata.env"), []byte("A=1"), 0644))
+
+	assert.NoError(t, clearDir(dir))
+
+	fis, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, fis)
+
+}
@@ -7,6 +7,7 @@ package vorteil
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"strings"
 	"time"
@@ -18,6 +19,7 @@ import (
 
 const (
 	defaultDNSAddr = "127.0.0.1"
+	resolvConfPath = "/etc/resolv.conf"
 )
 
 func printDNS(dns []string) {
@@ -104,3 +106,37 @@ func (v *Vinitd) startDNS(dnsAddr string, verbose bool) error {
 
 	return err
 }
+
+// writeSearchDomains replaces the search line in /etc/resolv.conf
+func writeSearchDomains(domains []string) error {
+
+	rc, err := ioutil.ReadFile(resolvConfPath)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+
+	for _, l := range strings.Split(strings.TrimSpace(string(rc)), "\n") {
+		if strings.HasPrefix(l, "search") || l == "options edns0" {
+			continue
+		}
+		sb.WriteString(l)
+		sb.WriteByte('\n')
+	}
+
+	sb.WriteString("options edns0\n")
+	sb.WriteString("search")
+
+	seen := make(map[string]bool)
+	for _, s := range domains {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		sb.WriteString(fmt.Sprintf(" %s", s))
+	}
+	sb.WriteByte('\n')
+
+	return ioutil.WriteFile(resolvConfPath, []byte(sb.String()), 0644)
+}
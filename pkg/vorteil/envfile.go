@@ -0,0 +1,341 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// envEntry is a variable before expansion
+type envEntry struct {
+	key, value string
+
+	// single quoted dotenv values are not expanded
+	literal bool
+
+	// VCFG and cloud values are split and unquoted with shell rules
+	shell bool
+}
+
+// isEnvName returns true for valid variable names
+func isEnvName(s string) bool {
+
+	if s == "" {
+		return false
+	}
+
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// expandEnv replaces $VAR, ${VAR}, ${VAR:-default}, ${VAR-default} and
+// ${VAR:+alternative}. \$ is a literal $. If quotes is set single quoted
+// text is not expanded.
+func expandEnv(s string, lookup func(string) (string, bool), quotes bool) string {
+
+	var (
+		buf    strings.Builder
+		quoted bool
+	)
+
+	for i := 0; i < len(s); i++ {
+
+		c := s[i]
+
+		switch {
+		case quotes && c == '\'':
+			quoted = !quoted
+			buf.WriteByte(c)
+			continue
+		case quoted:
+			buf.WriteByte(c)
+			continue
+		case c == '\\' && i+1 < len(s) && s[i+1] == '$':
+			buf.WriteByte('$')
+			i++
+			continue
+		case c != '$' || i+1 == len(s):
+			buf.WriteByte(c)
+			continue
+		}
+
+		// ${...}
+		if s[i+1] == '{' {
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				buf.WriteString(s[i:])
+				return buf.String()
+			}
+			buf.WriteString(expandBraces(s[i+2:i+end], lookup))
+			i += end
+			continue
+		}
+
+		// $VAR
+		j := i + 1
+		for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || (j > i+1 && unicode.IsDigit(rune(s[j])))) {
+			j++
+		}
+
+		if j == i+1 {
+			buf.WriteByte(c)
+			continue
+		}
+
+		v, _ := lookup(s[i+1 : j])
+		buf.WriteString(v)
+		i = j - 1
+	}
+
+	return buf.String()
+}
+
+// expandBraces handles the content of ${...}
+func expandBraces(expr string, lookup func(string) (string, bool)) string {
+
+	for _, op := range []string{":-", ":+", "-"} {
+
+		i := strings.Index(expr, op)
+		if i < 0 || !isEnvName(expr[:i]) {
+			continue
+		}
+
+		v, ok := lookup(expr[:i])
+		word := expr[i+len(op):]
+
+		switch op {
+		case ":-":
+			if v == "" {
+				return word
+			}
+		case ":+":
+			if v != "" {
+				return word
+			}
+			return ""
+		case "-":
+			if !ok {
+				return word
+			}
+		}
+
+		return v
+	}
+
+	v, _ := lookup(expr)
+	return v
+}
+
+// parseDotenv reads KEY=VALUE lines with optional export prefix, comments
+// and quoted values
+func parseDotenv(r io.Reader) ([]envEntry, error) {
+
+	var entries []envEntry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+
+		line++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		l = strings.TrimPrefix(l, "export ")
+
+		kv := strings.SplitN(l, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !isEnvName(key) {
+			return nil, fmt.Errorf("line %d: invalid variable", line)
+		}
+
+		e := envEntry{key: key}
+		val := strings.TrimSpace(kv[1])
+
+		switch {
+		case len(val) >= 2 && val[0] == '\'' && strings.LastIndexByte(val, '\'') > 0:
+			e.value = val[1:strings.LastIndexByte(val, '\'')]
+			e.literal = true
+		case len(val) >= 2 && val[0] == '"' && strings.LastIndexByte(val, '"') > 0:
+			e.value = val[1:strings.LastIndexByte(val, '"')]
+			e.value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(e.value)
+		default:
+			// trailing comments need a space before #
+			if i := strings.Index(val, " #"); i >= 0 {
+				val = strings.TrimSpace(val[:i])
+			}
+			e.value = val
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// loadEnvFile reads a dotenv file. Files starting with - are optional.
+func loadEnvFile(path string) ([]envEntry, error) {
+
+	optional := strings.HasPrefix(path, "-")
+	path = strings.TrimPrefix(path, "-")
+
+	f, err := os.Open(path)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := parseDotenv(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return entries, nil
+}
+
+// loadEnvDir reads one variable per file, the file name is the key. Hidden
+// files are skipped, e.g. ..data of kubernetes style mounts.
+func loadEnvDir(dir string) ([]envEntry, error) {
+
+	optional := strings.HasPrefix(dir, "-")
+	dir = strings.TrimPrefix(dir, "-")
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []envEntry
+
+	for _, fi := range fis {
+
+		if strings.HasPrefix(fi.Name(), ".") || !isEnvName(fi.Name()) {
+			continue
+		}
+
+		// follows symlinks
+		path := filepath.Join(dir, fi.Name())
+		if st, err := os.Stat(path); err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, envEntry{
+			key:     fi.Name(),
+			value:   strings.TrimRight(string(b), "\r\n"),
+			literal: true,
+		})
+	}
+
+	return entries, nil
+}
+
+// userdataEnv returns the scalar values of the userdata JSON object. With a
+// key other than true the values of the nested object are used, e.g. key
+// app.env for {"app": {"env": {"PORT": 80}}}.
+func userdataEnv(userdata, key string) ([]envEntry, error) {
+
+	// numbers keep their notation, 1000000 would be 1e+06 as float
+	var obj map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(userdata))
+	dec.UseNumber()
+	err := dec.Decode(&obj)
+	if err != nil {
+		return nil, fmt.Errorf("userdata is not a JSON object")
+	}
+
+	if key != "true" {
+		for _, k := range strings.Split(key, ".") {
+			o, ok := obj[k].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("userdata has no object %s", key)
+			}
+			obj = o
+		}
+	}
+
+	var keys []string
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var entries []envEntry
+	for _, k := range keys {
+		switch v := obj[k].(type) {
+		case map[string]interface{}, []interface{}, nil:
+			continue
+		default:
+			entries = append(entries, envEntry{key: k, value: fmt.Sprint(v), literal: true})
+		}
+	}
+
+	return entries, nil
+}
+
+// loadEnv collects the variables of the program options in precedence
+// order: userdata, directories, files
+func (v *Vinitd) loadEnv(opts programOptions) ([]envEntry, error) {
+
+	var entries []envEntry
+
+	if opts.envUserdata != "" {
+		ud, ok := v.hypervisorInfo.envs[envUserData]
+		if !ok {
+			return nil, fmt.Errorf("no userdata available")
+		}
+		e, err := userdataEnv(ud, opts.envUserdata)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+
+	for _, d := range opts.envDirs {
+		e, err := loadEnvDir(d)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+
+	for _, f := range opts.envFiles {
+		e, err := loadEnvFile(f)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+
+	return entries, nil
+}
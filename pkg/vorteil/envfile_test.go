@@ -0,0 +1,117 @@
+package vorteil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+
+	vars := map[string]string{"HOST": "db", "EMPTY": ""}
+	lookup := func(k string) (string, bool) {
+		v, ok := vars[k]
+		return v, ok
+	}
+
+	for in, out := range map[string]string{
+		"$HOST:5432":            "db:5432",
+		"${HOST}_1":             "db_1",
+		"${PORT:-5432}":         "5432",
+		"${EMPTY:-default}":     "default",
+		"${EMPTY-default}":      "",
+		"${MISSING-default}":    "default",
+		"${HOST:+set}":          "set",
+		"${MISSING:+set}":       "",
+		`\$HOST`:                "$HOST",
+		"cost $5":               "cost $5",
+		"${unterminated":        "${unterminated",
+		"${URL:-http://x:80/a}": "http://x:80/a",
+	} {
+		assert.Equal(t, out, expandEnv(in, lookup, false), in)
+	}
+
+	assert.Equal(t, "'$HOST' db", expandEnv("'$HOST' $HOST", lookup, true))
+
+}
+
+func TestParseDotenv(t *testing.T) {
+
+	entries, err := parseDotenv(strings.NewReader(`
+# comment
+export PORT=8080
+NAME="my app" # comment
+RAW='${NOT_EXPANDED}'
+MULTI="a\nb"
+URL=http://host/#anchor # comment
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []envEntry{
+		{key: "PORT", value: "8080"},
+		{key: "NAME", value: "my app"},
+		{key: "RAW", value: "${NOT_EXPANDED}", literal: true},
+		{key: "MULTI", value: "a\nb"},
+		{key: "URL", value: "http://host/#anchor"},
+	}, entries)
+
+	_, err = parseDotenv(strings.NewReader("1INVALID=x"))
+	assert.Error(t, err)
+
+}
+
+func TestLoadEnv(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "envfile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	envDir := filepath.Join(dir, "env")
+	os.Mkdir(envDir, 0755)
+	ioutil.WriteFile(filepath.Join(envDir, "DB_HOST"), []byte("db.internal\n"), 0644)
+	ioutil.WriteFile(filepath.Join(envDir, "LEVEL"), []byte("dir"), 0644)
+	ioutil.WriteFile(filepath.Join(envDir, "..data"), []byte("skip"), 0644)
+
+	envFile := filepath.Join(dir, "app.env")
+	ioutil.WriteFile(envFile, []byte("LEVEL=file\nDSN=postgres://${DB_HOST}:${DB_PORT:-5432}\n"), 0644)
+
+	v := &Vinitd{
+		hypervisorInfo: hv{
+			envs: map[string]string{
+				envUserData: `{"LEVEL": "userdata", "app": {"WORKERS": 4, "MAX": 1000000, "RATIO": 0.25, "nested": {}}}`,
+				"LEVEL":     "cloud",
+			},
+		},
+	}
+
+	opts, _, err := parseProgramOptions([]string{
+		"VINITD_ENV_USERDATA=app",
+		"VINITD_ENV_DIR=" + envDir,
+		"VINITD_ENV_FILE=" + envFile + ",-/does/not/exist",
+	})
+	assert.NoError(t, err)
+
+	loaded, err := v.loadEnv(opts)
+	assert.NoError(t, err)
+
+	env := envs([]string{"URL=http://$DB_HOST"}, v.hypervisorInfo.envs, loaded)
+	m := envMap(env)
+	assert.Equal(t, "4", m["WORKERS"])
+	assert.Equal(t, "1000000", m["MAX"])
+	assert.Equal(t, "0.25", m["RATIO"])
+	assert.Equal(t, "file", m["LEVEL"])
+	assert.Equal(t, "postgres://db.internal:5432", m["DSN"])
+	assert.Equal(t, "http://db.internal", m["URL"])
+	assert.NotContains(t, m, "..data")
+
+	env = envs([]string{"LEVEL=vcfg"}, v.hypervisorInfo.envs, loaded)
+	assert.Equal(t, "vcfg", envMap(env)["LEVEL"])
+
+	opts.envFiles = []string{"/does/not/exist"}
+	_, err = v.loadEnv(opts)
+	assert.Error(t, err)
+
+}
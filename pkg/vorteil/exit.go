@@ -0,0 +1,245 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+type exitAction int
+
+const (
+	exitPoweroff exitAction = iota
+	exitReboot   exitAction = iota
+	exitIdle     exitAction = iota
+)
+
+const (
+	// kernel cmdline keys, e.g. vinitd.exit=reboot vinitd.exit.isaport=0xf4
+	exitCmdLine        = "vinitd.exit"
+	exitISAPortCmdLine = "vinitd.exit.isaport"
+
+	// guestinfo key on vmware
+	exitGuestInfoKey = "vorteil.exitcode"
+
+	// reported if the main program could not be started
+	exitCodeNotStarted = 127
+)
+
+var (
+	exitActionStrings = map[exitAction]string{
+		exitPoweroff: "poweroff",
+		exitReboot:   "reboot",
+		exitIdle:     "idle",
+	}
+
+	// wait status of exited processes from the reaper and the proc
+	// connector. the reaper might collect processes before exec.Cmd can read
+	// the status
+	exitStatuses    = make(map[int]syscall.WaitStatus)
+	exitStatusesMtx sync.Mutex
+
+	// exit code of the main program, -1 if unknown
+	mainExitCode = -1
+
+	finishedAction exitAction
+
+	programsFinishedOnce sync.Once
+)
+
+func parseExitAction(s string) (exitAction, error) {
+
+	for a, n := range exitActionStrings {
+		if n == s {
+			return a, nil
+		}
+	}
+
+	return exitPoweroff, fmt.Errorf("unknown exit action '%s'", s)
+}
+
+func exitActionFromCmdLine() exitAction {
+
+	s, ok := cmdLineValue(exitCmdLine)
+	if !ok {
+		return exitPoweroff
+	}
+
+	a, err := parseExitAction(s)
+	if err != nil {
+		logError("can not parse %s: %s", exitCmdLine, err.Error())
+	}
+
+	return a
+}
+
+func recordExitStatus(pid int, ws syscall.WaitStatus) {
+	exitStatusesMtx.Lock()
+	defer exitStatusesMtx.Unlock()
+	exitStatuses[pid] = ws
+}
+
+// waitStatusCode converts a wait status into a shell style exit code
+func waitStatusCode(ws syscall.WaitStatus) int {
+
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+
+	return ws.ExitStatus()
+}
+
+// mainProgram returns the program marked with VINITD_MAIN or the first
+// service. If there are only one-shot programs it is the first of them.
+func mainProgram(progs []*program) *program {
+
+	var first, oneshot *program
+
+	for _, p := range progs {
+		if p.opts.main {
+			return p
+		}
+		if p.isJob() {
+			continue
+		}
+		if p.isOneshot() {
+			if oneshot == nil || p.progIndex < oneshot.progIndex {
+				oneshot = p
+			}
+			continue
+		}
+		if first == nil || p.progIndex < first.progIndex {
+			first = p
+		}
+	}
+
+	if first == nil {
+		return oneshot
+	}
+
+	return first
+}
+
+// exitCode returns the exit code of a finished program or -1
+func (p *program) exitCode() int {
+
+	if code := cmdExitCode(p.cmd); code >= 0 {
+		return code
+	}
+
+	if p.failed {
+		return exitCodeNotStarted
+	}
+
+	return -1
+}
+
+// cmdExitCode returns the exit code of a finished command or -1
+func cmdExitCode(cmd *exec.Cmd) int {
+
+	if cmd == nil || cmd.Process == nil {
+		return -1
+	}
+
+	if cmd.ProcessState != nil {
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			return waitStatusCode(ws)
+		}
+		return cmd.ProcessState.ExitCode()
+	}
+
+	exitStatusesMtx.Lock()
+	defer exitStatusesMtx.Unlock()
+
+	if ws, ok := exitStatuses[cmd.Process.Pid]; ok {
+		return waitStatusCode(ws)
+	}
+
+	return -1
+}
+
+func (v *Vinitd) reportExitCode(progs []*program) {
+
+	p := mainProgram(progs)
+	if p == nil {
+		return
+	}
+
+	mainExitCode = p.exitCode()
+
+	// parseable line on the console
+	logAlways("VINITD_EXIT_CODE=%d", mainExitCode)
+
+	if v.hypervisorInfo.hypervisor == hvVMWare {
+		err := vmtoolsInfoSet(exitGuestInfoKey, strconv.Itoa(mainExitCode))
+		if err != nil {
+			logWarn("can not report exit code: %s", err.Error())
+		}
+	}
+
+}
+
+// isaDebugExit writes the exit code to an isa-debug-exit device. qemu exits
+// immediately with (code << 1) | 1.
+func isaDebugExit() {
+
+	s, ok := cmdLineValue(exitISAPortCmdLine)
+	if !ok || mainExitCode < 0 {
+		return
+	}
+
+	port, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		logError("can not parse %s: %s", exitISAPortCmdLine, err.Error())
+		return
+	}
+
+	err = outb(uint16(port), byte(mainExitCode))
+	if err != nil {
+		logError("can not write exit code to port %#x: %s", port, err.Error())
+	}
+
+}
+
+// programsFinished is called when no programs are running anymore. It reports
+// the exit code of the main program and runs the configured exit action.
+func programsFinished(progs []*program) {
+
+	if initStatus == statusPoweroff {
+		return
+	}
+
+	programsFinishedOnce.Do(func() {
+
+		logAlways("no programs still running")
+
+		if len(progs) > 0 {
+			progs[0].vinitd.reportExitCode(progs)
+		}
+
+		finishedAction = exitActionFromCmdLine()
+		if finishedAction == exitIdle {
+			logAlways("idling, system stays up")
+		}
+
+	})
+
+	switch finishedAction {
+	case exitIdle:
+		return
+	case exitReboot:
+		instantShutdown = true
+		shutdown(syscall.LINUX_REBOOT_CMD_RESTART)
+	default:
+		instantShutdown = true
+		shutdown(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+	}
+
+}
@@ -0,0 +1,203 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type failureAction int
+
+const (
+	failFatal   failureAction = iota
+	failDegrade failureAction = iota
+	failRetry   failureAction = iota
+	failReboot  failureAction = iota
+)
+
+// subsystems with their own failure policy
+const (
+	failureNetwork = "network"
+	failureGateway = "gateway"
+	failureRoute   = "route"
+	failureNTP     = "ntp"
+	failureProgram = "program"
+	failureOneshot = "oneshot"
+	failureSystem  = "system"
+	failureCloud   = "cloudinit"
+)
+
+const (
+	// kernel cmdline keys, e.g. vinitd.failure=degrade vinitd.failure.ntp=retry:3
+	failureCmdLine = "vinitd.failure"
+
+	failureRetryDelay = time.Second
+)
+
+type failurePolicy struct {
+	action  failureAction
+	retries int
+}
+
+var (
+	failureActionStrings = map[failureAction]string{
+		failFatal:   "fatal",
+		failDegrade: "degrade",
+		failRetry:   "retry",
+		failReboot:  "reboot",
+	}
+
+	// defaults reflect the behaviour before policies were configurable,
+	// chronyd failing to start with generated config did not stop the boot
+	failureDefaults = map[string]failurePolicy{
+		failureNetwork: {action: failFatal},
+		failureGateway: {action: failFatal},
+		failureRoute:   {action: failDegrade},
+		failureNTP:     {action: failDegrade},
+		failureProgram: {action: failFatal},
+		failureOneshot: {action: failFatal},
+		failureSystem:  {action: failFatal},
+		failureCloud:   {action: failDegrade},
+	}
+
+	failurePolicies     map[string]failurePolicy
+	failurePoliciesOnce sync.Once
+)
+
+func (fp failurePolicy) String() string {
+	if fp.action == failRetry {
+		return fmt.Sprintf("%s:%d", failureActionStrings[fp.action], fp.retries)
+	}
+	return failureActionStrings[fp.action]
+}
+
+// parseFailurePolicy parses fatal, degrade, reboot or retry:N
+func parseFailurePolicy(s string) (failurePolicy, error) {
+
+	ss := strings.SplitN(strings.ToLower(strings.TrimSpace(s)), ":", 2)
+
+	for a, n := range failureActionStrings {
+		if n != ss[0] {
+			continue
+		}
+
+		fp := failurePolicy{action: a}
+
+		if a != failRetry {
+			if len(ss) > 1 {
+				return fp, fmt.Errorf("failure policy %s does not accept a value", n)
+			}
+			return fp, nil
+		}
+
+		// retry without a number retries once
+		fp.retries = 1
+		if len(ss) > 1 {
+			r, err := strconv.Atoi(ss[1])
+			if err != nil || r < 1 {
+				return fp, fmt.Errorf("invalid retry count '%s'", ss[1])
+			}
+			fp.retries = r
+		}
+
+		return fp, nil
+	}
+
+	return failurePolicy{}, fmt.Errorf("unknown failure policy '%s'", s)
+}
+
+func loadFailurePolicies() {
+
+	failurePolicies = make(map[string]failurePolicy)
+
+	for k, v := range failureDefaults {
+		failurePolicies[k] = v
+	}
+
+	// global override first, subsystem values win
+	if s, ok := cmdLineValue(failureCmdLine); ok {
+		fp, err := parseFailurePolicy(s)
+		if err != nil {
+			logError("can not parse %s: %s", failureCmdLine, err.Error())
+		} else {
+			for k := range failurePolicies {
+				failurePolicies[k] = fp
+			}
+		}
+	}
+
+	for k := range failureDefaults {
+		key := fmt.Sprintf("%s.%s", failureCmdLine, k)
+		s, ok := cmdLineValue(key)
+		if !ok {
+			continue
+		}
+		fp, err := parseFailurePolicy(s)
+		if err != nil {
+			logError("can not parse %s: %s", key, err.Error())
+			continue
+		}
+		failurePolicies[k] = fp
+	}
+
+	for k, fp := range failurePolicies {
+		logDebug("failure policy %s: %s", k, fp)
+	}
+
+}
+
+func failurePolicyFor(subsystem string) failurePolicy {
+
+	failurePoliciesOnce.Do(loadFailurePolicies)
+
+	if fp, ok := failurePolicies[subsystem]; ok {
+		return fp
+	}
+
+	return failurePolicy{action: failFatal}
+}
+
+// handleFailure runs fn and applies the failure policy of the subsystem
+// if it returns an error. It returns nil if fn succeeded or the policy allows
+// to continue in a degraded state.
+func handleFailure(subsystem string, fn func() error) error {
+	return handleFailurePolicy(subsystem, failurePolicyFor(subsystem), fn)
+}
+
+// handleFailurePolicy is handleFailure with an explicit policy, e.g. for
+// bootstrap steps
+func handleFailurePolicy(subsystem string, fp failurePolicy, fn func() error) error {
+
+	err := fn()
+	for i := 0; err != nil && fp.action == failRetry && i < fp.retries; i++ {
+		logWarn("%s failed: %s, retry %d of %d", subsystem, err.Error(), i+1, fp.retries)
+		time.Sleep(failureRetryDelay * time.Duration(i+1))
+		err = fn()
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	switch fp.action {
+	case failDegrade:
+		logError("%s failed, continuing: %s", subsystem, err.Error())
+		return nil
+	case failReboot:
+		logError("%s failed, rebooting: %s", subsystem, err.Error())
+		shutdown(syscall.LINUX_REBOOT_CMD_RESTART)
+	default:
+		// fatal and retries exhausted
+		SystemPanic("%s failed: %s", subsystem, err.Error())
+	}
+
+	return err
+}
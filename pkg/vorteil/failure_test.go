@@ -0,0 +1,71 @@
+package vorteil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFailurePolicy(t *testing.T) {
+
+	fp, err := parseFailurePolicy("fatal")
+	assert.NoError(t, err)
+	assert.Equal(t, failFatal, fp.action)
+
+	fp, err = parseFailurePolicy("Degrade")
+	assert.NoError(t, err)
+	assert.Equal(t, failDegrade, fp.action)
+
+	fp, err = parseFailurePolicy("reboot")
+	assert.NoError(t, err)
+	assert.Equal(t, failReboot, fp.action)
+
+	fp, err = parseFailurePolicy("retry")
+	assert.NoError(t, err)
+	assert.Equal(t, failRetry, fp.action)
+	assert.Equal(t, 1, fp.retries)
+
+	fp, err = parseFailurePolicy("retry:5")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, fp.retries)
+	assert.Equal(t, "retry:5", fp.String())
+
+	_, err = parseFailurePolicy("retry:0")
+	assert.Error(t, err)
+
+	_, err = parseFailurePolicy("fatal:3")
+	assert.Error(t, err)
+
+	_, err = parseFailurePolicy("explode")
+	assert.Error(t, err)
+
+}
+
+func TestHandleFailure(t *testing.T) {
+
+	failurePoliciesOnce.Do(func() {})
+	failurePolicies = map[string]failurePolicy{
+		failureRoute: {action: failDegrade},
+		failureNTP:   {action: failRetry, retries: 2},
+	}
+
+	calls := 0
+	err := handleFailure(failureRoute, func() error {
+		calls++
+		return assert.AnError
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = handleFailure(failureNTP, func() error {
+		calls++
+		if calls < 3 {
+			return assert.AnError
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+}
@@ -0,0 +1,436 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fetchRetries        = 5
+	fetchMaxBackoff     = 30 * time.Second
+	fetchRequestTimeout = 5 * time.Minute
+
+	extractAuto = "auto"
+	extractTar  = "tar"
+	extractZip  = "zip"
+
+	authGCP   = "gcp"
+	authAzure = "azure"
+
+	gcpTokenURL   = "%s/computeMetadata/v1/instance/service-accounts/default/token"
+	azureTokenURL = "%s/metadata/identity/oauth2/token"
+
+	// default resource for azure managed identity tokens
+	azureStorageResource = "https://storage.azure.com/"
+)
+
+var (
+	// first wait between retries, doubles every attempt
+	fetchBackoff = time.Second
+
+	// metadata server for auth tokens
+	fetchMetadataServer = metadataURL
+)
+
+// fetchOptions are the key=value arguments of GET
+type fetchOptions struct {
+	url, dest string
+
+	sha256   string
+	headers  http.Header
+	mode     os.FileMode
+	owner    string
+	extract  string
+	auth     string
+	resource string
+	retries  int
+}
+
+// permanentError is returned for failures which are not worth another attempt
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// parseFetchOptions parses GET url dest [sha256=x] [header='Name: value']...
+// [mode=0644] [owner=user:group] [extract=auto|tar|zip] [auth=gcp|azure]
+// [resource=x] [retries=n]. $VAR in headers is replaced from env.
+func parseFetchOptions(args []string, env []string) (*fetchOptions, error) {
+
+	opts := &fetchOptions{
+		headers: make(http.Header),
+		mode:    0644,
+		retries: fetchRetries,
+	}
+
+	var rest []string
+
+	for _, a := range args {
+
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			rest = append(rest, a)
+			continue
+		}
+
+		var err error
+
+		switch kv[0] {
+		case "sha256":
+			opts.sha256 = strings.ToLower(kv[1])
+		case "header":
+			h := strings.SplitN(kv[1], ":", 2)
+			if len(h) != 2 {
+				return nil, fmt.Errorf("header '%s' needs to be 'name: value'", kv[1])
+			}
+			val := strings.TrimSpace(h[1])
+			for _, e := range env {
+				s := strings.SplitN(e, "=", 2)
+				if len(s) == 2 {
+					val = strings.ReplaceAll(val, fmt.Sprintf(replaceString, s[0]), s[1])
+				}
+			}
+			opts.headers.Add(strings.TrimSpace(h[0]), val)
+		case "mode":
+			opts.mode, err = parseMode(kv[1])
+		case "owner":
+			opts.owner = kv[1]
+		case "extract":
+			opts.extract = kv[1]
+			if kv[1] != extractAuto && kv[1] != extractTar && kv[1] != extractZip {
+				err = fmt.Errorf("unknown archive type '%s'", kv[1])
+			}
+		case "auth":
+			opts.auth = kv[1]
+			if kv[1] != authGCP && kv[1] != authAzure {
+				err = fmt.Errorf("unknown auth '%s'", kv[1])
+			}
+		case "resource":
+			opts.resource = kv[1]
+		case "retries":
+			opts.retries, err = strconv.Atoi(kv[1])
+		default:
+			// urls can contain '='
+			rest = append(rest, a)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rest) != 2 {
+		return nil, fmt.Errorf("bootstrap 'GET' needs one url and one target")
+	}
+
+	_, err := url.ParseRequestURI(rest[0])
+	if err != nil {
+		return nil, fmt.Errorf("can not parse url: %s", err)
+	}
+
+	opts.url, opts.dest = rest[0], rest[1]
+
+	if opts.sha256 != "" && len(opts.sha256) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid sha256 '%s'", opts.sha256)
+	}
+
+	return opts, nil
+}
+
+// bootstrapFetch downloads a file, verifies it and optionally extracts it
+func bootstrapFetch(ctx context.Context, args []string, p *program) error {
+
+	opts, err := parseFetchOptions(args, p.env)
+	if err != nil {
+		return err
+	}
+
+	return fetch(ctx, opts)
+}
+
+func fetch(ctx context.Context, opts *fetchOptions) error {
+
+	if opts.auth != "" {
+		token, err := metadataToken(opts.auth, opts.resource)
+		if err != nil {
+			return fmt.Errorf("can not get %s token: %v", opts.auth, err)
+		}
+		opts.headers.Set("Authorization", "Bearer "+token)
+	}
+
+	dir := filepath.Dir(opts.dest)
+	if opts.extract != "" {
+		dir = opts.dest
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("can not create dir %s: %s", dir, err)
+	}
+
+	backoff := fetchBackoff
+
+	for attempt := 0; ; attempt++ {
+
+		err = fetchOnce(ctx, opts, dir)
+		if err == nil {
+			break
+		}
+
+		if _, ok := err.(*permanentError); ok || attempt >= opts.retries {
+			return err
+		}
+
+		logWarn("fetching %s failed, retrying in %v: %v", opts.url, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > fetchMaxBackoff {
+			backoff = fetchMaxBackoff
+		}
+	}
+
+	logDebug("fetched %s", opts.url)
+
+	return nil
+}
+
+// fetchOnce downloads to a temporary file in dir and moves or extracts it
+// to the destination
+func fetchOnce(ctx context.Context, opts *fetchOptions, dir string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, fetchRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.url, nil)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	for k, v := range opts.headers {
+		req.Header[k] = v
+	}
+
+	if h := opts.headers.Get("Host"); h != "" {
+		req.Host = h
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("%s returned %s", opts.url, resp.Status)
+		// client errors will not go away
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout &&
+			resp.StatusCode != http.StatusTooManyRequests {
+			return &permanentError{err}
+		}
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".fetch")
+	if err != nil {
+		return &permanentError{err}
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if opts.sha256 != "" {
+		sum := hex.EncodeToString(h.Sum(nil))
+		if sum != opts.sha256 {
+			return fmt.Errorf("checksum mismatch, expected %s got %s", opts.sha256, sum)
+		}
+	}
+
+	if opts.extract != "" {
+		return extract(ctx, f, opts)
+	}
+
+	err = f.Chmod(opts.mode)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	if opts.owner != "" {
+		uid, gid, err := lookupOwner(opts.owner)
+		if err != nil {
+			return &permanentError{err}
+		}
+		err = f.Chown(uid, gid)
+		if err != nil {
+			return &permanentError{err}
+		}
+	}
+
+	err = os.Rename(f.Name(), opts.dest)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	return nil
+}
+
+// extract unpacks the downloaded file into the destination directory
+func extract(ctx context.Context, f *os.File, opts *fetchOptions) error {
+
+	kind := opts.extract
+	if kind == extractAuto {
+		kind = extractTar
+		magic := make([]byte, 4)
+		if _, err := f.ReadAt(magic, 0); err == nil && string(magic) == "PK\x03\x04" {
+			kind = extractZip
+		}
+	}
+
+	var err error
+	if kind == extractZip {
+		err = unzip(ctx, f.Name(), opts.dest)
+	} else {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		err = untar(ctx, f, opts.dest)
+	}
+
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	if opts.owner != "" {
+		return bootstrapChangeOwner(ctx, []string{"-R", opts.owner, opts.dest}, nil)
+	}
+
+	return nil
+}
+
+func unzip(ctx context.Context, archive, dest string) error {
+
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		target := filepath.Join(dest, zf.Name)
+		if !strings.HasPrefix(target, dest+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry %s outside of %s", zf.Name, dest)
+		}
+
+		if zf.FileInfo().IsDir() {
+			err = os.MkdirAll(target, zf.Mode().Perm()|0700)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+
+		os.Remove(target)
+		err = untarFile(r, target, zf.Mode().Perm())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type metadataTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// metadataToken gets an access token of the instance's service account or
+// managed identity from the metadata server
+func metadataToken(auth, resource string) (string, error) {
+
+	var (
+		u      string
+		header map[string]string
+		query  map[string]string
+	)
+
+	switch auth {
+	case authGCP:
+		u = fmt.Sprintf(gcpTokenURL, fetchMetadataServer)
+		header = gcpMetadataHeader
+	case authAzure:
+		u = fmt.Sprintf(azureTokenURL, fetchMetadataServer)
+		header = azureMetadataHeader
+		if resource == "" {
+			resource = azureStorageResource
+		}
+		query = map[string]string{
+			"api-version": "2018-02-01",
+			"resource":    resource,
+		}
+	}
+
+	r, err := doMetadataRequest(u, header, query)
+	if err != nil {
+		return "", err
+	}
+
+	var tr metadataTokenResponse
+	err = json.Unmarshal([]byte(r), &tr)
+	if err != nil {
+		return "", err
+	}
+
+	if tr.AccessToken == "" {
+		return "", fmt.Errorf("empty access token")
+	}
+
+	return tr.AccessToken, nil
+}
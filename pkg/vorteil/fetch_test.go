@@ -0,0 +1,103 @@
+package vorteil
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetch(t *testing.T) {
+
+	fetchBackoff = time.Millisecond
+	defer func() { fetchBackoff = time.Second }()
+
+	dir, err := ioutil.TempDir("", "fetch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	w, _ := zw.Create("bin/app")
+	w.Write([]byte("binary"))
+	zw.Close()
+
+	fails := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			if fails > 0 {
+				fails--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("content"))
+		case "/private":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("private"))
+		case "/app.zip":
+			w.Write(zipBuf.Bytes())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p := &program{env: []string{"TOKEN=secret"}}
+	ctx := context.Background()
+	sum := sha256.Sum256([]byte("content"))
+
+	dest := filepath.Join(dir, "flaky")
+	err = bootstrapFetch(ctx, []string{srv.URL + "/flaky", dest,
+		"sha256=" + hex.EncodeToString(sum[:]), "mode=0600"}, p)
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadFile(dest)
+	assert.Equal(t, "content", string(b))
+	fi, err := os.Stat(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// not found is not retried and does not create the file
+	err = bootstrapFetch(ctx, []string{srv.URL + "/missing", filepath.Join(dir, "missing")}, p)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = bootstrapFetch(ctx, []string{srv.URL + "/flaky", filepath.Join(dir, "bad"),
+		"sha256=" + hex.EncodeToString(make([]byte, 32)), "retries=1"}, p)
+	assert.Error(t, err)
+
+	err = bootstrapFetch(ctx, []string{srv.URL + "/private", filepath.Join(dir, "private"),
+		"header=Authorization: Bearer $TOKEN"}, p)
+	assert.NoError(t, err)
+
+	err = bootstrapFetch(ctx, []string{srv.URL + "/app.zip", filepath.Join(dir, "app"),
+		"extract=auto"}, p)
+	assert.NoError(t, err)
+	b, _ = ioutil.ReadFile(filepath.Join(dir, "app", "bin", "app"))
+	assert.Equal(t, "binary", string(b))
+
+	// only the extracted files are left
+	fis, _ := ioutil.ReadDir(dir)
+	assert.Len(t, fis, 3)
+
+	_, err = parseFetchOptions([]string{srv.URL, "/tmp/x", "extract=rar"}, nil)
+	assert.Error(t, err)
+
+	_, err = parseFetchOptions([]string{srv.URL}, nil)
+	assert.Error(t, err)
+
+}
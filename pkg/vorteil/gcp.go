@@ -0,0 +1,232 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// protocol of local routes added by vinitd, the same google's guest
+	// agent uses
+	gcpRouteProtocol = 0x42
+
+	// guest attributes need enable-guest-attributes in the metadata
+	gcpGuestAttributes = "/computeMetadata/v1/instance/guest-attributes/vorteil/"
+
+	gcpStatusReady  = "ready"
+	gcpStatusFailed = "failed"
+)
+
+var gcpGuestAttributesClient = &http.Client{
+	Timeout: 5 * time.Second,
+}
+
+// gcpInterface are the addresses of a network interface which are routed
+// to the instance without being configured on the interface
+type gcpInterface struct {
+	ForwardedIPs      []string `json:"forwardedIps"`
+	TargetInstanceIPs []string `json:"targetInstanceIps"`
+	IPAliases         []string `json:"ipAliases"`
+}
+
+// localRoutes returns the sorted IPv4 networks which have to be routed
+// locally, single addresses are /32 networks
+func (i *gcpInterface) localRoutes() []string {
+
+	var routes []string
+
+	for _, list := range [][]string{i.ForwardedIPs, i.TargetInstanceIPs, i.IPAliases} {
+		for _, s := range list {
+
+			if !strings.Contains(s, "/") {
+				s += "/32"
+			}
+
+			_, n, err := net.ParseCIDR(s)
+			if err != nil || n.IP.To4() == nil {
+				logDebug("ignoring local route %s", s)
+				continue
+			}
+
+			if !containsString(routes, n.String()) {
+				routes = append(routes, n.String())
+			}
+		}
+	}
+
+	sort.Strings(routes)
+
+	return routes
+}
+
+// diffRoutes returns the routes to add and to remove
+func diffRoutes(current, desired []string) ([]string, []string) {
+
+	var add, del []string
+
+	for _, r := range desired {
+		if !containsString(current, r) {
+			add = append(add, r)
+		}
+	}
+
+	for _, r := range current {
+		if !containsString(desired, r) {
+			del = append(del, r)
+		}
+	}
+
+	return add, del
+}
+
+// syncLocalRoutes makes the local routes of vinitd on the interface match
+// the desired networks
+func syncLocalRoutes(dev string, desired []string) error {
+
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return err
+	}
+
+	filter := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Table:     unix.RT_TABLE_LOCAL,
+		Protocol:  gcpRouteProtocol,
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter,
+		netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return err
+	}
+
+	var current []string
+	existing := make(map[string]netlink.Route)
+	for _, r := range routes {
+		if r.Dst != nil {
+			current = append(current, r.Dst.String())
+			existing[r.Dst.String()] = r
+		}
+	}
+
+	add, del := diffRoutes(current, desired)
+
+	for _, d := range del {
+		logDebug("removing local route %s from %s", d, dev)
+		r := existing[d]
+		if err := netlink.RouteDel(&r); err != nil {
+			logWarn("can not remove local route %s: %s", d, err.Error())
+		}
+	}
+
+	for _, a := range add {
+
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			continue
+		}
+
+		logDebug("adding local route %s to %s", a, dev)
+		err = netlink.RouteAdd(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       n,
+			Table:     unix.RT_TABLE_LOCAL,
+			Scope:     netlink.SCOPE_HOST,
+			Type:      unix.RTN_LOCAL,
+			Protocol:  gcpRouteProtocol,
+		})
+		if err != nil {
+			logWarn("can not add local route %s: %s", a, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// updateInterface routes forwarded IPs of load balancers, target instance
+// IPs and alias IP ranges to the interface. These are not proxies but a
+// virtual network:
+// https://cloud.google.com/load-balancing/docs/internal#how_ilb_works
+// Routes of removed addresses are deleted, they are kept if the metadata
+// can not be requested.
+func (p *gcpProvider) updateInterface(name string, idx int) {
+
+	var gi gcpInterface
+	err := p.getJSON(fmt.Sprintf("/computeMetadata/v1/instance/network-interfaces/%d/", idx),
+		map[string]string{"recursive": "true"}, &gi)
+	if err != nil {
+		logDebug("can not request local routes of %s: %s", name, err.Error())
+		return
+	}
+
+	p.routeMtx.Lock()
+	defer p.routeMtx.Unlock()
+
+	err = syncLocalRoutes(name, gi.localRoutes())
+	if err != nil {
+		logWarn("can not update local routes of %s: %s", name, err.Error())
+	}
+}
+
+// setGuestAttribute writes a value to the guest attributes of the instance
+func (p *gcpProvider) setGuestAttribute(key, value string) error {
+
+	req, err := http.NewRequest(http.MethodPut, p.server+gcpGuestAttributes+key, strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range p.header {
+		req.Header.Add(k, v)
+	}
+
+	resp, err := gcpGuestAttributesClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("setting guest attribute %s failed with status %d", key, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// reportReady writes the boot status to the guest attributes
+func (p *gcpProvider) reportReady() {
+
+	err := p.setGuestAttribute("status", gcpStatusReady)
+	if err != nil {
+		logDebug("can not write boot status: %s", err.Error())
+	}
+}
+
+// reportFailure writes the failed status and the reason to the guest
+// attributes
+func (p *gcpProvider) reportFailure(reason string) {
+
+	err := p.setGuestAttribute("failure", reason)
+	if err == nil {
+		err = p.setGuestAttribute("status", gcpStatusFailed)
+	}
+
+	if err != nil {
+		logDebug("can not write boot status: %s", err.Error())
+	}
+}
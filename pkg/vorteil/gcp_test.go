@@ -0,0 +1,81 @@
+package vorteil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCPLocalRoutes(t *testing.T) {
+
+	gi := &gcpInterface{
+		ForwardedIPs:      []string{"10.128.0.10", "10.128.0.9", "2600:1900::1"},
+		TargetInstanceIPs: []string{"10.128.0.10"},
+		IPAliases:         []string{"10.8.0.0/24", "invalid"},
+	}
+
+	routes := gi.localRoutes()
+	assert.Equal(t, []string{"10.128.0.10/32", "10.128.0.9/32", "10.8.0.0/24"}, routes)
+
+	// the load balancer moved a forwarded ip
+	add, del := diffRoutes(routes, []string{"10.128.0.11/32", "10.8.0.0/24"})
+	assert.Equal(t, []string{"10.128.0.11/32"}, add)
+	assert.Equal(t, []string{"10.128.0.10/32", "10.128.0.9/32"}, del)
+
+	add, del = diffRoutes(routes, routes)
+	assert.Empty(t, add)
+	assert.Empty(t, del)
+
+}
+
+func TestGCPGuestAttributes(t *testing.T) {
+
+	attrs := make(map[string]string)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		attrs[r.URL.Path] = string(b)
+	}))
+	defer srv.Close()
+
+	p := newGCPProvider(srv.URL)
+
+	p.reportReady()
+	assert.Equal(t, map[string]string{gcpGuestAttributes + "status": "ready"}, attrs)
+
+	p.reportFailure("starting program failed")
+	assert.Equal(t, "failed", attrs[gcpGuestAttributes+"status"])
+	assert.Equal(t, "starting program failed", attrs[gcpGuestAttributes+"failure"])
+
+}
+
+func TestGCPAttributeRefresh(t *testing.T) {
+
+	paths := map[string]string{
+		"/computeMetadata/v1/instance/attributes/vorteil": `{"MODE": "a"}`,
+	}
+	srv := metadataStub(t, "Metadata-Flavor", "Google", paths)
+	defer srv.Close()
+
+	p := newGCPProvider(srv.URL)
+
+	v := &Vinitd{hypervisorInfo: hv{envs: make(map[string]string)}}
+	probeCloud(p, v)
+	assert.Equal(t, "a", v.hypervisorInfo.envs["MODE"])
+
+	// changed at runtime
+	paths["/computeMetadata/v1/instance/attributes/vorteil"] = `{"MODE": "b"}`
+
+	w := &metadataWatcher{v: v, p: p, interval: time.Second}
+	w.refresh()
+	assert.Equal(t, "b", v.hypervisorInfo.envs["MODE"])
+
+}
@@ -21,6 +21,7 @@
 #include <linux/rtnetlink.h>
 #include <linux/genetlink.h>
 #include <sys/syscall.h>
+#include <sys/io.h>
 
 static inline void set_sockaddr(struct sockaddr_in *sin, int addr)
 {
@@ -29,69 +30,6 @@ static inline void set_sockaddr(struct sockaddr_in *sin, int addr)
 	sin->sin_port = 0;
 }
 
-#define NLA_DATA(na) ((void *)((char*)(na) + NLA_HDRLEN))
-#define GENLMSG_DATA(glh) ((void *)(NLMSG_DATA(glh) + GENL_HDRLEN))
-
-int helper_add_gcp_virtual_route(char *dev, char *ip)
-{
-  
-  struct sockaddr_nl saddr;
-  struct nlattr *nl_na;
-
-  struct {
-      struct nlmsghdr n;
-      struct rtmsg r;
-      char buf[4096];
-  } nl_request;
-
-  int sock, ret, idx;
-  in_addr_t addr;
-
-   sock = socket(AF_NETLINK, SOCK_RAW, NETLINK_ROUTE);
-  if (sock < 0) {
-      return 1;
-  }
-  memset(&saddr, 0, sizeof(saddr));
-
-  nl_request.n.nlmsg_len = NLMSG_LENGTH(sizeof(struct rtmsg) + 16);
-
-  nl_request.n.nlmsg_flags = NLM_F_REQUEST | NLM_F_ACK|NLM_F_EXCL|NLM_F_CREATE;
-  nl_request.n.nlmsg_type = RTM_NEWROUTE;
-
-  nl_request.r.rtm_family = AF_INET;
-  nl_request.r.rtm_table = RT_TABLE_LOCAL;
-  nl_request.r.rtm_src_len = 0;
-  nl_request.r.rtm_tos = 0;
-  nl_request.r.rtm_dst_len = 32;
-  nl_request.r.rtm_scope = RT_SCOPE_HOST;
-  nl_request.r.rtm_protocol = 0x42;
-  nl_request.r.rtm_type = RTN_LOCAL;
-  nl_request.r.rtm_flags = 0;
-
-  nl_na = (struct nlattr *) &nl_request.buf;
-  nl_na->nla_type = RTA_DST;
-  nl_na->nla_len = 8;
-
-  addr = inet_addr(ip);
-  memset(NLA_DATA(nl_na), 0, 8);
-  memcpy(NLA_DATA(nl_na), &addr, sizeof(addr));
-
-  nl_na = (struct nlattr *) ((char *) nl_na + NLA_ALIGN(nl_na->nla_len));
-  nl_na->nla_type = RTA_OIF;
-  nl_na->nla_len = 8;
-
-  memset(NLA_DATA(nl_na), 0, 8);
-  idx = if_nametoindex(dev);
-  memcpy(NLA_DATA(nl_na), &idx, sizeof(idx));
-
-  ret =  send(sock, &nl_request, sizeof(nl_request), 0);
-
-  close (sock);
-
-  return ret;
-
-}
-
 int helper_add_route(int dst, int mask, int gw, char *dev, int flags)
 {
 	struct rtentry *rm;
@@ -126,10 +64,13 @@ ret:;
 	return err;
 }
 
-void err_print(char *txt)
+int helper_outb(int port, int value)
 {
-	FILE *fp;
-	fp = fopen("/dev/vtty", "w+");
-	fprintf(fp, "%s\n", txt);
-	fclose(fp);
+	if (ioperm(port, 1, 1)) {
+		return errno;
+	}
+
+	outb(value, port);
+
+	return 0;
 }
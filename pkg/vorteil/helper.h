@@ -8,6 +8,6 @@
 
 extern int helper_add_route(int dst, int mask, int addr, char *dev, int flags);
 
-extern int helper_add_gcp_virtual_route(char *dev, char *ip);
+extern int helper_outb(int port, int value);
 
 #endif
@@ -0,0 +1,123 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	imdsTokenPath   = "/latest/api/token"
+	imdsTokenHeader = "X-aws-ec2-metadata-token"
+	imdsTTLHeader   = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	imdsTokenTTL = 6 * time.Hour
+
+	// tokens are renewed this long before they expire
+	imdsTokenRefresh = time.Minute
+
+	// after a failed token request IMDSv1 is used for this long before
+	// trying again
+	imdsFallbackRetry = 5 * time.Minute
+)
+
+var (
+	// the token request fails fast if the hop limit is too low, e.g. in
+	// containers
+	imdsClient = &http.Client{
+		Timeout: 2 * time.Second,
+	}
+
+	imds = &imdsTokens{
+		tokens: make(map[string]imdsToken),
+	}
+)
+
+// imdsToken is an IMDSv2 session token. An empty value means IMDSv1.
+type imdsToken struct {
+	value   string
+	expires time.Time
+}
+
+// imdsTokens caches the session token per metadata server
+type imdsTokens struct {
+	mtx    sync.Mutex
+	tokens map[string]imdsToken
+}
+
+// token returns a valid token for the server or an empty string if the
+// server does not support IMDSv2
+func (t *imdsTokens) token(server string) string {
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	tok, ok := t.tokens[server]
+	if ok && time.Now().Add(imdsTokenRefresh).Before(tok.expires) {
+		return tok.value
+	}
+
+	r, status, err := metadataRequest(imdsClient, http.MethodPut, server+imdsTokenPath,
+		map[string]string{imdsTTLHeader: strconv.Itoa(int(imdsTokenTTL.Seconds()))}, nil)
+
+	if err != nil {
+		// 403 if IMDS is disabled, 404 and 405 if only IMDSv1 is available
+		logDebug("IMDSv2 token not available (status %d): %s, using IMDSv1", status, err.Error())
+		t.tokens[server] = imdsToken{expires: time.Now().Add(imdsFallbackRetry)}
+		return ""
+	}
+
+	logDebug("got IMDSv2 token")
+	secrets.add(r)
+	t.tokens[server] = imdsToken{value: r, expires: time.Now().Add(imdsTokenTTL)}
+
+	return r
+}
+
+// invalidate removes the token, e.g. if the server rejected it
+func (t *imdsTokens) invalidate(server string) {
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	delete(t.tokens, server)
+}
+
+// imdsGet requests a path from the EC2 metadata server with an IMDSv2 token
+// if available. A rejected token is renewed once.
+func imdsGet(server, path string) (string, error) {
+
+	var (
+		r      string
+		status int
+		err    error
+	)
+
+	for i := 0; i < 2; i++ {
+
+		header := make(map[string]string)
+		for k, val := range ec2MetadataHeader {
+			header[k] = val
+		}
+
+		if tok := imds.token(server); tok != "" {
+			header[imdsTokenHeader] = tok
+		}
+
+		r, status, err = metadataRequest(metadataHTTPClient, getRequest, server+path, header, nil)
+		if status != http.StatusUnauthorized {
+			break
+		}
+
+		logDebug("IMDS token rejected, requesting new token")
+		imds.invalidate(server)
+	}
+
+	return r, err
+}
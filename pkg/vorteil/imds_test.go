@@ -0,0 +1,200 @@
+package vorteil
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// imdsEmulator behaves like the EC2 instance metadata service with
+// HttpTokens required or optional. Without v2 token requests fail like on
+// older emulators.
+type imdsEmulator struct {
+	mtx      sync.Mutex
+	v2       bool
+	required bool
+	tokens   map[string]bool
+	puts     int
+	v1       int
+	fail     bool
+	values   map[string]string
+}
+
+func (e *imdsEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Path == imdsTokenPath {
+		if !e.v2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ttl, err := strconv.Atoi(r.Header.Get(imdsTTLHeader))
+		if err != nil || ttl < 1 || ttl > 21600 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		e.puts++
+		tok := fmt.Sprintf("token-%d", e.puts)
+		e.tokens[tok] = true
+		w.Write([]byte(tok))
+		return
+	}
+
+	tok := r.Header.Get(imdsTokenHeader)
+	if (tok == "" && e.required) || (tok != "" && !e.tokens[tok]) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if tok == "" {
+		e.v1++
+	}
+
+	val, ok := e.values[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(val))
+
+}
+
+func newIMDSEmulator(v2, required bool) *imdsEmulator {
+	return &imdsEmulator{
+		v2:       v2,
+		required: required,
+		tokens:   make(map[string]bool),
+		values: map[string]string{
+			"/latest/meta-data/public-ipv4":              "52.1.2.3",
+			"/latest/user-data":                          "#cloud-config",
+			"/latest/dynamic/instance-identity/document": `{"region": "eu-west-1", "instanceId": "i-123"}`,
+		},
+	}
+}
+
+func probeEmulator(e *imdsEmulator, url string) map[string]string {
+
+	v := &Vinitd{
+		ifcs:           map[string]*ifc{"eth0": {name: "eth0", idx: 0}},
+		hypervisorInfo: hv{envs: make(map[string]string)},
+	}
+	probeCloud(newEC2Provider(url), v)
+
+	return v.hypervisorInfo.envs
+}
+
+func TestIMDSv2Required(t *testing.T) {
+
+	e := newIMDSEmulator(true, true)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	envs := probeEmulator(e, srv.URL)
+	assert.Equal(t, "52.1.2.3", envs["EXT_IP0"])
+	assert.Equal(t, "#cloud-config", envs[envUserData])
+	assert.Equal(t, "eu-west-1", envs[envRegion])
+	assert.Equal(t, "i-123", envs[envInstanceID])
+
+	// token is cached
+	assert.Equal(t, 1, e.puts)
+
+	// token revoked, e.g. after the instance got stopped
+	e.mtx.Lock()
+	e.tokens = make(map[string]bool)
+	e.mtx.Unlock()
+
+	r, err := imdsGet(srv.URL, "/latest/meta-data/public-ipv4")
+	assert.NoError(t, err)
+	assert.Equal(t, "52.1.2.3", r)
+	assert.Equal(t, 2, e.puts)
+
+	// token about to expire
+	imds.mtx.Lock()
+	tok := imds.tokens[srv.URL]
+	tok.expires = time.Now().Add(imdsTokenRefresh / 2)
+	imds.tokens[srv.URL] = tok
+	imds.mtx.Unlock()
+
+	_, err = imdsGet(srv.URL, "/latest/meta-data/public-ipv4")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, e.puts)
+
+	// tokens are masked in logs
+	assert.Equal(t, secretMask, redact("token-3"))
+
+}
+
+func TestIMDSv1Fallback(t *testing.T) {
+
+	e := newIMDSEmulator(false, false)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	envs := probeEmulator(e, srv.URL)
+	assert.Equal(t, "52.1.2.3", envs["EXT_IP0"])
+	assert.Equal(t, "i-123", envs[envInstanceID])
+	assert.Equal(t, 0, e.puts)
+
+}
+
+func TestIMDSv2Optional(t *testing.T) {
+
+	e := newIMDSEmulator(true, false)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	// tokens are used if the server issues them
+	envs := probeEmulator(e, srv.URL)
+	assert.Equal(t, "52.1.2.3", envs["EXT_IP0"])
+	assert.Equal(t, "i-123", envs[envInstanceID])
+	assert.Equal(t, 1, e.puts)
+	assert.Equal(t, 0, e.v1)
+
+	// unauthenticated requests still succeed
+	resp, err := http.Get(srv.URL + "/latest/user-data")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, e.v1)
+
+}
+
+func TestIMDSv1FallbackRetry(t *testing.T) {
+
+	e := newIMDSEmulator(true, false)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	// a v1 fallback from an earlier failure is retried if the server
+	// requires tokens now
+	imds.mtx.Lock()
+	imds.tokens[srv.URL] = imdsToken{expires: time.Now().Add(time.Hour)}
+	imds.mtx.Unlock()
+
+	e.mtx.Lock()
+	e.required = true
+	e.mtx.Unlock()
+
+	r, err := imdsGet(srv.URL, "/latest/user-data")
+	assert.NoError(t, err)
+	assert.Equal(t, "#cloud-config", r)
+	assert.Equal(t, 1, e.puts)
+
+}
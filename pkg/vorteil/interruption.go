@@ -0,0 +1,214 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+const (
+	// shutdown (default), notify to run hooks only or off
+	interruptionCmdLine = "vinitd.interruption"
+
+	interruptionShutdown = "shutdown"
+	interruptionNotify   = "notify"
+	interruptionOff      = "off"
+
+	interruptionPoll = 5 * time.Second
+
+	// time reserved after stopping the programs to unmount and flush disks
+	interruptionMargin = 5 * time.Second
+
+	// maximum hook timeout, used for notices without deadline, e.g. live
+	// migration, or far ahead, e.g. scheduled maintenance
+	interruptionHookTimeout = 30 * time.Second
+
+	// hooks get this fraction of the time until the deadline, the rest is
+	// left to stop the programs
+	interruptionHookShare = 2
+
+	envInterruptionType     = "INTERRUPTION_TYPE"
+	envInterruptionDeadline = "INTERRUPTION_DEADLINE"
+)
+
+const (
+	interruptionPreemption  = "preemption"
+	interruptionTermination = "termination"
+	interruptionMaintenance = "maintenance"
+)
+
+// shutdown deadline of an interruption, limits the stop timeouts
+var stopDeadline time.Time
+
+// interruption is an announced preemption or maintenance of the instance
+type interruption struct {
+	// preemption, termination or maintenance
+	kind string
+
+	// the instance is stopped, otherwise it is e.g. migrated or rebooted by
+	// the platform
+	shutdown bool
+
+	// the platform acts at this time, zero if unknown
+	deadline time.Time
+
+	// event id or action to tell events apart
+	id string
+}
+
+func (i *interruption) String() string {
+
+	s := fmt.Sprintf("%s %s", i.kind, i.id)
+	if !i.deadline.IsZero() {
+		s = fmt.Sprintf("%s at %s", s, i.deadline.Format(time.RFC3339))
+	}
+
+	return s
+}
+
+// interruptionWatcher is implemented by providers which announce
+// interruptions. It returns nil if there is none.
+type interruptionWatcher interface {
+	interruption() (*interruption, error)
+}
+
+// interruptionMode returns the action on interruption notices from the
+// kernel command line
+func interruptionMode() string {
+
+	s, ok := cmdLineValue(interruptionCmdLine)
+	if !ok {
+		return interruptionShutdown
+	}
+
+	switch s {
+	case interruptionShutdown, interruptionNotify, interruptionOff:
+		return s
+	}
+
+	logError("unknown %s '%s', using %s", interruptionCmdLine, s, interruptionShutdown)
+	return interruptionShutdown
+}
+
+// hookTimeout returns the time the preempt hooks may take
+func (i *interruption) hookTimeout() time.Duration {
+
+	timeout := interruptionHookTimeout
+	if i.deadline.IsZero() {
+		return timeout
+	}
+
+	share := (time.Until(i.deadline) - interruptionMargin) / interruptionHookShare
+	if share < timeout {
+		timeout = share
+	}
+
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+
+	return timeout
+}
+
+// notifyInterruption runs the preempt hook of the program
+func (p *program) notifyInterruption(i *interruption, timeout time.Duration) {
+
+	if len(p.opts.preemptHook) == 0 || !p.running() {
+		return
+	}
+
+	env := append([]string{}, p.env...)
+	env = append(env, fmt.Sprintf(environString, envInterruptionType, i.kind))
+	if !i.deadline.IsZero() {
+		env = append(env, fmt.Sprintf(environString, envInterruptionDeadline, i.deadline.Format(time.RFC3339)))
+	}
+
+	p.runHook("preempt", p.opts.preemptHook, env, timeout)
+}
+
+// handleInterruption runs the hooks of all programs and shuts the instance
+// down if it gets stopped by the platform
+func (v *Vinitd) handleInterruption(i *interruption, mode string) {
+
+	logAlways("instance interruption announced: %s", i)
+
+	timeout := i.hookTimeout()
+
+	done := make(chan struct{})
+	for _, p := range v.programs {
+		go func(p *program) {
+			p.notifyInterruption(i, timeout)
+			done <- struct{}{}
+		}(p)
+	}
+
+	for range v.programs {
+		<-done
+	}
+
+	if !i.shutdown || mode != interruptionShutdown {
+		return
+	}
+
+	if !i.deadline.IsZero() {
+		stopDeadline = i.deadline.Add(-interruptionMargin)
+	}
+
+	shutdown(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+}
+
+// watchInterruptions polls the provider for interruption notices. A notice
+// is handled once while it is pending. Hooks run in the background so
+// later notices are not missed.
+func (v *Vinitd) watchInterruptions(w interruptionWatcher, mode string) {
+
+	var pending string
+
+	for {
+
+		time.Sleep(interruptionPoll)
+
+		i, err := w.interruption()
+		if err != nil {
+			logDebug("error requesting interruption notice: %s", err.Error())
+			continue
+		}
+
+		if i == nil {
+			pending = ""
+			continue
+		}
+
+		if pending == i.kind+i.id {
+			continue
+		}
+		pending = i.kind + i.id
+
+		go v.handleInterruption(i, mode)
+	}
+}
+
+// startInterruptionWatcher watches for preemption and maintenance notices
+// of the cloud provider
+func (v *Vinitd) startInterruptionWatcher() {
+
+	w, ok := v.hypervisorInfo.provider.(interruptionWatcher)
+	if !ok {
+		return
+	}
+
+	mode := interruptionMode()
+	if mode == interruptionOff {
+		logDebug("interruption notices disabled")
+		return
+	}
+
+	logDebug("watching for interruption notices, mode %s", mode)
+
+	go v.watchInterruptions(w, mode)
+}
@@ -0,0 +1,147 @@
+package vorteil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEC2Interruption(t *testing.T) {
+
+	paths := map[string]string{
+		"/latest/meta-data/events/maintenance/scheduled": `[{"Code": "system-reboot", "EventId": "instance-event-1",
+			"NotBefore": "21 Jan 2030 09:00:43 GMT", "State": "active"}]`,
+	}
+	srv := metadataStub(t, "Metadata", "true", paths)
+	defer srv.Close()
+
+	p := newEC2Provider(srv.URL)
+
+	i, err := p.interruption()
+	assert.NoError(t, err)
+	assert.Equal(t, interruptionMaintenance, i.kind)
+	assert.False(t, i.shutdown)
+	assert.Equal(t, "system-reboot instance-event-1", i.id)
+	assert.Equal(t, time.Date(2030, 1, 21, 9, 0, 43, 0, time.UTC), i.deadline.UTC())
+
+	paths["/latest/meta-data/spot/instance-action"] = `{"action": "terminate", "time": "2030-01-21T08:22:00Z"}`
+
+	i, err = p.interruption()
+	assert.NoError(t, err)
+	assert.Equal(t, interruptionPreemption, i.kind)
+	assert.True(t, i.shutdown)
+	assert.Equal(t, time.Date(2030, 1, 21, 8, 22, 0, 0, time.UTC), i.deadline)
+
+	paths["/latest/meta-data/spot/instance-action"] = `{"action": "hibernate", "time": "2030-01-21T08:22:00Z"}`
+
+	i, err = p.interruption()
+	assert.NoError(t, err)
+	assert.False(t, i.shutdown)
+
+	delete(paths, "/latest/meta-data/spot/instance-action")
+	paths["/latest/meta-data/events/maintenance/scheduled"] = "[]"
+
+	i, err = p.interruption()
+	assert.NoError(t, err)
+	assert.Nil(t, i)
+
+}
+
+func TestGCPInterruption(t *testing.T) {
+
+	paths := map[string]string{
+		"/computeMetadata/v1/instance/preempted":         "FALSE",
+		"/computeMetadata/v1/instance/maintenance-event": "NONE",
+	}
+	srv := metadataStub(t, "Metadata-Flavor", "Google", paths)
+	defer srv.Close()
+
+	p := newGCPProvider(srv.URL)
+
+	i, err := p.interruption()
+	assert.NoError(t, err)
+	assert.Nil(t, i)
+
+	paths["/computeMetadata/v1/instance/maintenance-event"] = "MIGRATE_ON_HOST_MAINTENANCE"
+	i, err = p.interruption()
+	assert.NoError(t, err)
+	assert.Equal(t, interruptionMaintenance, i.kind)
+	assert.False(t, i.shutdown)
+
+	paths["/computeMetadata/v1/instance/preempted"] = "TRUE"
+	i, err = p.interruption()
+	assert.NoError(t, err)
+	assert.Equal(t, interruptionPreemption, i.kind)
+	assert.True(t, i.shutdown)
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), i.deadline, time.Second)
+
+}
+
+func TestAzureInterruption(t *testing.T) {
+
+	paths := map[string]string{
+		"/metadata/instance/compute/name?api-version=2019-02-01&format=text": "vm1",
+		"/metadata/scheduledevents?api-version=2020-07-01&format=json": `{"DocumentIncarnation": 2, "Events": [
+			{"EventId": "1", "EventType": "Reboot", "Resources": ["vm2"], "EventStatus": "Scheduled",
+			 "NotBefore": "Mon, 19 Sep 2030 18:29:47 GMT"},
+			{"EventId": "2", "EventType": "Preempt", "Resources": ["vm1"], "EventStatus": "Scheduled",
+			 "NotBefore": "Mon, 19 Sep 2030 18:29:47 GMT"}]}`,
+	}
+	srv := metadataStub(t, "Metadata", "True", paths)
+	defer srv.Close()
+
+	i, err := newAzureProvider(srv.URL, "").interruption()
+	assert.NoError(t, err)
+	assert.Equal(t, interruptionPreemption, i.kind)
+	assert.Equal(t, "Preempt 2", i.id)
+	assert.True(t, i.shutdown)
+	assert.Equal(t, time.Date(2030, 9, 19, 18, 29, 47, 0, time.UTC), i.deadline.UTC())
+
+}
+
+func TestStopDeadline(t *testing.T) {
+
+	defer func(d time.Duration) {
+		terminateWait = d
+		stopDeadline = time.Time{}
+		terminateDeadline = time.Time{}
+	}(terminateWait)
+
+	terminateWait = time.Minute
+
+	p := &program{opts: programOptions{stopTimeout: 2 * time.Minute}}
+	assert.Equal(t, 2*time.Minute, p.stopTimeout())
+
+	stopDeadline = time.Now().Add(30 * time.Second)
+	assert.InDelta(t, float64(30*time.Second), float64(p.stopTimeout()), float64(time.Second))
+
+	// the program gets at least the signal
+	stopDeadline = time.Now().Add(-time.Minute)
+	assert.Equal(t, time.Second, p.stopTimeout())
+
+	// later rounds get what is left of the shutdown
+	stopDeadline = time.Time{}
+	assert.Equal(t, 2*time.Minute, stopBudget([]*program{p, {}}))
+	terminateDeadline = time.Now().Add(45 * time.Second)
+	assert.InDelta(t, float64(45*time.Second), float64(p.stopTimeout()), float64(time.Second))
+
+}
+
+func TestInterruptionHookTimeout(t *testing.T) {
+
+	i := &interruption{kind: interruptionMaintenance}
+	assert.Equal(t, interruptionHookTimeout, i.hookTimeout())
+
+	// maintenance days ahead does not keep hooks running
+	i.deadline = time.Now().Add(72 * time.Hour)
+	assert.Equal(t, interruptionHookTimeout, i.hookTimeout())
+
+	// half of the window is left to stop the programs
+	i.deadline = time.Now().Add(25 * time.Second)
+	assert.InDelta(t, float64(10*time.Second), float64(i.hookTimeout()), float64(time.Second))
+
+	i.deadline = time.Now()
+	assert.Equal(t, time.Second, i.hookTimeout())
+
+}
@@ -0,0 +1,290 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// number of output files kept per job
+	jobKeepLogs = 10
+
+	jobLastLog = "last.log"
+
+	// time between terminate signal and SIGKILL for jobs
+	jobKillDelay = 5 * time.Second
+)
+
+// job is a program started by vinitd on a schedule
+type job struct {
+	p    *program
+	user string
+
+	mtx     sync.Mutex
+	runs    map[*exec.Cmd]bool
+	stopped bool
+}
+
+var (
+	jobs    []*job
+	jobsMtx sync.Mutex
+)
+
+func (p *program) isJob() bool {
+	return p.opts.progType == programJob
+}
+
+func (v *Vinitd) startJob(p *program) {
+
+	j := &job{
+		p:    p,
+		user: v.user,
+		runs: make(map[*exec.Cmd]bool),
+	}
+
+	jobsMtx.Lock()
+	jobs = append(jobs, j)
+	jobsMtx.Unlock()
+
+	go j.schedule()
+}
+
+func (j *job) isStopped() bool {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.stopped
+}
+
+func (j *job) schedule() {
+
+	for {
+
+		now := time.Now()
+		n := j.p.opts.schedule.next(now)
+		if n.IsZero() {
+			logError("job[%d] has no next activation", j.p.progIndex)
+			return
+		}
+
+		logDebug("job[%d] next run at %v", j.p.progIndex, n)
+		time.Sleep(n.Sub(now))
+
+		if j.isStopped() {
+			return
+		}
+
+		j.trigger()
+	}
+
+}
+
+// trigger applies the overlap policy and starts a new run
+func (j *job) trigger() {
+
+	j.mtx.Lock()
+
+	if len(j.runs) > 0 {
+		switch j.p.opts.overlap {
+		case overlapAllow:
+		case overlapReplace:
+			logWarn("job[%d] still running, replacing it", j.p.progIndex)
+			for cmd := range j.runs {
+				cmd.Process.Signal(syscall.SIGKILL)
+			}
+		default:
+			j.mtx.Unlock()
+			logWarn("job[%d] still running, skipping run", j.p.progIndex)
+			return
+		}
+	}
+
+	j.mtx.Unlock()
+
+	go func() {
+		err := j.run()
+		if err != nil {
+			logError("job[%d] failed: %s", j.p.progIndex, err.Error())
+		}
+	}()
+
+}
+
+// output creates the output file for a run and removes old ones
+func (j *job) output() (*os.File, error) {
+
+	dir, err := runDir("jobs", strconv.Itoa(j.p.progIndex))
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s.log", time.Now().Format("20060102-150405.000"))
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	last := filepath.Join(dir, jobLastLog)
+	os.Remove(last)
+	os.Symlink(name, last)
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return f, nil
+	}
+
+	var logs []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".log") {
+			logs = append(logs, fi.Name())
+		}
+	}
+
+	sort.Strings(logs)
+	for len(logs) > jobKeepLogs {
+		os.Remove(filepath.Join(dir, logs[0]))
+		logs = logs[1:]
+	}
+
+	return f, nil
+}
+
+func (j *job) terminateSignal() syscall.Signal {
+
+	sig, err := j.p.vcfgProg.Terminate.Signal()
+	if err != nil {
+		return syscall.SIGTERM
+	}
+
+	return sig
+}
+
+// kill sends the terminate signal and SIGKILL after jobKillDelay
+func (j *job) kill(cmd *exec.Cmd, done chan struct{}) {
+
+	cmd.Process.Signal(j.terminateSignal())
+
+	select {
+	case <-done:
+	case <-time.After(jobKillDelay):
+		cmd.Process.Signal(syscall.SIGKILL)
+	}
+
+}
+
+func (j *job) run() error {
+
+	out, err := j.output()
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cmd := j.p.command(j.user)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	j.mtx.Lock()
+	if j.stopped {
+		j.mtx.Unlock()
+		return nil
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		j.mtx.Unlock()
+		return err
+	}
+
+	j.runs[cmd] = true
+	j.mtx.Unlock()
+
+	accounting.registerProgram(cmd.Process.Pid, j.p)
+
+	logDebug("job[%d] started as pid %d", j.p.progIndex, cmd.Process.Pid)
+
+	start := time.Now()
+	done := make(chan struct{})
+
+	if j.p.opts.timeout > 0 {
+		go func() {
+			select {
+			case <-done:
+			case <-time.After(j.p.opts.timeout):
+				logWarn("job[%d] timed out after %v", j.p.progIndex, j.p.opts.timeout)
+				j.kill(cmd, done)
+			}
+		}()
+	}
+
+	cmd.Wait()
+	close(done)
+
+	j.mtx.Lock()
+	delete(j.runs, cmd)
+	j.mtx.Unlock()
+
+	logAlways("job[%d] finished with exit code %d after %v, output in %s", j.p.progIndex,
+		cmdExitCode(cmd), time.Since(start).Round(time.Millisecond), out.Name())
+
+	return nil
+}
+
+// stop prevents new runs and terminates running ones
+func (j *job) stop(timeout time.Duration) {
+
+	j.mtx.Lock()
+	j.stopped = true
+
+	for cmd := range j.runs {
+		logAlways("job[%d] pid[%d] - sending signal '%s'", j.p.progIndex, cmd.Process.Pid, j.terminateSignal())
+		cmd.Process.Signal(j.terminateSignal())
+	}
+	j.mtx.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		j.mtx.Lock()
+		n := len(j.runs)
+		if n == 0 || time.Now().After(deadline) {
+			for cmd := range j.runs {
+				cmd.Process.Signal(syscall.SIGKILL)
+			}
+			j.mtx.Unlock()
+			return
+		}
+		j.mtx.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+}
+
+func stopJobs() {
+
+	jobsMtx.Lock()
+	defer jobsMtx.Unlock()
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			j.stop(j.p.stopTimeout())
+		}(j)
+	}
+
+	wg.Wait()
+}
@@ -8,22 +8,15 @@ package vorteil
 import (
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
-	"time"
 
-	reap "github.com/hashicorp/go-reap"
 	"github.com/mattn/go-shellwords"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"golang.org/x/sys/unix"
@@ -120,19 +113,21 @@ func (p *program) waitForApp(cmd *exec.Cmd) {
 	handleExit(p.vinitd.programs)
 }
 
-func (p *program) launch(systemUser string) error {
+// command creates the command for the program with its environment, working
+// directory and privileges. It can be called multiple times, e.g. for jobs.
+func (p *program) command(systemUser string) *exec.Cmd {
 
 	fixDefaults(&p.vcfgProg)
 
+	path, pArgs := p.path, p.args
+
 	// strace override
 	if p.vcfgProg.Strace {
-		p.args = append(p.args, "")
-		copy(p.args[1:], p.args)
-		p.args[0] = p.path
-		p.path = "/vorteil/strace"
+		pArgs = append([]string{path}, pArgs...)
+		path = "/vorteil/strace"
 	}
 
-	cmd := exec.Command(p.path, p.args...)
+	cmd := exec.Command(path, pArgs...)
 	cmd.Env = p.env
 	cmd.Dir = p.vcfgProg.Cwd
 
@@ -175,6 +170,12 @@ func (p *program) launch(systemUser string) error {
 
 	logDebug("starting as %s, uid %d", user, rid)
 
+	return cmd
+}
+
+// output sets stdout and stderr of the command as configured in the VCFG
+func (p *program) output(cmd *exec.Cmd) error {
+
 	// Create stderr dir if it does not exists
 	if _, err := os.Stat(filepath.Dir(p.vcfgProg.Stderr)); os.IsNotExist(err) {
 		os.MkdirAll(filepath.Dir(p.vcfgProg.Stderr), 0)
@@ -198,309 +199,30 @@ func (p *program) launch(systemUser string) error {
 	cmd.Stderr = stderr
 	cmd.Stdout = stdout
 
-	p.cmd = cmd
-
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
-
-	go p.waitForApp(cmd)
-
-	logDebug("started %s as pid %d", p.path, cmd.Process.Pid)
-
 	return nil
 }
 
-// bootstrapWaitForFile hangs process until the file appears
-// warns every 30 seconds.
-func bootstrapWaitForFile(args []string, p *program) {
-
-	args = args[1:]
-	// check length of args to see atleast one path
-	if len(args) != 1 {
-		logError("bootstrap 'WAIT_FILE' needs one value")
-		return
-	}
-
-	// loop through and stat the path to see when it exists
-	count := 0
-	for {
-		if _, err := os.Stat(args[0]); err == nil {
-			break
-		}
-		// check count log a warning saying file hasn't appeared in 30 seconds repeat action
-		if count%30 == 0 && count > 0 {
-			logWarn("bootstrap 'WAIT_FILE' file %s has not appeared yet", args[0])
-		}
-		count++
-		time.Sleep(time.Second * 1)
-	}
-
-}
-
-// bootstrapGet executes a get request and saves the file
-func bootstrapGetRequest(args []string, p *program) {
-
-	if len(args) < 3 {
-		logError("bootstrap 'WAIT_GET' needs at least one url and one target file")
-		return
-	}
-
-	logDebug("get request: %s", args[1])
-
-	_, err := url.ParseRequestURI(args[1])
-	if err != nil {
-		logAlways("can not parse url: %s", err)
-		return
-	}
-
-	resp, err := http.Get(args[1])
-	if err != nil {
-		logAlways("can not get url: %s", err)
-		return
-	}
-
-	defer resp.Body.Close()
-
-	err = os.MkdirAll(filepath.Dir(args[2]), 0755)
-	if err != nil {
-		logAlways("can not create dir %s: %s", filepath.Dir(args[2]), err)
-		return
-	}
-
-	out, err := os.Create(args[2])
-	if err != nil {
-		logAlways("can not create file %s: %s", args[2], err)
-		return
-	}
-	defer out.Close()
-	io.Copy(out, resp.Body)
-
-	logDebug("got %s to %s", args[1], args[2])
-}
-
-// bootstrapWaitForPort hands process until the ports appear for certain network types, timesout after 30 seconds
-func bootstrapWaitForPort(args []string, p *program) {
-
-	var (
-		ifce *net.Interface
-		err  error
-		ief  string
-	)
-
-	args = args[1:]
-
-	// b.args[0] should be ifce, b.args[1:] should be all network
-	if len(args) < 2 {
-		logError("bootstrap 'WAIT_PORT' needs at least one value to listen out for")
-		return
-	}
-
-	idx := 0
-	ief = "eth0"
-
-	// interface to look on should always exist if they provide it if not its default eth0
-	if strings.Contains(args[0], "if=") {
-		ief = strings.Split(args[0], "=")[1]
-		idx = 1
-	}
-
-	ifce, err = net.InterfaceByName(ief)
-
-	if err != nil {
-		logError("bootstrap 'WAIT_PORT' unable to fetch interface %s: %s", ief, err)
-		return
-	}
-
-	// addresses for the said interface
-	addrs, err := ifce.Addrs()
-	if err != nil {
-		logError("bootstrap 'WAIT_PORT' unable to read addresses for %s: %s", ifce, err)
-		return
-	}
-
-	var (
-		ip     string
-		isIpv4 bool
-	)
-	// loop through addresses to find ipv4 address for interface
-	for _, addr := range addrs {
-		// get ip object of the address and check if ipv4
-		ip, isIpv4 = checkIfIPV4(addr.String())
-		if isIpv4 {
-			break
-		}
-	}
-
-	var wg sync.WaitGroup
-	// Loop through ports and attempt connections
-	for _, arg := range strings.Split(strings.TrimSpace(strings.Join(args[idx:], " ")), " ") {
-		// listen for ports to be alive
-		wg.Add(1)
-		// go routine it to test all ports currently asked for
-		// simple check for numbers
-		_, err := strconv.Atoi(arg)
-		if err != nil {
-			logError("The value '%s' does not seem to be a port number", arg)
-		}
-
-		go listenForPort(fmt.Sprintf("%s:%s", ip, arg), &wg)
-	}
-	// wait till group resolves
-	wg.Wait()
-}
-
-// listenForPort listens for port in a loop returns nothing but resolves wait group when function successfully dials port
-func listenForPort(addrToCheck string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	count := 0
-	for {
-		// attempt connection
-		conn, err := net.Dial("tcp", addrToCheck)
-		if err == nil {
-			conn.Close()
-			break
-		}
-		// log if port is not up every 30 seconds
-		if count%30 == 0 {
-			logWarn("bootstrap 'WAIT_PORT' tcp connection to '%s' has not come online", addrToCheck)
-		}
-		count++
-		time.Sleep(time.Second * 1)
-	}
-}
-
-// checkIfIPV4 returns converted addr to IP and true or false if it is ipv4
-func checkIfIPV4(addr string) (string, bool) {
-	ip, _, err := net.ParseCIDR(addr)
-	if err != nil {
-		logError("bootstrap 'WAIT_PORT' unable to ParseCIDR of address: %s", err)
-	}
-	return ip.String(), strings.Count(ip.String(), ":") < 2
-}
-
-func bootstrapNotdefined(args []string, p *program) string {
-
-	args = args[1:]
-
-	// if this is not a pair, we ignore
-	if len(args) != 2 {
-		logError("bootstrap 'DEFINE_IF_NOT_DEFINED' needs two values")
-		return ""
-	}
-
-	// check if it has been set
-	for _, val := range p.env {
-		if strings.HasPrefix(val, fmt.Sprintf("%s=", args[0])) {
-			return ""
-		}
-	}
-
-	for k, val := range p.vinitd.hypervisorInfo.envs {
-		logDebug("replacing %s with %s", fmt.Sprintf(replaceString, k), val)
-		args[1] = strings.ReplaceAll(args[1], fmt.Sprintf(replaceString, k), val)
-	}
-
-	return fmt.Sprintf(environString, args[0], args[1])
-
-}
-
-// func bootstrapReplace(b *bootstrapInstruction) {
-func bootstrapReplace(args []string, p *program) {
-
-	args = args[1:]
-
-	if len(args) != 3 {
-		logError("bootstrap 'FIND_AND_REPLACE' needs two values")
-		return
-	}
+func (p *program) launch(systemUser string) error {
 
-	m := make(map[string]string)
-	for _, a := range args {
-		aa := strings.SplitN(a, "=", 2)
-		m[aa[0]] = aa[1]
-	}
+	cmd := p.command(systemUser)
 
-	txt, err := ioutil.ReadFile(m["file"])
+	err := p.output(cmd)
 	if err != nil {
-		logWarn("file %s does does not exist to replace text", m["file"])
-		return
+		return err
 	}
 
-	// check if it has been set
-	for _, val := range p.env {
-		s := strings.SplitN(val, "=", 2)
-		m["replace"] = strings.ReplaceAll(m["replace"], fmt.Sprintf(replaceString, s[0]), s[1])
-	}
+	p.cmd = cmd
 
-	content := strings.Replace(string(txt), m["find"], m["replace"], -1)
-	err = ioutil.WriteFile(m["file"], []byte(content), 0)
+	err = cmd.Start()
 	if err != nil {
-		return
+		return err
 	}
 
-}
-
-func (p *program) bootstrap() error {
-
-	for _, b := range p.vcfgProg.Bootstrap {
+	accounting.registerProgram(cmd.Process.Pid, p)
 
-		bs := strings.Split(b, " ")
-
-		if len(bs) == 0 {
-			logError("can not parse bootstrap %s", bs)
-			continue
-		}
-
-		switch bs[0] {
-		case bootstrapSleep:
-			{
-				s, err := strconv.Atoi(bs[1])
-				if err != nil {
-					logError("can not parse sleep bootstrap %s", bs)
-					continue
-				}
-				time.Sleep(time.Duration(s) * time.Millisecond)
-			}
-		case bootstrapWaitFile:
-			{
-				bootstrapWaitForFile(bs, p)
-				break
-			}
-		case bootstrapWaitPort:
-			{
-				bootstrapWaitForPort(bs, p)
-				break
-			}
-		case bootstrapGet:
-			{
-				bootstrapGetRequest(bs, p)
-				break
-			}
-		case bootstrapFandR:
-			{
-				bootstrapReplace(bs, p)
-			}
-		case bootstrapDefine:
-			{
-				s := bootstrapNotdefined(bs, p)
-				logDebug("bootstrap not definded: %s", s)
-				if len(s) > 0 {
-					p.env = append(p.env, s)
-				}
+	go p.waitForApp(cmd)
 
-				// we need to repace it if required
-				if len(p.args) > 1 {
-					p.args = args(p.args[1:], p.env)
-				}
-			}
-		default:
-			{
-				logError("unknown bootstrap command: %s", bs[0])
-			}
-		}
-	}
+	logDebug("started %s as pid %d", p.path, cmd.Process.Pid)
 
 	return nil
 }
@@ -529,47 +251,60 @@ func args(progArgs []string, envs []string) []string {
 
 }
 
-func envs(progValues []string, hyperVisorEnvs map[string]string) []string {
+// envs merges cloud values, loaded variables and the VCFG environment in
+// this order. Later values override earlier ones and can refer to them.
+func envs(progValues []string, hyperVisorEnvs map[string]string, loaded []envEntry) []string {
 
-	var newEnvs, output []string
-	var envs map[string]string
-
-	envs = make(map[string]string)
+	var entries []envEntry
 
 	for k, val := range hyperVisorEnvs {
-		newEnvs = append(newEnvs, fmt.Sprintf(environString, k, val))
+		entries = append(entries, envEntry{key: k, value: val, shell: true})
 	}
 
+	entries = append(entries, loaded...)
+
 	for _, e := range progValues {
-		newEnvs = append(newEnvs, e)
+		strs := strings.SplitN(e, "=", 2)
+		if len(strs) == 2 {
+			entries = append(entries, envEntry{key: strs[0], value: strs[1], shell: true})
+		}
 	}
 
 	parser := shellwords.NewParser()
-	parser.ParseEnv = true
+	parser.ParseEnv = false
 	parser.ParseBacktick = false
 
-	parser.Getenv = func(key string) string {
-		v, _ := envs[key]
-		return v
+	envs := make(map[string]string)
+	lookup := func(key string) (string, bool) {
+		v, ok := envs[key]
+		return v, ok
 	}
 
-	for i := 0; i < len(newEnvs); i++ {
-		s := newEnvs[i]
-		strs := strings.SplitN(s, "=", 2)
-		if len(strs) == 2 {
-			var k, v string
-			k = strs[0]
-			if len(strs) > 1 {
-				v = strs[1]
-			}
+	var keys []string
+	for _, e := range entries {
 
+		v := e.value
+		if !e.literal {
+			v = expandEnv(v, lookup, e.shell)
+		}
+
+		if e.shell {
 			strs, _ := parser.Parse(v)
-			if len(strs) > 0 {
-				v = strings.Join(strs, " ")
-				envs[k] = v
-				output = append(output, fmt.Sprintf(environString, k, v))
+			if len(strs) == 0 {
+				continue
 			}
+			v = strings.Join(strs, " ")
 		}
+
+		if _, ok := envs[e.key]; !ok {
+			keys = append(keys, e.key)
+		}
+		envs[e.key] = v
+	}
+
+	var output []string
+	for _, k := range keys {
+		output = append(output, fmt.Sprintf(environString, k, envs[k]))
 	}
 
 	return output
@@ -578,9 +313,16 @@ func envs(progValues []string, hyperVisorEnvs map[string]string) []string {
 
 func (v *Vinitd) prepProgram(p vcfg.Program, pIndex int) error {
 
+	opts, env, err := parseProgramOptions(p.Env)
+	if err != nil {
+		return fmt.Errorf("program %d: %v", pIndex, err)
+	}
+	p.Env = env
+
 	// we can add the program to the list now
 	np := &program{
 		vcfgProg:    p,
+		opts:        opts,
 		cmd:         nil,
 		vinitd:      v,
 		exitChannel: make(chan interface{}),
@@ -597,7 +339,18 @@ func (v *Vinitd) launchProgram(np *program) error {
 	p := np.vcfgProg
 
 	// get envs and substitute with cloud args
-	pEnvs := envs(p.Env, v.hypervisorInfo.envs)
+	loaded, err := v.loadEnv(np.opts)
+	if err != nil {
+		return err
+	}
+
+	pEnvs := envs(p.Env, v.hypervisorInfo.envs, loaded)
+
+	// secret:// values are resolved at launch time only
+	pEnvs, err = v.resolveSecrets(pEnvs)
+	if err != nil {
+		return err
+	}
 	np.env = pEnvs
 
 	// replace args cloud args as well plus existing envs
@@ -617,10 +370,25 @@ func (v *Vinitd) launchProgram(np *program) error {
 	logDebug("launching %s", np.path)
 
 	// run bootstrap functions
-	np.bootstrap()
+	err = np.bootstrap()
+	if err != nil {
+		return err
+	}
 
-	logDebug("launch args %v", np.args)
-	logDebug("launch envs %v", np.env)
+	logDebug("launch args %v", redactArgs(np.args, np.env))
+	logDebug("launch envs %v", redactEnv(np.env))
+
+	if np.isJob() {
+		if _, err := os.Stat(np.path); err != nil {
+			return fmt.Errorf("%s application missing", np.path)
+		}
+		v.startJob(np)
+		return nil
+	}
+
+	if np.isOneshot() {
+		return np.runOneshot(v.user)
+	}
 
 	err = np.launch(v.user)
 	if err != nil {
@@ -652,12 +420,56 @@ func (v *Vinitd) launchProgram(np *program) error {
 	return nil
 }
 
+// reapPending collects all exited children and records their status, it
+// might collect a process before exec's Wait
+func reapPending(pids chan<- int) error {
+
+	for {
+
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+
+		switch err {
+		case nil:
+		case syscall.EINTR:
+			continue
+		case syscall.ECHILD:
+			return nil
+		default:
+			return err
+		}
+
+		if pid <= 0 {
+			return nil
+		}
+
+		recordExitStatus(pid, ws)
+
+		if pids != nil {
+			pids <- pid
+		}
+	}
+}
+
+// reapChildren reaps children on SIGCHLD
+func reapChildren(pids chan<- int, errors chan<- error) {
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, unix.SIGCHLD)
+
+	for range c {
+		if err := reapPending(pids); err != nil {
+			errors <- err
+		}
+	}
+}
+
 func reapProcs(programs []*program) {
 
-	pids := make(reap.PidCh, 1)
-	errors := make(reap.ErrorCh, 1)
+	pids := make(chan int, 1)
+	errors := make(chan error, 1)
 
-	go reap.ReapChildren(pids, errors, nil, nil)
+	go reapChildren(pids, errors)
 
 	for {
 		select {
@@ -683,7 +495,6 @@ func reapProcs(programs []*program) {
 func (v *Vinitd) Launch() error {
 
 	var wg sync.WaitGroup
-	wg.Add(len(v.vcfg.Programs))
 
 	logDebug("starting %d programs", len(v.vcfg.Programs))
 
@@ -692,12 +503,37 @@ func (v *Vinitd) Launch() error {
 
 	go reapProcs(v.programs)
 
-	go listenToProcesses(v.programs)
+	// one-shot programs run to completion in order before all others
+	for _, p := range v.programs {
+
+		if !p.isOneshot() {
+			continue
+		}
+
+		err := handleFailure(p.oneshotFailure(), func() error {
+			err := v.launchProgram(p)
+			p.failed = err != nil
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+	}
 
 	for _, p := range v.programs {
 
+		if p.isOneshot() {
+			continue
+		}
+
+		wg.Add(1)
 		go func(p *program) {
-			err := v.launchProgram(p)
+			err := handleFailure(failureProgram, func() error {
+				err := v.launchProgram(p)
+				p.failed = err != nil
+				return err
+			})
 			if err != nil {
 				errors <- err
 			}
@@ -721,5 +557,13 @@ func (v *Vinitd) Launch() error {
 	logDebug("all apps started")
 	initStatus = statusLaunched
 
+	// values can change from here on, programs are started with the values
+	// fetched during setup
+	v.startMetadataWatcher()
+	v.startInterruptionWatcher()
+
+	// programs might have finished or failed during launch already
+	handleExit(v.programs)
+
 	return nil
 }
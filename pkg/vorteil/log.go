@@ -11,6 +11,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/sirupsen/logrus"
@@ -18,18 +19,50 @@ import (
 	"github.com/vorteil/vorteil/pkg/vcfg"
 )
 
+const (
+	// size of the console history kept for the debug shell
+	logHistorySize = 16384
+)
+
 var (
 	logger *logrus.Logger
+
+	logHistory = &logRing{size: logHistorySize}
 )
 
+// logRing keeps the last bytes written to the console
+type logRing struct {
+	mtx  sync.Mutex
+	buf  []byte
+	size int
+}
+
+func (l *logRing) Write(b []byte) (int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.buf = append(l.buf, b...)
+	if len(l.buf) > l.size {
+		l.buf = append([]byte(nil), l.buf[len(l.buf)-l.size:]...)
+	}
+
+	return len(b), nil
+}
+
+func (l *logRing) Bytes() []byte {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return append([]byte(nil), l.buf...)
+}
+
 func logAlways(format string, values ...interface{}) {
-	txt := fmt.Sprintf(format, values...)
+	txt := redact(fmt.Sprintf(format, values...))
 	up := fmt.Sprintf("[%05.6f]", uptime())
 	fmt.Fprintf(os.Stdout, "%s %s\n", up, txt)
 }
 
 func logDebug(format string, values ...interface{}) {
-	logger.Debugf(fmt.Sprintf(format+"\n", values...))
+	logger.Debugf(redact(fmt.Sprintf(format+"\n", values...)))
 }
 
 // LogDebugEarly creates an early debug logging function before logging is configured.
@@ -51,17 +84,21 @@ func LogDebugEarly(format string, values ...interface{}) {
 }
 
 func logWarn(format string, values ...interface{}) {
-	logger.Warnf(fmt.Sprintf(format+"\n", values...))
+	logger.Warnf(redact(fmt.Sprintf(format+"\n", values...)))
 }
 
-// SystemPanic prints error message and shuts down the system
+// SystemPanic prints error message and shuts down the system. In debug mode
+// it opens a shell on the console first and powers off after it exits.
 func SystemPanic(format string, values ...interface{}) {
-	logger.Errorf(fmt.Sprintf(format, values...))
+	msg := redact(fmt.Sprintf(format, values...))
+	logger.Errorf(msg)
+	reportBootFailure(msg)
+	debugShell()
 	shutdown(syscall.LINUX_REBOOT_CMD_POWER_OFF)
 }
 
 func logError(format string, values ...interface{}) {
-	logger.Errorf(fmt.Sprintf(format+"\n", values...))
+	logger.Errorf(redact(fmt.Sprintf(format+"\n", values...)))
 }
 
 func printVersion() error {
@@ -249,6 +286,8 @@ func (v *Vinitd) checkLogs() {
 				logError("epoll error: %v", err)
 			}
 
+			logHistory.Write(b1[:r])
+
 			for _, t := range ts {
 				if t != nil {
 					t.Write(b1[:r])
@@ -273,6 +273,9 @@ func (v *Vinitd) startLogging() {
 	err = cmd.Start()
 	if err != nil {
 		logError("%s", err.Error())
+		return
 	}
 
+	accounting.registerService(cmd.Process.Pid, serviceFluentBit)
+
 }
@@ -0,0 +1,452 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// refresh interval of the metadata, off disables the watcher
+	metadataRefreshCmdLine = "vinitd.metadata.refresh"
+
+	metadataRefreshDefault = 5 * time.Minute
+
+	// wait before the next attempt if the metadata server is not available
+	metadataRetry = 30 * time.Second
+
+	metadataHookTimeout = 30 * time.Second
+
+	// dotenv file with the environment variables of the instance
+	metadataEnvFile = "metadata.env"
+
+	// directory with one file per value, a symlink to the current version
+	metadataTreeDir = "metadata"
+
+	metadataSummaryFile = "metadata.json"
+
+	// comma separated list of changed variables for metadata hooks
+	envMetadataChanged = "METADATA_CHANGED"
+)
+
+// metadataWatcher refreshes the metadata of the cloud provider and notifies
+// programs about changed values
+type metadataWatcher struct {
+	v        *Vinitd
+	p        CloudProvider
+	interval time.Duration
+}
+
+// metadataRefresh returns the refresh interval from the kernel command
+// line. Zero disables refreshing.
+func metadataRefresh() time.Duration {
+
+	s, ok := cmdLineValue(metadataRefreshCmdLine)
+	if !ok {
+		return metadataRefreshDefault
+	}
+
+	if s == "off" {
+		return 0
+	}
+
+	d, err := parseDuration(s)
+	if err != nil || d < 0 {
+		logError("can not parse %s: %s, using %s", metadataRefreshCmdLine, s, metadataRefreshDefault)
+		return metadataRefreshDefault
+	}
+
+	return d
+}
+
+// dotenvValue quotes a value so parseDotenv returns it unchanged
+func dotenvValue(s string) string {
+
+	if !strings.ContainsAny(s, "'\n") {
+		return fmt.Sprintf("'%s'", s)
+	}
+
+	return fmt.Sprintf("\"%s\"", strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s))
+}
+
+// writeMetadataEnv writes the environment variables of the instance to
+// /run/vorteil/metadata.env. The file is replaced atomically and readable by
+// the program user only.
+func writeMetadataEnv(envs map[string]string, user string) error {
+
+	dir, err := runDir()
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for k := range envs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var str strings.Builder
+	for _, k := range keys {
+		str.WriteString(fmt.Sprintf(environString, k, dotenvValue(envs[k])))
+		str.WriteString("\n")
+	}
+
+	tmp, err := ioutil.TempFile(dir, metadataEnvFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(str.String())
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if uid, gid, err := lookupOwner(user); err == nil {
+		os.Chown(tmp.Name(), uid, gid)
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, metadataEnvFile))
+}
+
+// metadataInterface is a network interface in the metadata summary
+type metadataInterface struct {
+	Name       string `json:"name"`
+	MAC        string `json:"mac,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	Mask       string `json:"netmask,omitempty"`
+	Gateway    string `json:"gateway,omitempty"`
+	ExternalIP string `json:"external-ip,omitempty"`
+}
+
+// metadataSummary is metadata.json of the metadata tree. Userdata is in its
+// own file only.
+type metadataSummary struct {
+	Hypervisor       string              `json:"hypervisor"`
+	Cloud            string              `json:"cloud"`
+	Hostname         string              `json:"hostname"`
+	ExternalHostname string              `json:"external-hostname,omitempty"`
+	Region           string              `json:"region,omitempty"`
+	InstanceID       string              `json:"instance-id,omitempty"`
+	DNS              []string            `json:"dns"`
+	NTP              []string            `json:"ntp"`
+	Interfaces       []metadataInterface `json:"interfaces"`
+}
+
+// metadataSummary collects the current values of the instance
+func (v *Vinitd) metadataSummary() metadataSummary {
+
+	envs := v.hypervisorInfo.envs
+
+	s := metadataSummary{
+		Hypervisor:       v.hypervisorInfo.hypervisorString(),
+		Cloud:            v.hypervisorInfo.cloudString(),
+		Hostname:         v.hostname,
+		ExternalHostname: envs[envExtHostname],
+		Region:           envs[envRegion],
+		InstanceID:       envs[envInstanceID],
+		DNS:              []string{},
+		NTP:              append([]string{}, v.vcfg.System.NTP...),
+		Interfaces:       []metadataInterface{},
+	}
+
+	for _, d := range v.dns {
+		s.DNS = append(s.DNS, d.String())
+	}
+
+	for _, ifc := range v.ifcs {
+
+		mi := metadataInterface{
+			Name:       ifc.name,
+			MAC:        ifc.netIfc.HardwareAddr.String(),
+			ExternalIP: envs[fmt.Sprintf(envExtIP, ifc.idx)],
+		}
+
+		if ifc.addr != nil {
+			mi.IP = ifc.addr.IP.String()
+			mi.Mask = net.IP(ifc.addr.Mask).String()
+		}
+
+		if ifc.gw != nil {
+			mi.Gateway = ifc.gw.String()
+		}
+
+		s.Interfaces = append(s.Interfaces, mi)
+	}
+
+	sort.Slice(s.Interfaces, func(i, j int) bool {
+		return s.Interfaces[i].Name < s.Interfaces[j].Name
+	})
+
+	return s
+}
+
+// writeMetadataTree writes the values to a new directory in base and
+// replaces the metadata symlink, readers see either the old or the new
+// values
+func writeMetadataTree(base string, s metadataSummary, userdata, user string) error {
+
+	dir, err := ioutil.TempDir(base, "."+metadataTreeDir)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"hypervisor":        s.Hypervisor,
+		"cloud":             s.Cloud,
+		"hostname":          s.Hostname,
+		"external-hostname": s.ExternalHostname,
+		"region":            s.Region,
+		"instance-id":       s.InstanceID,
+		"userdata":          userdata,
+		"dns":               strings.Join(s.DNS, "\n"),
+		"ntp":               strings.Join(s.NTP, "\n"),
+	}
+
+	for _, mi := range s.Interfaces {
+		for n, val := range map[string]string{
+			"mac":         mi.MAC,
+			"ip":          mi.IP,
+			"netmask":     mi.Mask,
+			"gateway":     mi.Gateway,
+			"external-ip": mi.ExternalIP,
+		} {
+			files[filepath.Join("interfaces", mi.Name, n)] = val
+		}
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	files[metadataSummaryFile] = string(b)
+
+	for n, val := range files {
+		p := filepath.Join(dir, n)
+		err = os.MkdirAll(filepath.Dir(p), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(p, []byte(val), 0600)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	if uid, gid, err := lookupOwner(user); err == nil {
+		filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			os.Lchown(p, uid, gid)
+			return nil
+		})
+	}
+
+	// rename replaces the link atomically, the old version is removed
+	// afterwards
+	link := filepath.Join(base, metadataTreeDir)
+	old, _ := os.Readlink(link)
+
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+
+	err = os.Symlink(filepath.Base(dir), tmp)
+	if err == nil {
+		err = os.Rename(tmp, link)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.RemoveAll(dir)
+		return err
+	}
+
+	if old != "" && old != filepath.Base(dir) {
+		os.RemoveAll(filepath.Join(base, old))
+	}
+
+	return nil
+}
+
+// writeMetadata updates metadata.env and the metadata tree
+func (v *Vinitd) writeMetadata() {
+
+	err := writeMetadataEnv(v.hypervisorInfo.envs, v.user)
+	if err != nil {
+		logWarn("can not write metadata: %s", err.Error())
+	}
+
+	base, err := runDir()
+	if err == nil {
+		err = writeMetadataTree(base, v.metadataSummary(), v.hypervisorInfo.envs[envUserData], v.user)
+	}
+	if err != nil {
+		logWarn("can not write metadata tree: %s", err.Error())
+	}
+}
+
+// changedEnvs returns the sorted names of new or changed values. Values
+// missing in next are not changes, see removedEnvs.
+func changedEnvs(prev, next map[string]string) []string {
+
+	var changed []string
+	for k, val := range next {
+		if old, ok := prev[k]; !ok || old != val {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
+
+// removedEnvs returns the sorted names of values missing in next. It is
+// only valid if all requests for next succeeded.
+func removedEnvs(prev, next map[string]string) []string {
+
+	var removed []string
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+
+	return removed
+}
+
+// notifyMetadata sends the metadata signal and runs the metadata hook of
+// running programs
+func (p *program) notifyMetadata(changed []string, envs map[string]string) {
+
+	if !p.running() {
+		return
+	}
+
+	if p.opts.metadataSignal != 0 {
+		logAlways("program[%d] - metadata changed, sending signal '%s'", p.progIndex, p.opts.metadataSignal)
+		p.cmd.Process.Signal(p.opts.metadataSignal)
+	}
+
+	if len(p.opts.metadataHook) > 0 {
+
+		// later values win in exec
+		env := append([]string{}, p.env...)
+		for _, k := range changed {
+			env = append(env, fmt.Sprintf(environString, k, envs[k]))
+		}
+		env = append(env, fmt.Sprintf(environString, envMetadataChanged, strings.Join(changed, ",")))
+
+		p.runHook("metadata", p.opts.metadataHook, env, metadataHookTimeout)
+	}
+}
+
+// refresh fetches the metadata and applies changed values
+func (w *metadataWatcher) refresh() {
+
+	v := w.v
+
+	next, err := cloudEnvs(w.p, v.ifcs)
+	updateInterfaces(w.p, v.ifcs)
+
+	changed := changedEnvs(v.hypervisorInfo.metadata, next)
+
+	// a missing value is removed only if no request failed
+	var removed []string
+	if err == nil {
+		removed = removedEnvs(v.hypervisorInfo.metadata, next)
+	} else {
+		logDebug("keeping missing metadata values: %s", err.Error())
+	}
+
+	if len(changed) == 0 && len(removed) == 0 {
+		return
+	}
+
+	for _, k := range changed {
+		v.hypervisorInfo.metadata[k] = next[k]
+		v.hypervisorInfo.envs[k] = next[k]
+	}
+
+	for _, k := range removed {
+		delete(v.hypervisorInfo.metadata, k)
+		delete(v.hypervisorInfo.envs, k)
+	}
+
+	changed = append(changed, removed...)
+	sort.Strings(changed)
+
+	logAlways("metadata changed: %s", strings.Join(changed, ", "))
+
+	v.writeMetadata()
+
+	for _, p := range v.programs {
+		p.notifyMetadata(changed, v.hypervisorInfo.envs)
+	}
+}
+
+// run refreshes the metadata if it changed or on every interval
+func (w *metadataWatcher) run() {
+
+	cw, wait := w.p.(changeWaiter)
+
+	var version string
+
+	for {
+
+		if wait {
+			var err error
+			version, err = cw.waitForChange(version, w.interval)
+			if err != nil {
+				logDebug("waiting for metadata change failed: %s", err.Error())
+				time.Sleep(metadataRetry)
+				continue
+			}
+		} else {
+			time.Sleep(w.interval)
+		}
+
+		w.refresh()
+	}
+}
+
+// startMetadataWatcher writes the metadata of the instance and watches
+// the metadata of the cloud provider for changes
+func (v *Vinitd) startMetadataWatcher() {
+
+	v.writeMetadata()
+
+	p := v.hypervisorInfo.provider
+	if p == nil {
+		return
+	}
+
+	interval := metadataRefresh()
+	if interval == 0 {
+		logDebug("metadata refresh disabled")
+		return
+	}
+
+	if v.hypervisorInfo.metadata == nil {
+		v.hypervisorInfo.metadata = make(map[string]string)
+	}
+
+	logDebug("refreshing %s metadata every %s", p.Name(), interval)
+
+	w := &metadataWatcher{
+		v:        v,
+		p:        p,
+		interval: interval,
+	}
+	go w.run()
+}
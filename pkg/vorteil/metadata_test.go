@@ -0,0 +1,246 @@
+package vorteil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDotenvValue(t *testing.T) {
+
+	envs := map[string]string{
+		"PLAIN":   "value",
+		"SPACES":  "a b # c",
+		"DOLLAR":  "$HOME",
+		"QUOTE":   `it's "quoted"`,
+		"NEWLINE": "line1\nline2\\n",
+	}
+
+	var str strings.Builder
+	for k, val := range envs {
+		str.WriteString(k + "=" + dotenvValue(val) + "\n")
+	}
+
+	entries, err := parseDotenv(strings.NewReader(str.String()))
+	assert.NoError(t, err)
+	assert.Len(t, entries, len(envs))
+
+	for _, e := range entries {
+		assert.Equal(t, envs[e.key], e.value, e.key)
+	}
+
+}
+
+func TestChangedEnvs(t *testing.T) {
+
+	prev := map[string]string{"EXT_IP0": "1.2.3.4", envUserData: "a", "CLOUD_TAG_ENV": "prod"}
+
+	// missing values are not changes
+	assert.Empty(t, changedEnvs(prev, map[string]string{"EXT_IP0": "1.2.3.4"}))
+
+	assert.Equal(t, []string{"CLOUD_TAG_ROLE", "EXT_IP0"}, changedEnvs(prev, map[string]string{
+		"EXT_IP0":        "5.6.7.8",
+		envUserData:      "a",
+		"CLOUD_TAG_ROLE": "web",
+	}))
+
+	assert.Equal(t, []string{"CLOUD_TAG_ENV", envUserData}, removedEnvs(prev, map[string]string{"EXT_IP0": "1.2.3.4"}))
+
+}
+
+func TestMetadataRefresh(t *testing.T) {
+
+	d := &configDrive{cloud: cpNoCloud, instanceID: "i-1", userdata: `{"MODE": "a"}`}
+
+	v := &Vinitd{
+		ifcs:           map[string]*ifc{"eth0": {name: "eth0", idx: 0}},
+		hypervisorInfo: hv{envs: map[string]string{envHostname: "vm"}},
+	}
+	probeCloud(d, v)
+
+	w := &metadataWatcher{v: v, p: d, interval: time.Second}
+
+	d.userdata = `{"MODE": "b"}`
+	w.refresh()
+
+	assert.Equal(t, "b", v.hypervisorInfo.envs["MODE"])
+	assert.Equal(t, `{"MODE": "b"}`, v.hypervisorInfo.envs[envUserData])
+	assert.Equal(t, "b", v.hypervisorInfo.metadata["MODE"])
+	assert.Equal(t, "vm", v.hypervisorInfo.envs[envHostname])
+	assert.Equal(t, "i-1", v.hypervisorInfo.envs[envInstanceID])
+
+	// removed userdata keys are removed
+	d.userdata = `{"OTHER": "c"}`
+	w.refresh()
+
+	assert.NotContains(t, v.hypervisorInfo.envs, "MODE")
+	assert.NotContains(t, v.hypervisorInfo.metadata, "MODE")
+	assert.Equal(t, "c", v.hypervisorInfo.envs["OTHER"])
+	assert.Equal(t, "vm", v.hypervisorInfo.envs[envHostname])
+
+}
+
+func TestMetadataRefreshRemoved(t *testing.T) {
+
+	e := newIMDSEmulator(false, false)
+	e.values["/latest/meta-data/tags/instance"] = "Role"
+	e.values["/latest/meta-data/tags/instance/Role"] = "web"
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	p := newEC2Provider(srv.URL)
+
+	v := &Vinitd{
+		ifcs:           map[string]*ifc{"eth0": {name: "eth0", idx: 0}},
+		hypervisorInfo: hv{envs: make(map[string]string)},
+	}
+	probeCloud(p, v)
+	assert.Equal(t, "web", v.hypervisorInfo.envs["CLOUD_TAG_ROLE"])
+
+	w := &metadataWatcher{v: v, p: p, interval: time.Second}
+
+	// failed requests keep the values
+	e.mtx.Lock()
+	e.fail = true
+	e.mtx.Unlock()
+	w.refresh()
+
+	assert.Equal(t, "web", v.hypervisorInfo.envs["CLOUD_TAG_ROLE"])
+	assert.Equal(t, "52.1.2.3", v.hypervisorInfo.envs["EXT_IP0"])
+
+	// values which are not found any more are removed
+	e.mtx.Lock()
+	e.fail = false
+	delete(e.values, "/latest/meta-data/tags/instance")
+	e.mtx.Unlock()
+	w.refresh()
+
+	assert.NotContains(t, v.hypervisorInfo.envs, "CLOUD_TAG_ROLE")
+	assert.Equal(t, "52.1.2.3", v.hypervisorInfo.envs["EXT_IP0"])
+
+}
+
+func TestGCPWaitForChange(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		q := r.URL.Query()
+		if r.Header.Get("Metadata-Flavor") != "Google" || q.Get("recursive") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		etag := "etag-1"
+		if q.Get("wait_for_change") == "true" {
+			if q.Get("last_etag") != "etag-1" || q.Get("timeout_sec") != "60" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			etag = "etag-2"
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(`{"instance": {}}`))
+	}))
+	defer srv.Close()
+
+	p := newGCPProvider(srv.URL)
+
+	etag, err := p.waitForChange("", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "etag-1", etag)
+
+	etag, err = p.waitForChange(etag, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "etag-2", etag)
+
+	_, err = p.waitForChange("etag-0", time.Minute)
+	assert.Error(t, err)
+
+}
+
+func TestMetadataTree(t *testing.T) {
+
+	base, err := ioutil.TempDir("", "metadata")
+	assert.NoError(t, err)
+	defer os.RemoveAll(base)
+
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	v := &Vinitd{
+		hostname: "vm",
+		ifcs: map[string]*ifc{
+			"eth0": {
+				name:   "eth0",
+				idx:    0,
+				netIfc: net.Interface{HardwareAddr: mac},
+				addr:   &net.IPNet{IP: net.IPv4(10, 0, 0, 5), Mask: net.CIDRMask(24, 32)},
+				gw:     net.IPv4(10, 0, 0, 1),
+			},
+			"eth1": {name: "eth1", idx: 1},
+		},
+		dns: []net.IP{net.IPv4(10, 0, 0, 2)},
+		hypervisorInfo: hv{
+			hypervisor: hvKVM,
+			cloud:      cpGCP,
+			envs: map[string]string{
+				"EXT_IP0":     "35.1.2.3",
+				envInstanceID: "4711",
+				envUserData:   "#cloud-config",
+			},
+		},
+	}
+	v.vcfg.System.NTP = []string{"pool.ntp.org"}
+
+	read := func(n string) string {
+		b, err := ioutil.ReadFile(filepath.Join(base, metadataTreeDir, n))
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	err = writeMetadataTree(base, v.metadataSummary(), v.hypervisorInfo.envs[envUserData], "")
+	assert.NoError(t, err)
+
+	first, err := os.Readlink(filepath.Join(base, metadataTreeDir))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "KVM", read("hypervisor"))
+	assert.Equal(t, "GCP", read("cloud"))
+	assert.Equal(t, "vm", read("hostname"))
+	assert.Equal(t, "4711", read("instance-id"))
+	assert.Equal(t, "#cloud-config", read("userdata"))
+	assert.Equal(t, "10.0.0.2", read("dns"))
+	assert.Equal(t, "pool.ntp.org", read("ntp"))
+	assert.Equal(t, "52:54:00:12:34:56", read("interfaces/eth0/mac"))
+	assert.Equal(t, "10.0.0.5", read("interfaces/eth0/ip"))
+	assert.Equal(t, "255.255.255.0", read("interfaces/eth0/netmask"))
+	assert.Equal(t, "10.0.0.1", read("interfaces/eth0/gateway"))
+	assert.Equal(t, "35.1.2.3", read("interfaces/eth0/external-ip"))
+	assert.Equal(t, "", read("interfaces/eth1/ip"))
+
+	var s metadataSummary
+	assert.NoError(t, json.Unmarshal([]byte(read(metadataSummaryFile)), &s))
+	assert.Equal(t, v.metadataSummary(), s)
+
+	// new version replaces the old one
+	v.hypervisorInfo.envs["EXT_IP0"] = "35.4.5.6"
+	err = writeMetadataTree(base, v.metadataSummary(), "", "")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "35.4.5.6", read("interfaces/eth0/external-ip"))
+	_, err = os.Stat(filepath.Join(base, first))
+	assert.True(t, os.IsNotExist(err))
+
+	fis, err := ioutil.ReadDir(base)
+	assert.NoError(t, err)
+	assert.Len(t, fis, 2)
+
+}
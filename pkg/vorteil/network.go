@@ -117,6 +117,12 @@ type clientdhcp struct {
 	offer  *dhcpv4.DHCPv4
 }
 
+var (
+	// acknowledged leases, released on shutdown
+	dhcpLeases    = make(map[string]*clientdhcp)
+	dhcpLeasesMtx sync.Mutex
+)
+
 func networkDeviceType(name string) networkType {
 	dat, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/type", name))
 	if err != nil {
@@ -297,7 +303,8 @@ func addAddrToInterface(ifc *ifc) error {
 		return err
 	}
 
-	if err = netlink.AddrAdd(eth, addr); err != nil {
+	// replace does not fail if the address exists already
+	if err = netlink.AddrReplace(eth, addr); err != nil {
 		return err
 	}
 
@@ -374,20 +381,28 @@ func configInterface(ifc *ifc, ip, mask, router net.IP) error {
 	addAddrToInterface(ifc)
 
 	// google cloud returns a full mask, need to set link to gateway
-	// if that fails we can panic because there is no connectivity
+	// if that fails there is no connectivity
 	if mask.Equal(net.IPv4bcast) {
-		err := addNetworkRoute4(router, net.IPv4bcast, nil, ifc.name, unix.RTF_UP|unix.RTF_HOST)
+		err := handleFailure(failureGateway, func() error {
+			err := addNetworkRoute4(router, net.IPv4bcast, nil, ifc.name, unix.RTF_UP|unix.RTF_HOST)
+			if err != nil {
+				return fmt.Errorf("could not set host route for %s", router)
+			}
+			return nil
+		})
 		if err != nil {
-			SystemPanic("could not set host route")
+			return err
 		}
 	}
 
 	// set default gateway
 	if router != nil {
 		logDebug("setting default gateway to %s", router)
-		err := setDefaultGateway(ifc.name, router)
+		err := handleFailure(failureGateway, func() error {
+			return setDefaultGateway(ifc.name, router)
+		})
 		if err != nil {
-			SystemPanic(err.Error())
+			return err
 		}
 	}
 
@@ -403,9 +418,21 @@ func fetchDHCP(ifc *ifc, v *Vinitd) error {
 	cid[0] = byte(1)
 	copy(cid[1:], ifc.netIfc.HardwareAddr)
 
-	offer, xid, err := dhcpDiscover(ifc.netIfc, cid)
-	if err != nil {
-		logError("can not get IP from DHCP: %s", err.Error())
+	// the network policy applies to getting the lease only, routes have
+	// their own policy in configInterface
+	var (
+		offer *dhcpv4.DHCPv4
+		xid   dhcpv4.TransactionID
+	)
+	err := handleFailure(failureNetwork, func() error {
+		var err error
+		offer, xid, err = dhcpDiscover(ifc.netIfc, cid)
+		if err != nil {
+			logError("can not get IP from DHCP: %s", err.Error())
+		}
+		return err
+	})
+	if err != nil || offer == nil {
 		return err
 	}
 
@@ -421,7 +448,10 @@ func fetchDHCP(ifc *ifc, v *Vinitd) error {
 		v.hypervisorInfo.cloud = cpNone
 	}
 
-	configInterface(ifc, offer.YourIPAddr, mask, router)
+	err = configInterface(ifc, offer.YourIPAddr, mask, router)
+	if err != nil {
+		return err
+	}
 
 	for _, ntpIPs := range offer.NTPServers() {
 		logDebug("dhcp NTP servers: %v", ntpIPs.String())
@@ -487,6 +517,10 @@ func fetchDHCP(ifc *ifc, v *Vinitd) error {
 		}
 		logDebug("dhcp acknowledged: %v, renew %d", ack, renew)
 
+		dhcpLeasesMtx.Lock()
+		dhcpLeases[name] = clientInfo
+		dhcpLeasesMtx.Unlock()
+
 		for {
 			<-time.After(time.Duration(renew) * time.Second)
 			logDebug("renew with %v", dhcpServerIP)
@@ -499,6 +533,50 @@ func fetchDHCP(ifc *ifc, v *Vinitd) error {
 
 }
 
+// releaseDHCP sends a release for all acknowledged leases
+func releaseDHCP() {
+
+	dhcpLeasesMtx.Lock()
+	defer dhcpLeasesMtx.Unlock()
+
+	for name, cinfo := range dhcpLeases {
+
+		ip := cinfo.offer.YourIPAddr
+		server := dhcpv4.GetIP(dhcpv4.OptionServerIdentifier, cinfo.offer.Options)
+
+		logDebug("releasing dhcp lease %v on %s", ip, name)
+
+		release, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+			dhcpv4.WithTransactionID(cinfo.xid),
+			dhcpv4.WithHwAddr(cinfo.offer.ClientHWAddr),
+			dhcpv4.WithClientIP(ip),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(server)),
+			dhcpv4.WithOption(dhcpv4.OptClientIdentifier(cinfo.cid)))
+		if err != nil {
+			logWarn("can not create dhcp release: %s", err.Error())
+			continue
+		}
+
+		conn, err := net.DialUDP("udp4",
+			&net.UDPAddr{IP: ip, Port: dhcpv4.ClientPort},
+			&net.UDPAddr{IP: server, Port: dhcpv4.ServerPort})
+		if err != nil {
+			logWarn("can not send dhcp release: %s", err.Error())
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(defaultDHCPTimeout))
+		_, err = conn.Write(release.ToBytes())
+		if err != nil {
+			logWarn("can not send dhcp release: %s", err.Error())
+		}
+		conn.Close()
+
+		delete(dhcpLeases, name)
+	}
+
+}
+
 func setDefaultGateway(name string, ip net.IP) error {
 
 	err := addNetworkRoute4(nil, nil, ip, name, unix.RTF_UP|unix.RTF_GATEWAY)
@@ -556,17 +634,26 @@ func (v *Vinitd) handleNetworkLink(interf *ifc, ifcg vcfg.NetworkInterface, errC
 	if ifcg.IP != "dhcp" && ifcg.IP != "" {
 
 		go func() {
-			// static ip
+			// static ip, configInterface applies the gateway policy
 			ip := net.ParseIP(ifcg.IP)
 			mask := net.ParseIP(ifcg.Mask)
 			gw := net.ParseIP(ifcg.Gateway)
 
+			var err error
 			if ip == nil || mask == nil || gw == nil {
-				errCh <- fmt.Errorf("ip, mask or gateway is not valid")
-				wg.Done()
-				return
+				// the configuration does not change on retry, the network
+				// policy decides once
+				fp := failurePolicyFor(failureNetwork)
+				fp.retries = 0
+				err = handleFailurePolicy(failureNetwork, fp, func() error {
+					return fmt.Errorf("ip, mask or gateway is not valid for %s", interf.name)
+				})
+			} else {
+				err = configInterface(interf, ip, mask, gw)
+			}
+			if err != nil {
+				errCh <- err
 			}
-			configInterface(interf, ip, mask, gw)
 			wg.Done()
 		}()
 
@@ -612,6 +699,8 @@ func handleNetworkTCPDump(interf *ifc, ifcg vcfg.NetworkInterface,
 		err = tcpDumpCmd.Start()
 		if err != nil {
 			errCh <- fmt.Errorf("could not set tcpdump command, %v", err)
+		} else {
+			accounting.registerService(tcpDumpCmd.Process.Pid, serviceTCPDump)
 		}
 	}
 
@@ -726,6 +815,11 @@ func sortAndPrint(ifcs map[string]*ifc) {
 
 	sort.Strings(ifcKeys)
 	for _, iKey := range ifcKeys {
+		// interfaces without address are not configured or failed
+		if ifcs[iKey].addr == nil {
+			logAlways("%s ip\t: not configured", ifcs[iKey].name)
+			continue
+		}
 		logAlways("%s ip\t: %s", ifcs[iKey].name, ifcs[iKey].addr.IP.String())
 		logAlways("%s mask\t: %s", ifcs[iKey].name, net.IP(ifcs[iKey].addr.Mask).String())
 		logAlways("%s gateway\t: %s", ifcs[iKey].name, ifcs[iKey].gw.String())
@@ -817,42 +911,47 @@ func trimString(s string, n int) string {
 func configRoutes(routes []vcfg.Route) {
 
 	for _, r := range routes {
+		r := r
+		handleFailure(failureRoute, func() error {
+			return configRoute(r)
+		})
+	}
 
-		dst, nw, err := net.ParseCIDR(r.Destination)
-		if err != nil {
-			logError("can not set route destination: %v", r.Destination)
-			continue
-		}
+}
 
-		gw := net.ParseIP(r.Gateway)
-		if gw == nil {
-			logError("gateway %s invalid", r.Gateway)
-			continue
-		}
+func configRoute(r vcfg.Route) error {
 
-		// check if gateway is in that network
-		// if not, we need to create a direct link
-		var errNw error
-		if !nw.Contains(gw) {
-			errNw = addNetworkRoute4(gw, net.IPv4bcast, nil, r.Interface,
-				unix.RTF_UP|unix.RTF_HOST)
-		} else {
-			errNw = addNetworkRoute4(gw, net.IP(nw.Mask), nil, r.Interface,
-				unix.RTF_UP|unix.RTF_HOST)
-		}
+	dst, nw, err := net.ParseCIDR(r.Destination)
+	if err != nil {
+		return fmt.Errorf("can not set route destination: %v", r.Destination)
+	}
 
-		if errNw != nil {
-			logError("can not set route direct link: %v", errNw)
-			continue
-		}
+	gw := net.ParseIP(r.Gateway)
+	if gw == nil {
+		return fmt.Errorf("gateway %s invalid", r.Gateway)
+	}
 
-		err = addNetworkRoute4(dst, net.IP(nw.Mask), gw, r.Interface,
-			unix.RTF_UP|unix.RTF_STATIC|unix.RTF_GATEWAY)
-		if err != nil {
-			logError("can not set route: %v", err)
-			continue
-		}
+	// check if gateway is in that network
+	// if not, we need to create a direct link
+	var errNw error
+	if !nw.Contains(gw) {
+		errNw = addNetworkRoute4(gw, net.IPv4bcast, nil, r.Interface,
+			unix.RTF_UP|unix.RTF_HOST)
+	} else {
+		errNw = addNetworkRoute4(gw, net.IP(nw.Mask), nil, r.Interface,
+			unix.RTF_UP|unix.RTF_HOST)
+	}
+
+	if errNw != nil {
+		return fmt.Errorf("can not set route direct link: %v", errNw)
+	}
 
+	err = addNetworkRoute4(dst, net.IP(nw.Mask), gw, r.Interface,
+		unix.RTF_UP|unix.RTF_STATIC|unix.RTF_GATEWAY)
+	if err != nil {
+		return fmt.Errorf("can not set route: %v", err)
 	}
 
+	return nil
+
 }
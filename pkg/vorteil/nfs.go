@@ -15,6 +15,11 @@ import (
 	"github.com/vorteil/vorteil/pkg/vcfg"
 )
 
+var (
+	// mount points of successful nfs mounts, unmounted on shutdown
+	nfsMounts []string
+)
+
 func resolveNFS(name string) net.IP {
 	logDebug("resolving nfs server: %s", name)
 	ips, err := net.LookupIP(name)
@@ -70,6 +75,24 @@ func setupNFS(mounts []vcfg.NFSSettings) {
 			logError("can not mount NFS: %s", err.Error())
 			continue
 		}
+
+		nfsMounts = append(nfsMounts, mp)
 	}
 
 }
+
+func unmountNFS() {
+
+	for i := len(nfsMounts) - 1; i >= 0; i-- {
+		mp := nfsMounts[i]
+		logDebug("unmounting nfs %s", mp)
+		err := syscall.Unmount(mp, 0)
+		if err != nil {
+			logWarn("can not unmount nfs %s: %s, detaching", mp, err.Error())
+			syscall.Unmount(mp, syscall.MNT_FORCE|syscall.MNT_DETACH)
+		}
+	}
+
+	nfsMounts = nil
+
+}
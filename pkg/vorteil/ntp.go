@@ -44,19 +44,20 @@ func setupChronyD(ntps []string) error {
 			}
 		}
 
-		// Prepend servers to config data
+		// Prepend servers to config data, local copy so it can be retried
+		cfg := chronydCfgData
 		for _, ntpServer := range ntps {
-			chronydCfgData = fmt.Sprintf("server %s iburst\n%s", ntpServer, chronydCfgData)
+			cfg = fmt.Sprintf("server %s iburst\n%s", ntpServer, cfg)
 		}
 
 		// Write config data
-		if err := ioutil.WriteFile(chronydCfgPath, []byte(chronydCfgData), 0644); err != nil {
+		if err := ioutil.WriteFile(chronydCfgPath, []byte(cfg), 0644); err != nil {
 			return fmt.Errorf("could not write config file: %v", err)
 		}
 
-		logDebug("ntp config:\n %s", chronydCfgData)
+		logDebug("ntp config:\n %s", cfg)
 
-		startChrony()
+		return startChrony()
 	}
 
 	return nil
@@ -69,6 +70,13 @@ func startChrony() error {
 		Credential: &syscall.Credential{Uid: uint32(rootID), Gid: uint32(rootID)},
 	}
 
-	return chronydCMD.Start()
+	err := chronydCMD.Start()
+	if err != nil {
+		return err
+	}
+
+	accounting.registerService(chronydCMD.Process.Pid, serviceChrony)
+
+	return nil
 
 }
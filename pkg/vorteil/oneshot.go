@@ -0,0 +1,95 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+const (
+	// the reaper records the exit status shortly after it collected the
+	// process, cmd.Wait fails then
+	oneshotStatusWait = time.Second
+)
+
+func (p *program) isOneshot() bool {
+	return p.opts.progType == programOneshot
+}
+
+// oneshotFailure returns the subsystem whose failure policy applies,
+// commands of cloud-init do not stop the boot by default
+func (p *program) oneshotFailure() string {
+
+	if p.cloudInit {
+		return failureCloud
+	}
+
+	return failureOneshot
+}
+
+// runOneshot runs the program to completion and returns an error if it
+// exits with a non-zero exit code
+func (p *program) runOneshot(systemUser string) error {
+
+	cmd := p.command(systemUser)
+
+	err := p.output(cmd)
+	if err != nil {
+		return err
+	}
+
+	p.cmd = cmd
+
+	logAlways("program[%d] - running one-shot %s", p.progIndex, p.path)
+
+	start := time.Now()
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	accounting.registerProgram(cmd.Process.Pid, p)
+
+	code := waitExitCode(cmd)
+
+	logAlways("program[%d] - one-shot finished with exit code %d after %v", p.progIndex,
+		code, time.Since(start).Round(time.Millisecond))
+
+	if code != 0 {
+		return fmt.Errorf("one-shot %s exited with %d", p.path, code)
+	}
+
+	return nil
+}
+
+// waitExitCode waits for a started command and returns its exit code
+func waitExitCode(cmd *exec.Cmd) int {
+
+	cmd.Wait()
+
+	code := cmdExitCode(cmd)
+	for deadline := time.Now().Add(oneshotStatusWait); code < 0 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		code = cmdExitCode(cmd)
+	}
+
+	return code
+}
+
+// oneshotsFinished returns true if all one-shot programs ran
+func oneshotsFinished(progs []*program) bool {
+
+	for _, p := range progs {
+		if p.isOneshot() && !p.failed && cmdExitCode(p.cmd) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,240 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-shellwords"
+	"golang.org/x/sys/unix"
+)
+
+// per-program options are passed as environment variables in the VCFG.
+// known options are removed before the program gets started.
+const (
+	optionPrefix = "VINITD_"
+
+	// comma separated list of program indexes or binary names this program
+	// depends on. dependencies are stopped after this program.
+	optionDepends = "VINITD_DEPENDS"
+
+	// command executed before the terminate signal is sent
+	optionPreStop = "VINITD_PRE_STOP"
+
+	// time to wait for the program to exit before it gets killed, e.g. 30s
+	optionStopTimeout = "VINITD_STOP_TIMEOUT"
+
+	// marks the program whose exit code gets reported, defaults to the first
+	optionMain = "VINITD_MAIN"
+
+	// service (default), oneshot or job
+	optionType = "VINITD_TYPE"
+
+	// cron expression or @every <duration> for jobs
+	optionSchedule = "VINITD_SCHEDULE"
+
+	// skip (default), allow or replace if a job is still running
+	optionOverlap = "VINITD_OVERLAP"
+
+	// maximum runtime of a job
+	optionTimeout = "VINITD_TIMEOUT"
+
+	// comma separated dotenv files, optional if prefixed with -
+	optionEnvFile = "VINITD_ENV_FILE"
+
+	// comma separated directories with one file per variable
+	optionEnvDir = "VINITD_ENV_DIR"
+
+	// true or the dotted path of an object in the JSON userdata
+	optionEnvUserdata = "VINITD_ENV_USERDATA"
+
+	// signal sent to the program if the cloud metadata changes, e.g. SIGHUP
+	optionMetadataSignal = "VINITD_METADATA_SIGNAL"
+
+	// command executed if the cloud metadata changes
+	optionMetadataHook = "VINITD_METADATA_HOOK"
+
+	// command executed if the cloud announces a preemption or maintenance
+	optionPreemptHook = "VINITD_PREEMPT_HOOK"
+)
+
+const (
+	programService = "service"
+	programOneshot = "oneshot"
+	programJob     = "job"
+
+	overlapSkip    = "skip"
+	overlapAllow   = "allow"
+	overlapReplace = "replace"
+)
+
+type programOptions struct {
+	depends     []string
+	preStop     []string
+	stopTimeout time.Duration
+	main        bool
+
+	progType string
+	schedule schedule
+	overlap  string
+	timeout  time.Duration
+
+	envFiles    []string
+	envDirs     []string
+	envUserdata string
+
+	metadataSignal syscall.Signal
+	metadataHook   []string
+	preemptHook    []string
+}
+
+// splitList splits a comma separated list and drops empty elements
+func splitList(s string) []string {
+
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); len(e) > 0 {
+			l = append(l, e)
+		}
+	}
+
+	return l
+}
+
+// parseDuration accepts go durations or plain seconds
+func parseDuration(s string) (time.Duration, error) {
+
+	if i, err := strconv.Atoi(s); err == nil {
+		return time.Duration(i) * time.Second, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// parseProgramOptions extracts all VINITD_ options from the environment
+// and returns the remaining environment variables.
+func parseProgramOptions(env []string) (programOptions, []string, error) {
+
+	var (
+		opts programOptions
+		rest []string
+		spec string
+	)
+
+	opts.progType = programService
+	opts.overlap = overlapSkip
+
+	for _, e := range env {
+
+		es := strings.SplitN(e, "=", 2)
+		if !strings.HasPrefix(es[0], optionPrefix) {
+			rest = append(rest, e)
+			continue
+		}
+
+		val := ""
+		if len(es) > 1 {
+			val = strings.TrimSpace(es[1])
+		}
+
+		switch es[0] {
+		case optionDepends:
+			opts.depends = splitList(val)
+		case optionPreStop:
+			args, err := shellwords.Parse(val)
+			if err != nil {
+				return opts, rest, fmt.Errorf("can not parse %s: %v", optionPreStop, err)
+			}
+			opts.preStop = args
+		case optionStopTimeout:
+			d, err := parseDuration(val)
+			if err != nil {
+				return opts, rest, fmt.Errorf("can not parse %s: %v", optionStopTimeout, err)
+			}
+			opts.stopTimeout = d
+		case optionMain:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return opts, rest, fmt.Errorf("can not parse %s: %v", optionMain, err)
+			}
+			opts.main = b
+		case optionType:
+			switch val {
+			case programService, programOneshot, programJob:
+				opts.progType = val
+			default:
+				return opts, rest, fmt.Errorf("unknown program type '%s'", val)
+			}
+		case optionSchedule:
+			spec = val
+		case optionOverlap:
+			switch val {
+			case overlapSkip, overlapAllow, overlapReplace:
+				opts.overlap = val
+			default:
+				return opts, rest, fmt.Errorf("unknown overlap policy '%s'", val)
+			}
+		case optionTimeout:
+			d, err := parseDuration(val)
+			if err != nil {
+				return opts, rest, fmt.Errorf("can not parse %s: %v", optionTimeout, err)
+			}
+			opts.timeout = d
+		case optionEnvFile:
+			opts.envFiles = splitList(val)
+		case optionEnvDir:
+			opts.envDirs = splitList(val)
+		case optionEnvUserdata:
+			if b, err := strconv.ParseBool(val); err == nil {
+				if b {
+					opts.envUserdata = "true"
+				}
+			} else {
+				opts.envUserdata = val
+			}
+		case optionMetadataSignal:
+			sig := unix.SignalNum(strings.ToUpper(val))
+			if sig == 0 {
+				return opts, rest, fmt.Errorf("unknown signal '%s'", val)
+			}
+			opts.metadataSignal = sig
+		case optionMetadataHook:
+			args, err := shellwords.Parse(val)
+			if err != nil {
+				return opts, rest, fmt.Errorf("can not parse %s: %v", optionMetadataHook, err)
+			}
+			opts.metadataHook = args
+		case optionPreemptHook:
+			args, err := shellwords.Parse(val)
+			if err != nil {
+				return opts, rest, fmt.Errorf("can not parse %s: %v", optionPreemptHook, err)
+			}
+			opts.preemptHook = args
+		default:
+			// not an option, e.g. a variable of the application
+			logDebug("unknown program option %s, passing it to the program", es[0])
+			rest = append(rest, e)
+		}
+
+	}
+
+	if opts.progType == programJob {
+		if spec == "" {
+			return opts, rest, fmt.Errorf("job needs %s", optionSchedule)
+		}
+		sched, err := parseSchedule(spec)
+		if err != nil {
+			return opts, rest, fmt.Errorf("can not parse %s: %v", optionSchedule, err)
+		}
+		opts.schedule = sched
+	}
+
+	return opts, rest, nil
+}
@@ -0,0 +1,91 @@
+package vorteil
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestParseProgramOptions(t *testing.T) {
+
+	opts, env, err := parseProgramOptions([]string{
+		"PATH=/bin",
+		"VINITD_DEPENDS=0, postgres",
+		"VINITD_PRE_STOP=/bin/pg_ctl stop -m 'fast'",
+		"VINITD_STOP_TIMEOUT=30",
+		"VINITD_APP_MODE=prod",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"PATH=/bin", "VINITD_APP_MODE=prod"}, env)
+	assert.Equal(t, []string{"0", "postgres"}, opts.depends)
+	assert.Equal(t, []string{"/bin/pg_ctl", "stop", "-m", "fast"}, opts.preStop)
+	assert.Equal(t, 30*time.Second, opts.stopTimeout)
+
+	opts, _, err = parseProgramOptions([]string{"VINITD_STOP_TIMEOUT=1m30s"})
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, opts.stopTimeout)
+
+	_, _, err = parseProgramOptions([]string{"VINITD_STOP_TIMEOUT=soon"})
+	assert.Error(t, err)
+
+	opts, _, err = parseProgramOptions([]string{"VINITD_MAIN=true"})
+	assert.NoError(t, err)
+	assert.True(t, opts.main)
+
+	p1 := &program{progIndex: 1}
+	p0 := &program{progIndex: 0}
+	assert.Equal(t, p0, mainProgram([]*program{p1, p0}))
+	p1.opts = opts
+	assert.Equal(t, p1, mainProgram([]*program{p0, p1}))
+
+	opts, _, err = parseProgramOptions([]string{
+		"VINITD_METADATA_SIGNAL=sighup",
+		"VINITD_METADATA_HOOK=/bin/reload --config /etc/app.conf",
+		"VINITD_PREEMPT_HOOK=/bin/checkpoint",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/checkpoint"}, opts.preemptHook)
+	assert.Equal(t, syscall.SIGHUP, opts.metadataSignal)
+	assert.Equal(t, []string{"/bin/reload", "--config", "/etc/app.conf"}, opts.metadataHook)
+
+	_, _, err = parseProgramOptions([]string{"VINITD_METADATA_SIGNAL=SIGNOPE"})
+	assert.Error(t, err)
+
+}
+
+func TestStopOrder(t *testing.T) {
+
+	db := &program{progIndex: 0, vcfgProg: vcfg.Program{Binary: "/usr/bin/postgres"}}
+	app := &program{progIndex: 1, vcfgProg: vcfg.Program{Binary: "/app"},
+		opts: programOptions{depends: []string{"postgres"}}}
+	proxy := &program{progIndex: 2, vcfgProg: vcfg.Program{Binary: "/proxy"},
+		opts: programOptions{depends: []string{"1"}}}
+	other := &program{progIndex: 3, vcfgProg: vcfg.Program{Binary: "/other"}}
+
+	rounds := stopOrder([]*program{db, app, proxy, other})
+	assert.Equal(t, [][]*program{{proxy, other}, {app}, {db}}, rounds)
+
+	// cycles end up in one round
+	db.opts.depends = []string{"2"}
+	rounds = stopOrder([]*program{db, app, proxy, other})
+	assert.Equal(t, [][]*program{{other}, {db, app, proxy}}, rounds)
+
+}
+
+func TestOneshotDone(t *testing.T) {
+
+	oneshot := &program{progIndex: 0, opts: programOptions{progType: programOneshot}}
+	assert.False(t, vmDone([]*program{oneshot}))
+	assert.Equal(t, oneshot, mainProgram([]*program{oneshot}))
+
+	oneshot.failed = true
+	assert.True(t, vmDone([]*program{oneshot}))
+
+	service := &program{progIndex: 1}
+	assert.False(t, vmDone([]*program{oneshot, service}))
+	assert.Equal(t, service, mainProgram([]*program{oneshot, service}))
+
+}
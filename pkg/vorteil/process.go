@@ -34,9 +34,6 @@ const (
 )
 
 var (
-	procs    map[uint32]uint32
-	internal map[uint32]string
-
 	instantShutdown = false
 	isFirecracker   = false
 )
@@ -65,25 +62,56 @@ type CbID struct {
 	Val uint32
 }
 
-func killAll() {
+// killCandidates returns all processes which are not kernel threads or
+// started by vinitd itself, e.g. chronyd
+func killCandidates() []int {
+
+	var pids []int
 
 	pl, err := ps.Processes()
 	if err != nil {
 		logError("can not get processes: %s", err.Error())
-		return
+		return pids
 	}
 
-	// iterate through all processes and send signals
-	// most processes are ok with either SIGINT or SIGTERM
 	for x := range pl {
 		p := pl[x]
 
 		// don't kill us (pid 1) and kthread (pid 2)
 		if p.Pid() > 2 && p.PPid() > 2 {
-			syscall.Kill(p.Pid(), syscall.SIGINT)
-			syscall.Kill(p.Pid(), syscall.SIGTERM)
+			pids = append(pids, p.Pid())
+		}
+	}
+
+	return pids
+}
+
+func killAll() {
+
+	// iterate through all processes and send signals
+	// most processes are ok with either SIGINT or SIGTERM
+	for _, pid := range killCandidates() {
+		syscall.Kill(pid, syscall.SIGINT)
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+
+	// escalate to SIGKILL for everything still running after the grace period
+	deadline := time.Now().Add(killGracePeriod)
+	for {
+		pids := killCandidates()
+		if len(pids) == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			for _, pid := range pids {
+				logWarn("process %d did not terminate, killing it", pid)
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+			return
 		}
 
+		time.Sleep(100 * time.Millisecond)
 	}
 
 }
@@ -108,6 +136,10 @@ func shutdown(cmd int) {
 
 	killAll()
 
+	unmountNFS()
+
+	releaseDHCP()
+
 	logAlways("shutting down system")
 
 	// Fixed Timeout - Allows for shutdown logs to be printed
@@ -126,6 +158,10 @@ func shutdown(cmd int) {
 		flushDisk(p)
 	}
 
+	if cmd == syscall.LINUX_REBOOT_CMD_POWER_OFF {
+		isaDebugExit()
+	}
+
 	// firecracker needs reboot for poweroff
 	if isFirecracker {
 		syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
@@ -135,74 +171,76 @@ func shutdown(cmd int) {
 
 }
 
+// sendTerminateSignals stops all programs in reverse dependency order. All
+// rounds share one deadline, later rounds get what is left.
 func sendTerminateSignals() {
-	var wg sync.WaitGroup
 
-	// loop through program's terminate signals
-	for p, termSig := range terminateSignals {
-		wg.Add(1)
-		go func(np *program, sig syscall.Signal) {
-			defer wg.Done()
+	stopJobs()
 
-			// if program is finished skip
-			if np.cmd == nil || np.cmd.Process == nil || np.cmd.ProcessState.ExitCode() >= 0 {
-				return
-			}
+	progs := launchedPrograms()
+	terminateDeadline = time.Now().Add(stopBudget(progs))
 
-			logAlways("program[%d] pid[%d] - sending signal '%s'", np.progIndex, np.cmd.Process.Pid, sig)
+	for _, round := range stopOrder(progs) {
 
-			// send terminate to program
-			if err := np.cmd.Process.Signal(sig); err != nil {
-				logError("could not send terminate signal program %v, error: %v", np.cmd.Process.Pid, err)
-			}
+		var wg sync.WaitGroup
 
-			// Wait for process to be exit...
-			select {
-			case <-np.exitChannel:
-			}
-		}(p, termSig)
-	}
+		for _, p := range round {
+			wg.Add(1)
+			go func(np *program, sig syscall.Signal) {
+				defer wg.Done()
+				np.stop(sig)
+			}(p, terminateSignals[p])
+		}
 
-	// Wait for all processes to be terminated, or continue after timeout
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
 		wg.Wait()
-	}()
-	select {
-	case <-c:
-		logAlways("applications terminated")
-	case <-time.After(terminateWait):
-		logWarn("could not terminate all applications before timeout")
 	}
-}
 
-func listenToProcesses(progs []*program) {
+	logAlways("applications terminated")
+}
 
-	procs = make(map[uint32]uint32)
-	internal = make(map[uint32]string)
+// openProcConnector subscribes to the kernel's process events
+func openProcConnector() (int, error) {
 
 	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM, unix.NETLINK_CONNECTOR)
 
 	if err != nil {
-		logError("socket for process listening failed: %s", err.Error())
-		return
+		return -1, fmt.Errorf("socket for process listening failed: %s", err.Error())
 	}
 
 	addr := &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: cnIDXProc, Pid: uint32(os.Getpid())}
 	err = unix.Bind(sock, addr)
 
 	if err != nil {
-		logError("bind for process listening failed: %s", err.Error())
-		return
+		unix.Close(sock)
+		return -1, fmt.Errorf("bind for process listening failed: %s", err.Error())
 	}
 
 	err = send(sock, procCNMCASTListen)
 	if err != nil {
-		logError("send for process listening failed: %s", err.Error())
+		unix.Close(sock)
+		return -1, fmt.Errorf("send for process listening failed: %s", err.Error())
+	}
+
+	return sock, nil
+}
+
+// startProcAccounting starts listening to process events. If that is not
+// possible vinitd falls back to process lists to decide if it is done.
+func startProcAccounting(progs []*program) {
+
+	sock, err := openProcConnector()
+	if err != nil {
+		logError("%s", err.Error())
 		return
 	}
 
+	accounting.setActive(true)
+
+	go listenToProcesses(sock, progs)
+}
+
+func listenToProcesses(sock int, progs []*program) {
+
 	for {
 		p := make([]byte, 1024)
 
@@ -221,37 +259,8 @@ func listenToProcesses(progs []*program) {
 
 func handleExit(progs []*program) {
 
-	// count is not correct. it is just a marker that we should keep running
-	count := 0
-	rpo, _ := ps.Processes()
-	for _, p := range rpo {
-		if p.Pid() > 2 && p.PPid() > 2 &&
-			p.Executable() != "chronyd" &&
-			p.Executable() != "fluent-bit" {
-			count++
-		}
-	}
-
-	// count the ones bootstrapping or not started
-	for _, p := range progs {
-
-		// has not been started or stil running
-		if p.cmd == nil {
-			count++
-		} else if p.cmd != nil && p.cmd.ProcessState == nil && !p.reaper { // if this has been reaped
-			count++
-		} else if p.cmd != nil && p.cmd.ProcessState != nil && !p.cmd.ProcessState.Exited() {
-			count++
-		}
-
-	}
-
-	if count == 0 {
-		if initStatus != statusPoweroff {
-			logAlways("no programs still running")
-			instantShutdown = true
-		}
-		shutdown(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+	if vmDone(progs) {
+		programsFinished(progs)
 	}
 
 }
@@ -264,6 +273,12 @@ func parseNetlinkMessage(m syscall.NetlinkMessage, progs []*program) {
 		binary.Read(buf, binary.LittleEndian, msg)
 		binary.Read(buf, binary.LittleEndian, hdr)
 
+		// event specific data following pid and tgid
+		data := make([]uint32, buf.Len()/4)
+		binary.Read(buf, binary.LittleEndian, data)
+
+		parseProcEvent(hdr, data)
+
 		switch hdr.What {
 		case procEventExit:
 			{
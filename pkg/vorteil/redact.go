@@ -0,0 +1,159 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	// kernel cmdline key with additional comma separated key patterns,
+	// e.g. vinitd.log.redact=*_DSN,LICENSE
+	redactCmdLine = "vinitd.log.redact"
+
+	// kernel cmdline flag to log environment values unmasked
+	unsafeCmdLine = "vinitd.log.unsafe"
+
+	// sensitive values shorter than this are not masked in arguments,
+	// e.g. AUTH_ENABLED=1
+	redactMinLength = 4
+)
+
+var (
+	// patterns match upper case keys
+	defaultRedactPatterns = []string{
+		"*PASSWORD*",
+		"*PASSWD*",
+		"*SECRET*",
+		"*TOKEN*",
+		"*KEY*",
+		"*CREDENTIAL*",
+		"*AUTH*",
+		"*PRIVATE*",
+		"*CERT*",
+		envUserData,
+	}
+
+	redaction redactConfig
+)
+
+type redactConfig struct {
+	once     sync.Once
+	patterns []string
+	unsafe   bool
+}
+
+// load reads the configuration from the kernel cmdline. It does not use
+// cmdLineValue because that logs.
+func (r *redactConfig) load() {
+
+	r.once.Do(func() {
+
+		r.patterns = defaultRedactPatterns
+
+		cmd, err := ioutil.ReadFile(cmdLineFile)
+		if err != nil {
+			return
+		}
+
+		for _, o := range strings.Fields(string(cmd)) {
+			if o == unsafeCmdLine {
+				r.unsafe = true
+			} else if strings.HasPrefix(o, redactCmdLine+"=") {
+				for _, p := range strings.Split(strings.TrimPrefix(o, redactCmdLine+"="), ",") {
+					if p != "" {
+						r.patterns = append(r.patterns, strings.ToUpper(p))
+					}
+				}
+			}
+		}
+
+	})
+
+}
+
+// sensitive returns true if the key matches one of the patterns
+func (r *redactConfig) sensitive(key string) bool {
+
+	r.load()
+
+	key = strings.ToUpper(key)
+	for _, p := range r.patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *redactConfig) isUnsafe() bool {
+	r.load()
+	return r.unsafe
+}
+
+// redactEnv masks values of sensitive KEY=VALUE pairs unless vinitd.log.unsafe
+// is set. Resolved secrets are always masked.
+func redactEnv(env []string) []string {
+
+	out := make([]string, len(env))
+
+	for i, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 && !redaction.isUnsafe() && redaction.sensitive(kv[0]) {
+			out[i] = fmt.Sprintf(environString, kv[0], secretMask)
+			continue
+		}
+		out[i] = secrets.mask(e)
+	}
+
+	return out
+}
+
+// redactArgs masks values of sensitive environment variables in arguments,
+// e.g. after $DB_PASSWORD has been substituted
+func redactArgs(args, env []string) []string {
+
+	var values []string
+
+	if !redaction.isUnsafe() {
+		for _, e := range env {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) == 2 && len(kv[1]) >= redactMinLength && redaction.sensitive(kv[0]) {
+				values = append(values, kv[1])
+			}
+		}
+	}
+
+	out := make([]string, len(args))
+	for i, a := range args {
+		for _, v := range values {
+			a = strings.ReplaceAll(a, v, secretMask)
+		}
+		out[i] = secrets.mask(a)
+	}
+
+	return out
+}
+
+// redactValue returns the value or the mask if the key is sensitive
+func redactValue(key, value string) string {
+
+	if !redaction.isUnsafe() && redaction.sensitive(key) {
+		return secretMask
+	}
+
+	return secrets.mask(value)
+}
+
+// redact masks resolved secrets in log messages
+func redact(s string) string {
+	return secrets.mask(s)
+}
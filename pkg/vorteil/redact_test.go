@@ -0,0 +1,46 @@
+package vorteil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+
+	env := []string{
+		"PATH=/bin",
+		"DB_PASSWORD=hunter22",
+		"api_token=abcdef",
+		"AUTH_ENABLED=1",
+		"USERDATA={}",
+	}
+
+	assert.Equal(t, []string{
+		"PATH=/bin",
+		"DB_PASSWORD=" + secretMask,
+		"api_token=" + secretMask,
+		"AUTH_ENABLED=" + secretMask,
+		"USERDATA=" + secretMask,
+	}, redactEnv(env))
+
+	assert.Equal(t, []string{"--user=app", "--password=" + secretMask, "--auth=1"},
+		redactArgs([]string{"--user=app", "--password=hunter22", "--auth=1"}, env))
+
+	assert.Equal(t, "10.0.0.1", redactValue("EXT_IP0", "10.0.0.1"))
+	assert.Equal(t, secretMask, redactValue("SSH_KEY", "ssh-rsa AAAA"))
+
+	secrets.add("resolved-secret")
+	assert.Equal(t, "connecting with "+secretMask, redact("connecting with resolved-secret"))
+
+	// patterns from vinitd.log.redact
+	assert.False(t, redaction.sensitive("DATABASE_DSN"))
+	redaction.patterns = append(redaction.patterns, "*_DSN")
+	defer func() { redaction.patterns = defaultRedactPatterns }()
+	assert.True(t, redaction.sensitive("database_dsn"))
+
+	redaction.unsafe = true
+	defer func() { redaction.unsafe = false }()
+	assert.Equal(t, env[:2], redactEnv(env[:2]))
+
+}
@@ -0,0 +1,225 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// renderInterface is the template view of a network interface
+type renderInterface struct {
+	Name    string
+	Index   int
+	MAC     string
+	IP      string
+	CIDR    string
+	Netmask string
+	Gateway string
+}
+
+// renderData is passed to RENDER templates
+type renderData struct {
+	// program environment
+	Env map[string]string
+
+	// hypervisor and cloud values, e.g. EXT_IP0, HOSTNAME
+	Cloud map[string]string
+
+	Hypervisor string
+	Provider   string
+	Hostname   string
+
+	// configured interfaces sorted by index
+	Interfaces []renderInterface
+
+	DNS []string
+}
+
+var (
+	renderFuncs = template.FuncMap{
+		"default": func(def string, val interface{}) string {
+			s := fmt.Sprint(val)
+			if val == nil || s == "" || s == "<no value>" {
+				return def
+			}
+			return s
+		},
+		"split":     strings.Split,
+		"join":      strings.Join,
+		"upper":     strings.ToUpper,
+		"lower":     strings.ToLower,
+		"trim":      strings.TrimSpace,
+		"replace":   strings.ReplaceAll,
+		"contains":  strings.Contains,
+		"hasPrefix": strings.HasPrefix,
+		"hasSuffix": strings.HasSuffix,
+		"quote": func(s string) string {
+			return fmt.Sprintf("%q", s)
+		},
+	}
+)
+
+func init() {
+	registerBootstrap(bootstrapRender, bootstrapRenderTemplate)
+}
+
+// envMap converts KEY=VALUE pairs into a map, later values win
+func envMap(env []string) map[string]string {
+
+	m := make(map[string]string)
+	for _, e := range env {
+		s := strings.SplitN(e, "=", 2)
+		if len(s) == 2 {
+			m[s[0]] = s[1]
+		}
+	}
+
+	return m
+}
+
+func newRenderData(p *program) *renderData {
+
+	d := &renderData{
+		Env:   envMap(p.env),
+		Cloud: make(map[string]string),
+	}
+
+	v := p.vinitd
+	if v == nil {
+		return d
+	}
+
+	for k, val := range v.hypervisorInfo.envs {
+		d.Cloud[k] = val
+	}
+
+	d.Hypervisor = v.hypervisorInfo.hypervisorString()
+	d.Provider = v.hypervisorInfo.cloudString()
+	d.Hostname = v.hostname
+
+	for _, i := range v.ifcs {
+		ri := renderInterface{
+			Name:  i.name,
+			Index: i.idx,
+			MAC:   i.netIfc.HardwareAddr.String(),
+		}
+		if i.addr != nil {
+			ri.IP = i.addr.IP.String()
+			ri.CIDR = i.addr.String()
+			ri.Netmask = net.IP(i.addr.Mask).String()
+		}
+		if i.gw != nil {
+			ri.Gateway = i.gw.String()
+		}
+		d.Interfaces = append(d.Interfaces, ri)
+	}
+
+	sort.Slice(d.Interfaces, func(a, b int) bool {
+		return d.Interfaces[a].Index < d.Interfaces[b].Index
+	})
+
+	for _, ip := range v.dns {
+		d.DNS = append(d.DNS, ip.String())
+	}
+
+	return d
+}
+
+// renderTemplate executes the template in src with the data of the program
+func renderTemplate(src string, p *program) ([]byte, error) {
+
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New(filepath.Base(src)).
+		Funcs(renderFuncs).
+		Option("missingkey=zero").
+		Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, newRenderData(p))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bootstrapRenderTemplate renders a text/template file to a destination,
+// e.g. RENDER /etc/nginx.tmpl /etc/nginx.conf mode=0600 owner=nginx
+func bootstrapRenderTemplate(ctx context.Context, args []string, p *program) error {
+
+	args, kv := keyValues(args, "mode", "owner")
+
+	if len(args) != 2 {
+		return fmt.Errorf("bootstrap 'RENDER' needs template and destination")
+	}
+
+	mode := os.FileMode(0644)
+	if m, ok := kv["mode"]; ok {
+		var err error
+		mode, err = parseMode(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := renderTemplate(args[0], p)
+	if err != nil {
+		return fmt.Errorf("can not render %s: %v", args[0], err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(args[1]), 0755)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, the application must not see
+	// half written configs
+	tmp, err := ioutil.TempFile(filepath.Dir(args[1]), ".render")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return err
+	}
+
+	if o, ok := kv["owner"]; ok {
+		uid, gid, err := lookupOwner(o)
+		if err != nil {
+			return err
+		}
+		err = os.Chown(tmp.Name(), uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), args[1])
+}
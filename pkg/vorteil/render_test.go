@@ -0,0 +1,69 @@
+package vorteil
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTemplate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "render")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, ipnet, _ := net.ParseCIDR("10.0.2.0/24")
+	ipnet.IP = net.ParseIP("10.0.2.15")
+
+	v := &Vinitd{
+		hostname: "web",
+		hypervisorInfo: hv{
+			envs: map[string]string{"EXT_IP0": "1.2.3.4"},
+		},
+		ifcs: map[string]*ifc{
+			"eth0": {name: "eth0", idx: 0, addr: ipnet, gw: net.ParseIP("10.0.2.2")},
+		},
+		dns: []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1")},
+	}
+
+	p := &program{
+		vinitd: v,
+		env:    []string{"PORT=8080", "DEBUG="},
+	}
+
+	tmpl := filepath.Join(dir, "nginx.tmpl")
+	err = ioutil.WriteFile(tmpl, []byte(`server_name {{ .Hostname }};
+{{ range .Interfaces }}listen {{ .IP }}:{{ $.Env.PORT }}; # {{ .Netmask }} via {{ .Gateway }}
+{{ end }}workers {{ .Env.WORKERS | default "4" }};
+{{ if .Env.DEBUG }}debug;{{ else }}quiet;{{ end }}
+resolver {{ join .DNS " " }};
+`), 0644)
+	assert.NoError(t, err)
+
+	dest := filepath.Join(dir, "conf", "nginx.conf")
+	err = bootstrapRenderTemplate(context.Background(), []string{tmpl, dest, "mode=0600"}, p)
+	assert.NoError(t, err)
+
+	b, err := ioutil.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, `server_name web;
+listen 10.0.2.15:8080; # 255.255.255.0 via 10.0.2.2
+workers 4;
+quiet;
+resolver 8.8.8.8 1.1.1.1;
+`, string(b))
+
+	fi, err := os.Stat(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	err = ioutil.WriteFile(tmpl, []byte(`{{ .Env.PORT `), 0644)
+	assert.NoError(t, err)
+	assert.Error(t, bootstrapRenderTemplate(context.Background(), []string{tmpl, dest}, p))
+
+}
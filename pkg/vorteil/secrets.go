@@ -0,0 +1,309 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	secretScheme = "secret://"
+
+	// kernel cmdline key with the base64 encoded AES-256 key for userdata
+	// secrets, e.g. vinitd.secrets.key=...
+	secretKeyCmdLine = "vinitd.secrets.key"
+
+	// userdata key with the encrypted secrets
+	envSecrets = "VINITD_SECRETS"
+
+	secretMask = "******"
+
+	// shorter values are not masked in all log messages, replacing values
+	// like 1 or on garbles unrelated text. environment values with
+	// sensitive names are masked anyway.
+	secretMinLength = 6
+
+	secretRequestTimeout = 30 * time.Second
+)
+
+// secretRef is a parsed reference like secret://aws/db-credentials#password
+type secretRef struct {
+	provider string
+	path     string
+
+	// optional key if the secret is a JSON object
+	key string
+}
+
+func (r *secretRef) String() string {
+	return fmt.Sprintf("%s%s/%s", secretScheme, r.provider, r.path)
+}
+
+// secretProvider returns the raw value of a secret
+type secretProvider func(ref *secretRef, v *Vinitd) (string, error)
+
+// secretStore caches resolved secrets and remembers values to mask them in
+// logs
+type secretStore struct {
+	mtx    sync.Mutex
+	cache  map[string]string
+	values map[string]bool
+}
+
+var (
+	secretProviders = make(map[string]secretProvider)
+
+	secrets = &secretStore{
+		cache:  make(map[string]string),
+		values: make(map[string]bool),
+	}
+
+	secretClient = &http.Client{
+		Timeout: secretRequestTimeout,
+	}
+)
+
+func registerSecretProvider(name string, p secretProvider) {
+	secretProviders[name] = p
+}
+
+func init() {
+	registerSecretProvider("file", fileSecret)
+	registerSecretProvider("userdata", userdataSecret)
+}
+
+func isSecretRef(s string) bool {
+	return strings.HasPrefix(s, secretScheme)
+}
+
+func parseSecretRef(s string) (*secretRef, error) {
+
+	s = strings.TrimPrefix(s, secretScheme)
+
+	ref := &secretRef{}
+
+	if i := strings.LastIndex(s, "#"); i >= 0 {
+		ref.key = s[i+1:]
+		s = s[:i]
+	}
+
+	ps := strings.SplitN(s, "/", 2)
+	if len(ps) != 2 || ps[0] == "" || ps[1] == "" {
+		return nil, fmt.Errorf("secret reference needs provider and path")
+	}
+
+	ref.provider, ref.path = ps[0], ps[1]
+
+	return ref, nil
+}
+
+// resolve returns the value of a secret reference
+func (s *secretStore) resolve(ref *secretRef, v *Vinitd) (string, error) {
+
+	p, ok := secretProviders[ref.provider]
+	if !ok {
+		return "", fmt.Errorf("unknown secret provider '%s'", ref.provider)
+	}
+
+	s.mtx.Lock()
+	raw, ok := s.cache[ref.String()]
+	s.mtx.Unlock()
+
+	if !ok {
+		var err error
+		raw, err = p(ref, v)
+		if err != nil {
+			return "", fmt.Errorf("can not get %s: %v", ref, err)
+		}
+		s.mtx.Lock()
+		s.cache[ref.String()] = raw
+		s.mtx.Unlock()
+	}
+
+	val := raw
+	if ref.key != "" {
+		var m map[string]interface{}
+		err := json.Unmarshal([]byte(raw), &m)
+		if err != nil {
+			return "", fmt.Errorf("%s is not a JSON object", ref)
+		}
+		kv, ok := m[ref.key]
+		if !ok {
+			return "", fmt.Errorf("%s has no key %s", ref, ref.key)
+		}
+		val = fmt.Sprint(kv)
+	}
+
+	s.add(val)
+
+	return val, nil
+}
+
+// add remembers a value to mask
+func (s *secretStore) add(val string) {
+
+	if len(val) < secretMinLength {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.values[val] = true
+}
+
+// mask replaces all known secret values in s
+func (s *secretStore) mask(str string) string {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for val := range s.values {
+		str = strings.ReplaceAll(str, val, secretMask)
+	}
+
+	return str
+}
+
+// resolveSecrets replaces environment values starting with secret:// with
+// the secret
+func (v *Vinitd) resolveSecrets(env []string) ([]string, error) {
+
+	var out []string
+
+	for _, e := range env {
+
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			out = append(out, e)
+			continue
+		}
+
+		// encrypted secrets are not passed to applications
+		if kv[0] == envSecrets {
+			continue
+		}
+
+		if !isSecretRef(kv[1]) {
+			out = append(out, e)
+			continue
+		}
+
+		ref, err := parseSecretRef(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", kv[0], err)
+		}
+
+		val, err := secrets.resolve(ref, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", kv[0], err)
+		}
+
+		logDebug("resolved secret %s from %s", kv[0], ref.provider)
+		out = append(out, fmt.Sprintf(environString, kv[0], val))
+	}
+
+	return out, nil
+}
+
+// fileSecret reads a secret from a file, e.g. on an attached disk:
+// secret://file/secrets/db-password
+func fileSecret(ref *secretRef, v *Vinitd) (string, error) {
+
+	b, err := ioutil.ReadFile("/" + strings.TrimPrefix(ref.path, "/"))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// userdataKey returns the key for userdata secrets from the kernel cmdline
+func userdataKey() ([]byte, error) {
+
+	k, ok := cmdLineValue(secretKeyCmdLine)
+	if !ok {
+		return nil, fmt.Errorf("%s not set", secretKeyCmdLine)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(k)
+	if err != nil {
+		return nil, fmt.Errorf("can not decode %s: %v", secretKeyCmdLine, err)
+	}
+
+	return key, nil
+}
+
+// decryptSecrets decrypts base64 encoded nonce and AES-GCM ciphertext into a
+// JSON object of secrets
+func decryptSecrets(data string, key []byte) (map[string]string, error) {
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted secrets too short")
+	}
+
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string)
+	err = json.Unmarshal(plain, &m)
+
+	return m, err
+}
+
+// userdataSecret returns a secret from the encrypted VINITD_SECRETS value in
+// the userdata: secret://userdata/db-password
+func userdataSecret(ref *secretRef, v *Vinitd) (string, error) {
+
+	data, ok := v.hypervisorInfo.envs[envSecrets]
+	if !ok {
+		return "", fmt.Errorf("no %s in userdata", envSecrets)
+	}
+
+	key, err := userdataKey()
+	if err != nil {
+		return "", err
+	}
+
+	m, err := decryptSecrets(data, key)
+	if err != nil {
+		return "", fmt.Errorf("can not decrypt secrets: %v", err)
+	}
+
+	for k, val := range m {
+		secrets.add(val)
+		if k == ref.path {
+			return val, nil
+		}
+	}
+
+	return "", fmt.Errorf("secret not found")
+}
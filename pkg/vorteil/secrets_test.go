@@ -0,0 +1,144 @@
+package vorteil
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecretRef(t *testing.T) {
+
+	ref, err := parseSecretRef("secret://aws/prod/db#password")
+	assert.NoError(t, err)
+	assert.Equal(t, &secretRef{provider: "aws", path: "prod/db", key: "password"}, ref)
+
+	ref, err = parseSecretRef("secret://file/data/token")
+	assert.NoError(t, err)
+	assert.Equal(t, &secretRef{provider: "file", path: "data/token"}, ref)
+
+	_, err = parseSecretRef("secret://aws")
+	assert.Error(t, err)
+
+}
+
+func TestResolveSecrets(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "secrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "db.json")
+	err = ioutil.WriteFile(f, []byte(`{"user": "app", "password": "s3cr3t"}`+"\n"), 0600)
+	assert.NoError(t, err)
+
+	v := &Vinitd{}
+	env, err := v.resolveSecrets([]string{
+		"PATH=/bin",
+		"DB_PASSWORD=secret://file" + f + "#password",
+		envSecrets + "=encrypted",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"PATH=/bin", "DB_PASSWORD=s3cr3t"}, env)
+
+	assert.Equal(t, []string{"PATH=/bin", "DB_PASSWORD=" + secretMask}, redactEnv(env))
+
+	// short values do not garble other log messages
+	secrets.add("on")
+	assert.Equal(t, "connection open", secrets.mask("connection open"))
+	assert.Equal(t, "using "+secretMask, secrets.mask("using s3cr3t"))
+
+	_, err = v.resolveSecrets([]string{"X=secret://file" + f + "#missing"})
+	assert.Error(t, err)
+
+	_, err = v.resolveSecrets([]string{"X=secret://vault/x"})
+	assert.Error(t, err)
+
+}
+
+func TestDecryptSecrets(t *testing.T) {
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+
+	plain, _ := json.Marshal(map[string]string{"api-key": "abc"})
+	data := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil))
+
+	m, err := decryptSecrets(data, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", m["api-key"])
+
+	rand.Read(key)
+	_, err = decryptSecrets(data, key)
+	assert.Error(t, err)
+
+}
+
+func TestAWSSecret(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("role"))
+		case "/latest/meta-data/iam/security-credentials/role":
+			w.Write([]byte(`{"AccessKeyId": "AKID", "SecretAccessKey": "SECRET", "Token": "TOKEN"}`))
+		case "/latest/meta-data/placement/region":
+			w.Write([]byte("eu-west-1"))
+		case "/eu-west-1":
+			auth := r.Header.Get("Authorization")
+			if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" ||
+				r.Header.Get("X-Amz-Security-Token") != "TOKEN" ||
+				!strings.HasPrefix(auth, awsAlgorithm+" Credential=AKID/") ||
+				!strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			assert.JSONEq(t, `{"SecretId": "db"}`, string(b))
+			w.Write([]byte(`{"SecretString": "{\"password\": \"pw\"}"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	server, endpoint := fetchMetadataServer, awsSecretsEndpoint
+	fetchMetadataServer, awsSecretsEndpoint = srv.URL, srv.URL+"/%s"
+	defer func() {
+		fetchMetadataServer, awsSecretsEndpoint = server, endpoint
+	}()
+
+	val, err := secrets.resolve(&secretRef{provider: "aws", path: "db", key: "password"}, &Vinitd{})
+	assert.NoError(t, err)
+	assert.Equal(t, "pw", val)
+
+}
+
+func TestAWSSign(t *testing.T) {
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	awsSign(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	// get-vanilla from the AWS signature version 4 test suite
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+
+}
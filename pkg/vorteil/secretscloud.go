@@ -0,0 +1,327 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsCredentialsPath = "/latest/meta-data/iam/security-credentials/"
+	awsRegionPath      = "/latest/meta-data/placement/region"
+
+	awsAlgorithm = "AWS4-HMAC-SHA256"
+	awsTimeFmt   = "20060102T150405Z"
+
+	gcpProjectURL = "%s/computeMetadata/v1/project/project-id"
+
+	azureVaultResource = "https://vault.azure.net"
+)
+
+var (
+	// endpoints, %s is the region, the path or the vault
+	awsSecretsEndpoint = "https://secretsmanager.%s.amazonaws.com/"
+	gcpSecretsEndpoint = "https://secretmanager.googleapis.com/v1/%s:access"
+	azureVaultEndpoint = "https://%s.vault.azure.net"
+)
+
+func init() {
+	registerSecretProvider("aws", awsSecret)
+	registerSecretProvider("gcp", gcpSecret)
+	registerSecretProvider("azure", azureSecret)
+}
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+}
+
+// awsInstanceCredentials returns the credentials of the instance role
+func awsInstanceCredentials() (*awsCredentials, error) {
+
+	role, err := imdsGet(fetchMetadataServer, awsCredentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("no instance role: %v", err)
+	}
+
+	r, err := imdsGet(fetchMetadataServer, awsCredentialsPath+strings.Split(role, "\n")[0])
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &awsCredentials{}
+	err = json.Unmarshal([]byte(r), creds)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets.add(creds.SecretAccessKey)
+	secrets.add(creds.Token)
+
+	return creds, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	s := sha256.Sum256(b)
+	return hex.EncodeToString(s[:])
+}
+
+// awsSign signs a request without query parameters with signature version 4
+func awsSign(req *http.Request, body []byte, creds *awsCredentials, region, service string, t time.Time) {
+
+	amzDate := t.UTC().Format(awsTimeFmt)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(fmt.Sprintf("%s:%s\n", k, headers[k]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+
+	stringToSign := strings.Join([]string{
+		awsAlgorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsAlgorithm, creds.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+
+}
+
+// secretRequest runs the request and returns the body if the status is 200
+func secretRequest(req *http.Request) ([]byte, error) {
+
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+
+	return b, nil
+}
+
+// awsSecret gets a secret from AWS Secrets Manager with the instance role:
+// secret://aws/db-credentials or secret://aws/arn:aws:secretsmanager:...
+func awsSecret(ref *secretRef, v *Vinitd) (string, error) {
+
+	creds, err := awsInstanceCredentials()
+	if err != nil {
+		return "", err
+	}
+
+	region, err := imdsGet(fetchMetadataServer, awsRegionPath)
+	if err != nil {
+		return "", fmt.Errorf("can not get region: %v", err)
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": ref.path})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(awsSecretsEndpoint, region), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	awsSign(req, body, creds, region, "secretsmanager", time.Now())
+
+	b, err := secretRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	var r struct {
+		SecretString string
+		SecretBinary []byte
+	}
+
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return "", err
+	}
+
+	if r.SecretString == "" && len(r.SecretBinary) > 0 {
+		return string(r.SecretBinary), nil
+	}
+
+	return r.SecretString, nil
+}
+
+// gcpSecret gets a secret from GCP Secret Manager with the service account
+// of the instance: secret://gcp/db-password, secret://gcp/project/db-password
+// or secret://gcp/project/db-password/3. The version defaults to latest.
+func gcpSecret(ref *secretRef, v *Vinitd) (string, error) {
+
+	ps := strings.Split(ref.path, "/")
+	if len(ps) > 3 {
+		return "", fmt.Errorf("invalid secret path %s", ref.path)
+	}
+
+	if len(ps) == 1 {
+		project, err := doMetadataRequest(fmt.Sprintf(gcpProjectURL, fetchMetadataServer), gcpMetadataHeader, nil)
+		if err != nil {
+			return "", fmt.Errorf("can not get project: %v", err)
+		}
+		ps = append([]string{project}, ps...)
+	}
+
+	if len(ps) == 2 {
+		ps = append(ps, "latest")
+	}
+
+	token, err := metadataToken(authGCP, "")
+	if err != nil {
+		return "", err
+	}
+	secrets.add(token)
+
+	name := fmt.Sprintf("projects/%s/secrets/%s/versions/%s", url.PathEscape(ps[0]),
+		url.PathEscape(ps[1]), url.PathEscape(ps[2]))
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(gcpSecretsEndpoint, name), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	b, err := secretRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	var r struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return "", err
+	}
+
+	val, err := base64.StdEncoding.DecodeString(r.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(val), nil
+}
+
+// azureSecret gets a secret from Azure Key Vault with the managed identity of
+// the instance: secret://azure/vault/db-password[/version]
+func azureSecret(ref *secretRef, v *Vinitd) (string, error) {
+
+	ps := strings.Split(ref.path, "/")
+	if len(ps) < 2 || len(ps) > 3 {
+		return "", fmt.Errorf("secret path needs vault and name")
+	}
+
+	token, err := metadataToken(authAzure, azureVaultResource)
+	if err != nil {
+		return "", err
+	}
+	secrets.add(token)
+
+	u := fmt.Sprintf(azureVaultEndpoint, ps[0]) + "/secrets/" + url.PathEscape(ps[1])
+	if len(ps) == 3 {
+		u += "/" + url.PathEscape(ps[2])
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u+"?api-version=7.0", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	b, err := secretRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	var r struct {
+		Value string `json:"value"`
+	}
+
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return "", err
+	}
+
+	return r.Value, nil
+}
@@ -0,0 +1,265 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// time processes get after SIGTERM in killAll before SIGKILL
+	killGracePeriod = 2 * time.Second
+
+	// pre-stop hooks of programs without timeout
+	preStopDefaultTimeout = 10 * time.Second
+)
+
+// programName returns the base name of the program's binary
+func programName(p *program) string {
+
+	pArgs, err := p.vcfgProg.ProgramArgs()
+	if err != nil || len(pArgs) == 0 {
+		return ""
+	}
+
+	return filepath.Base(pArgs[0])
+}
+
+// stopOrder groups programs into rounds. Programs in one round can be stopped
+// in parallel, all programs depending on a program are in earlier rounds.
+// Programs in dependency cycles are stopped together in the last round.
+func stopOrder(progs []*program) [][]*program {
+
+	byName := make(map[string][]*program)
+	for _, p := range progs {
+		byName[strconv.Itoa(p.progIndex)] = append(byName[strconv.Itoa(p.progIndex)], p)
+		if n := programName(p); n != "" {
+			byName[n] = append(byName[n], p)
+		}
+	}
+
+	// number of programs depending on a program
+	dependents := make(map[*program]int)
+	depends := make(map[*program][]*program)
+
+	for _, p := range progs {
+		seen := make(map[*program]bool)
+		for _, d := range p.opts.depends {
+			dps, ok := byName[d]
+			if !ok {
+				logWarn("program[%d] depends on unknown program %s", p.progIndex, d)
+				continue
+			}
+			for _, dp := range dps {
+				if dp == p || seen[dp] {
+					continue
+				}
+				seen[dp] = true
+				depends[p] = append(depends[p], dp)
+				dependents[dp]++
+			}
+		}
+	}
+
+	var (
+		rounds [][]*program
+		left   = append([]*program(nil), progs...)
+	)
+
+	for len(left) > 0 {
+
+		var round, next []*program
+		for _, p := range left {
+			if dependents[p] == 0 {
+				round = append(round, p)
+			} else {
+				next = append(next, p)
+			}
+		}
+
+		if len(round) == 0 {
+			logWarn("dependency cycle between programs, stopping them together")
+			rounds = append(rounds, next)
+			break
+		}
+
+		for _, p := range round {
+			for _, dp := range depends[p] {
+				dependents[dp]--
+			}
+		}
+
+		rounds = append(rounds, round)
+		left = next
+	}
+
+	return rounds
+}
+
+func (p *program) running() bool {
+
+	if p.cmd == nil || p.cmd.Process == nil {
+		return false
+	}
+
+	select {
+	case <-p.exitChannel:
+		return false
+	default:
+	}
+
+	return p.cmd.ProcessState.ExitCode() < 0
+}
+
+// runHook executes a command with the environment, working directory and
+// user of the program
+func (p *program) runHook(name string, args, env []string, timeout time.Duration) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logAlways("program[%d] - running %s hook %v", p.progIndex, name, args)
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Dir = p.vcfgProg.Cwd
+	if p.cmd != nil && p.cmd.SysProcAttr != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: p.cmd.SysProcAttr.Credential,
+		}
+	}
+
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		logAlways("%s", string(out))
+	}
+	// the reaper might have collected the hook already
+	if err != nil && !errors.Is(err, syscall.ECHILD) {
+		logError("program[%d] - %s hook failed: %v", p.progIndex, name, err)
+	}
+
+}
+
+// runPreStop executes the VINITD_PRE_STOP command of the program
+func (p *program) runPreStop(timeout time.Duration) {
+
+	if len(p.opts.preStop) == 0 {
+		return
+	}
+
+	if timeout == 0 {
+		timeout = preStopDefaultTimeout
+	}
+
+	p.runHook("pre-stop", p.opts.preStop, p.env, timeout)
+}
+
+// stopBudget returns the time to stop all programs, the longest stop
+// timeout of a program or the terminate wait
+func stopBudget(progs []*program) time.Duration {
+
+	budget := terminateWait
+	for _, p := range progs {
+		if p.opts.stopTimeout > budget {
+			budget = p.opts.stopTimeout
+		}
+	}
+
+	return budget
+}
+
+// stopTimeout returns the stop timeout of the program, limited by the
+// deadline of the shutdown and of an interruption
+func (p *program) stopTimeout() time.Duration {
+
+	timeout := terminateWait
+	if p.opts.stopTimeout > 0 {
+		timeout = p.opts.stopTimeout
+	}
+
+	for _, d := range []time.Time{terminateDeadline, stopDeadline} {
+
+		if d.IsZero() {
+			continue
+		}
+
+		if left := time.Until(d); left < timeout {
+			timeout = left
+		}
+
+		// the program gets at least the signal
+		if timeout < time.Second {
+			timeout = time.Second
+		}
+	}
+
+	return timeout
+}
+
+// stop runs the pre-stop hook, sends the terminate signal and kills the
+// program if it has not finished within its stop timeout
+func (p *program) stop(sig syscall.Signal) {
+
+	if !p.running() {
+		return
+	}
+
+	// the pre-stop hook and the program share the stop timeout
+	timeout := p.stopTimeout()
+	deadline := time.Now().Add(timeout)
+
+	p.runPreStop(timeout)
+
+	if !p.running() {
+		return
+	}
+
+	if timeout = time.Until(deadline); timeout < time.Second {
+		timeout = time.Second
+	}
+
+	logAlways("program[%d] pid[%d] - sending signal '%s'", p.progIndex, p.cmd.Process.Pid, sig)
+
+	if err := p.cmd.Process.Signal(sig); err != nil {
+		logError("could not send terminate signal program %v, error: %v", p.cmd.Process.Pid, err)
+	}
+
+	select {
+	case <-p.exitChannel:
+		return
+	case <-time.After(timeout):
+	}
+
+	logWarn("program[%d] pid[%d] - did not terminate within %v, killing it", p.progIndex, p.cmd.Process.Pid, timeout)
+	p.cmd.Process.Signal(syscall.SIGKILL)
+
+	select {
+	case <-p.exitChannel:
+	case <-time.After(time.Second):
+	}
+
+}
+
+func launchedPrograms() []*program {
+
+	var progs []*program
+	for p := range terminateSignals {
+		progs = append(progs, p)
+	}
+
+	sort.Slice(progs, func(i, j int) bool {
+		return progs[i].progIndex < progs[j].progIndex
+	})
+
+	return progs
+}
@@ -36,6 +36,17 @@ const (
 	bootstrapWaitFile = "WAIT_FILE"
 	bootstrapWaitPort = "WAIT_PORT"
 	bootstrapGet      = "GET"
+	bootstrapWaitDNS  = "WAIT_DNS"
+	bootstrapWaitHTTP = "WAIT_HTTP"
+	bootstrapExec     = "EXEC"
+
+	bootstrapMkdir     = "MKDIR"
+	bootstrapChown     = "CHOWN"
+	bootstrapChmod     = "CHMOD"
+	bootstrapWriteFile = "WRITE_FILE"
+	bootstrapSymlink   = "SYMLINK"
+	bootstrapUntar     = "UNTAR"
+	bootstrapRender    = "RENDER"
 )
 
 const (
@@ -50,6 +61,8 @@ const (
 
 	envRegion     = "CLOUD_REGION"
 	envInstanceID = "CLOUD_INSTANCE_ID"
+	envTag        = "CLOUD_TAG_%s"
+	envSSHKeys    = "CLOUD_SSH_KEYS"
 )
 
 const (
@@ -77,12 +90,22 @@ var (
 		cpGCP:     "GCP",
 		cpAzure:   "AZURE",
 		cpEC2:     "EC2",
+
+		cpDigitalOcean: "DIGITALOCEAN",
+		cpOracle:       "ORACLE",
+		cpOpenStack:    "OPENSTACK",
+		cpHetzner:      "HETZNER",
+		cpNoCloud:      "NOCLOUD",
+		cpVMware:       "VMWARE",
 	}
 
 	initStatus = statusSetup
 
 	terminateSignals = map[*program]syscall.Signal{}
 	terminateWait    = time.Duration(0)
+
+	// deadline of stopping all programs on shutdown
+	terminateDeadline time.Time
 )
 
 const (
@@ -91,6 +114,13 @@ const (
 	cpGCP     cloud = iota
 	cpEC2     cloud = iota
 	cpAzure   cloud = iota
+
+	cpDigitalOcean cloud = iota
+	cpOracle       cloud = iota
+	cpOpenStack    cloud = iota
+	cpHetzner      cloud = iota
+	cpNoCloud      cloud = iota
+	cpVMware       cloud = iota
 )
 
 type ifc struct {
@@ -105,6 +135,12 @@ type hv struct {
 	hypervisor hypervisor
 	cloud      cloud
 	envs       map[string]string
+
+	// metadata provider of the detected cloud
+	provider CloudProvider
+
+	// environment variables of the provider's metadata
+	metadata map[string]string
 }
 
 // Vinitd contains all information to run and manage this instance
@@ -134,6 +170,9 @@ type Vinitd struct {
 	instantShutdown bool
 
 	searchDomains []string
+
+	// attached NoCloud or OpenStack config drive
+	configDrive *configDrive
 }
 
 type program struct {
@@ -152,6 +191,15 @@ type program struct {
 	vinitd *Vinitd
 
 	reaper bool
+
+	// VINITD_ options from the environment
+	opts programOptions
+
+	// launch failed and the failure policy decided to continue
+	failed bool
+
+	// added by cloud-init userdata, failures are handled like cloud-init's
+	cloudInit bool
 }
 
 // GPTHeader for disk expansion
@@ -9,12 +9,17 @@ import (
 	"encoding/binary"
 	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 const (
 	procFile = "/proc/uptime"
+
+	// runtime data of vinitd, e.g. job output
+	runBaseDir = "/run/vorteil"
 )
 
 func uniqueIPs(ipSlice []net.IP) []net.IP {
@@ -29,6 +34,12 @@ func uniqueIPs(ipSlice []net.IP) []net.IP {
 	return list
 }
 
+// runDir returns a directory under /run/vorteil and creates it if required
+func runDir(elem ...string) (string, error) {
+	dir := filepath.Join(append([]string{runBaseDir}, elem...)...)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
 func min(x, y uint32) uint32 {
 	if x < y {
 		return x
@@ -43,6 +54,24 @@ func max(x, y int) int {
 	return x
 }
 
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(list []net.IP, ip net.IP) bool {
+	for _, e := range list {
+		if e.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func ip2networkInt(ip net.IP) uint32 {
 	if len(ip) == 16 {
 		return binary.LittleEndian.Uint32(ip[12:16])
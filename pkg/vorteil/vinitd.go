@@ -42,6 +42,9 @@ type networkSetting struct {
 	Gateway string `json:"gw"`
 }
 
+// kernel command line, a variable for tests
+var cmdLineFile = "/proc/cmdline"
+
 // flux disks
 var uuidPlain = [16]byte{0x7d, 0x44, 0x48, 0x40, 0x9d, 0xc0, 0x11, 0xd1, 0xb2, 0x45, 0x5f, 0xfd, 0xce, 0x74, 0xfa, 0xd3}
 
@@ -57,17 +60,19 @@ func New() *Vinitd {
 	// hypervisor and vorteil special envse.g. IP_0, EXT_HOSTNAME
 	v.hypervisorInfo.envs = make(map[string]string)
 
+	debugVinitd = v
+
 	return v
 
 }
 
 func hasCmdLineString(ss string) bool {
 
-	cmd, err := ioutil.ReadFile("/proc/cmdline")
+	cmd, err := ioutil.ReadFile(cmdLineFile)
 	if err != nil {
 		return false
 	}
-	logDebug("cmdline: %s", string(cmd))
+	logDebug("cmdline: %s", strings.Join(redactEnv(strings.Fields(string(cmd))), " "))
 	logDebug("check cmdline for string: %v", ss)
 
 	// check if it is set to ro, remove newline from the end before splitting
@@ -81,6 +86,25 @@ func hasCmdLineString(ss string) bool {
 	return false
 }
 
+// cmdLineValue returns the value of a key=value option in the kernel cmdline
+func cmdLineValue(key string) (string, bool) {
+
+	cmd, err := ioutil.ReadFile(cmdLineFile)
+	if err != nil {
+		return "", false
+	}
+
+	prefix := fmt.Sprintf("%s=", key)
+	for _, o := range strings.Fields(string(cmd)) {
+		if strings.HasPrefix(o, prefix) {
+			logDebug("found value in cmdline for %s", key)
+			return strings.TrimPrefix(o, prefix), true
+		}
+	}
+
+	return "", false
+}
+
 func setupMountOptions(diskname string, readOnly bool) error {
 
 	var (
@@ -191,6 +215,11 @@ func (v *Vinitd) PreSetup() error {
 		logError("can not setup mount options: %s", err.Error())
 	}
 
+	err = setupRunDir(runBaseDir)
+	if err != nil {
+		logError("can not setup %s: %s", runBaseDir, err.Error())
+	}
+
 	// mount /tmp as memory fs if read-only
 	if hasCmdLineString("direktiv") {
 
@@ -270,6 +299,11 @@ func (v *Vinitd) PreSetup() error {
 	if err != nil {
 		return err
 	}
+
+	// static network settings and hostname of a config drive are needed
+	// in setup
+	v.loadConfigDrive()
+
 	logDebug("pre-setup finished successfully")
 
 	terminateWait = time.Duration(v.vcfg.System.TerminateWait) * time.Millisecond
@@ -341,7 +375,9 @@ func (v *Vinitd) Setup() error {
 
 	go func() {
 		if !v.readOnly {
-			err = etcGenerateFiles(v.hostname, v.user)
+			err := handleFailure(failureSystem, func() error {
+				return etcGenerateFiles(v.hostname, v.user)
+			})
 			if err != nil {
 				logError("error creating etc files: %s", err.Error())
 				errors <- err
@@ -367,32 +403,10 @@ func (v *Vinitd) Setup() error {
 
 	// we have to write resolve conf if there are search domains from dhcp
 	if len(v.searchDomains) > 0 {
-		rc, err := ioutil.ReadFile("/etc/resolv.conf")
-		if err != nil {
-			return err
-		}
-
-		var sb strings.Builder
-
-		sb.WriteString(string(rc))
-		sb.WriteString("options edns0\n")
-		sb.WriteString("search")
-
-		for _, s := range v.searchDomains {
-			sb.WriteString(fmt.Sprintf(" %s", s))
-		}
-		sb.WriteByte('\n')
-
-		f, err := os.OpenFile("/etc/resolv.conf", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		err := writeSearchDomains(v.searchDomains)
 		if err != nil {
 			return err
 		}
-		_, err = f.WriteString(sb.String())
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
 	}
 
 	// if hostname rewritten, update it
@@ -404,7 +418,10 @@ func (v *Vinitd) Setup() error {
 	}
 
 	for i, p := range v.vcfg.Programs {
-		v.prepProgram(p, i)
+		err := v.prepProgram(p, i)
+		if err != nil {
+			return err
+		}
 	}
 
 	logDebug("system setup successful")
@@ -415,9 +432,30 @@ func (v *Vinitd) Setup() error {
 // PostSetup finishes tasks which need network access which is DNS, NFS and NTP
 func (v *Vinitd) PostSetup() error {
 
-	// start a DNS on 127.0.0.1
 	basicEnv(v)
-	err := v.startDNS(defaultDNSAddr, true)
+
+	// get cloud information first, cloud-init userdata can change hostname,
+	// DNS, NTP and add programs
+	bios, err := ioutil.ReadFile("/sys/devices/virtual/dmi/id/bios_vendor")
+	if err != nil {
+		logWarn("can not read bios vendor")
+		v.hypervisorInfo.hypervisor, v.hypervisorInfo.cloud = hvUnknown, cpUnknown
+		basicEnv(v)
+	} else {
+		v.hypervisorInfo.hypervisor, v.hypervisorInfo.cloud = hypervisorGuess(v, string(bios))
+		fetchCloudMetadata(v)
+	}
+
+	err = handleFailure(failureCloud, v.processCloudInit)
+	if err != nil {
+		SystemPanic("cloud-init failed: %s", err.Error())
+	}
+
+	// track processes of services and programs from here on
+	startProcAccounting(v.programs)
+
+	// start a DNS on 127.0.0.1
+	err = v.startDNS(defaultDNSAddr, true)
 
 	// we might be able to run
 	if err != nil {
@@ -428,8 +466,7 @@ func (v *Vinitd) PostSetup() error {
 	wgDone := make(chan bool)
 	var wg sync.WaitGroup
 
-	wg.Add(5)
-	cread := make(chan bool)
+	wg.Add(4)
 
 	go func() {
 		setupNFS(v.vcfg.NFS)
@@ -438,8 +475,6 @@ func (v *Vinitd) PostSetup() error {
 
 	go func() {
 		if len(v.vcfg.Logging) > 0 && !v.readOnly {
-			// waiting for the cloud metadata
-			<-cread
 			v.startLogging()
 		} else if len(v.vcfg.Logging) > 0 {
 			logWarn("filesystem read-only, can not start logging")
@@ -447,30 +482,9 @@ func (v *Vinitd) PostSetup() error {
 		wg.Done()
 	}()
 
-	// get cloud information
-	go func() {
-
-		defer func() {
-			wg.Done()
-			cread <- false
-		}()
-
-		bios, err := ioutil.ReadFile("/sys/devices/virtual/dmi/id/bios_vendor")
-		if err != nil {
-			logWarn("can not read bios vendor")
-			v.hypervisorInfo.hypervisor, v.hypervisorInfo.cloud = hvUnknown, cpUnknown
-			basicEnv(v)
-			return
-		}
-
-		v.hypervisorInfo.hypervisor, v.hypervisorInfo.cloud = hypervisorGuess(v, string(bios))
-		fetchCloudMetadata(v)
-
-	}()
-
 	// prepare shell if --shell is provided
 	go func() {
-		err := runBusyboxScript()
+		err := handleFailure(failureSystem, runBusyboxScript)
 		if err != nil {
 			errors <- err
 		}
@@ -479,7 +493,10 @@ func (v *Vinitd) PostSetup() error {
 
 	// Setup ChronyD NTP Server
 	go func() {
-		if err := setupChronyD(v.vcfg.System.NTP); err != nil {
+		err := handleFailure(failureNTP, func() error {
+			return setupChronyD(v.vcfg.System.NTP)
+		})
+		if err != nil {
 			errors <- err
 		}
 		wg.Done()
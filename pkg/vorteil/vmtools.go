@@ -0,0 +1,427 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// VMware guest tools, based on openbsd's vmt.c. The host sends commands on
+// the TCLO channel, the guest sends requests on short-lived RPCI channels.
+
+const (
+	vmRPCOpenRPCI = 0x49435052
+	vmRPCOpenTCLO = 0x4F4C4354
+
+	vmReplyOK    = "OK "
+	vmReplyReset = "OK ATR toolbox"
+	vmReplyError = "ERROR Unknown command"
+
+	vmStateHalt    = 1
+	vmStateReboot  = 2
+	vmStatePowerOn = 3
+	vmStateResume  = 4
+	vmStateSuspend = 5
+
+	vmGuestInfoDNSName    = 1
+	vmGuestInfoOSNameFull = 5
+	vmGuestInfoOSName     = 6
+	vmGuestInfoUptime     = 7
+	vmGuestInfoNicsV3     = 10 // INFO_IPADDRESS_V3
+
+	vmVersionUnmanaged = 0x7fffffff
+
+	// limits of the nic info of open-vm-tools
+	vmMaxNics = 16
+	vmMaxIPs  = 64
+
+	// the loop slows down until the host powered the guest on
+	vmToolsPoll      = 5 * time.Second
+	vmToolsPollStep  = 5 * time.Millisecond
+	vmToolsOpenRetry = time.Second
+
+	vmwareVendor = "VMware, Inc."
+)
+
+// rpcChannel is an open channel of the VMware RPC
+type rpcChannel interface {
+	send(data []byte) error
+
+	// receive returns nil if there is no message
+	receive() ([]byte, error)
+
+	close() error
+}
+
+// rpcTransport opens TCLO and RPCI channels, the backdoor on VMware
+type rpcTransport interface {
+	open(proto uint32) (rpcChannel, error)
+}
+
+// rpciError is a request rejected by the host
+type rpciError string
+
+func (e rpciError) Error() string {
+	return fmt.Sprintf("rpc request failed: %s", string(e))
+}
+
+// rpci sends a request on a new RPCI channel. Replies start with 1 on
+// success, the value follows.
+func rpci(t rpcTransport, req string) (string, error) {
+
+	c, err := t.open(vmRPCOpenRPCI)
+	if err != nil {
+		return "", err
+	}
+	defer c.close()
+
+	err = c.send([]byte(req))
+	if err != nil {
+		return "", err
+	}
+
+	r, err := c.receive()
+	if err != nil {
+		return "", err
+	}
+
+	reply := strings.TrimRight(string(r), "\x00")
+	if reply != "1" && !strings.HasPrefix(reply, "1 ") {
+		return "", rpciError(reply)
+	}
+
+	return strings.TrimPrefix(strings.TrimPrefix(reply, "1"), " "), nil
+}
+
+// guestInfo returns guestinfo.<key> of the VM, empty if it is not set
+func guestInfo(t rpcTransport, key string) (string, error) {
+
+	val, err := rpci(t, "info-get guestinfo."+key)
+	if _, ok := err.(rpciError); ok {
+		return "", nil
+	}
+
+	return val, err
+}
+
+// vmtoolsInfoSet sets guestinfo.<key> of the VM
+func vmtoolsInfoSet(key, value string) error {
+	_, err := rpci(newRPCTransport(), fmt.Sprintf("info-set guestinfo.%s %s", key, value))
+	return err
+}
+
+// vmNic is a network interface reported to the host
+type vmNic struct {
+	mac   string
+	addrs []*net.IPNet
+}
+
+// vmwareNics returns the interfaces with MAC address and their addresses,
+// IPv6 link-local addresses are skipped
+func vmwareNics() []vmNic {
+
+	var nics []vmNic
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nics
+	}
+
+	for _, i := range ifaces {
+
+		if i.Flags&net.FlagLoopback != 0 || len(i.HardwareAddr) == 0 {
+			continue
+		}
+
+		nic := vmNic{mac: i.HardwareAddr.String()}
+
+		addrs, _ := i.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLinkLocalUnicast() {
+				nic.addrs = append(nic.addrs, n)
+			}
+		}
+
+		nics = append(nics, nic)
+	}
+
+	return nics
+}
+
+// xdrWriter encodes the nic info
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	binary.Write(&w.Buffer, binary.BigEndian, v)
+}
+
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.Write(b)
+	w.Write(make([]byte, (4-len(b)%4)%4))
+}
+
+// nicInfo returns the XDR encoded GuestNicProto version 3 of
+// open-vm-tools' guestInfo.x. Routes, DNS, WINS and DHCP are not sent.
+func nicInfo(nics []vmNic) []byte {
+
+	const (
+		nicInfoV3     = 3
+		addrIPv4      = 1
+		addrIPv6      = 2
+		addrPreferred = 1
+	)
+
+	if len(nics) > vmMaxNics {
+		nics = nics[:vmMaxNics]
+	}
+
+	var w xdrWriter
+
+	w.uint32(nicInfoV3)
+	w.uint32(1)
+	w.uint32(uint32(len(nics)))
+
+	for _, nic := range nics {
+
+		w.opaque([]byte(nic.mac))
+
+		addrs := nic.addrs
+		if len(addrs) > vmMaxIPs {
+			addrs = addrs[:vmMaxIPs]
+		}
+
+		w.uint32(uint32(len(addrs)))
+		for _, a := range addrs {
+
+			if ip := a.IP.To4(); ip != nil {
+				w.uint32(addrIPv4)
+				w.opaque(ip)
+			} else {
+				w.uint32(addrIPv6)
+				w.opaque(a.IP.To16())
+			}
+
+			ones, _ := a.Mask.Size()
+			w.uint32(uint32(ones))
+
+			// no origin, status preferred
+			w.uint32(0)
+			w.uint32(1)
+			w.uint32(addrPreferred)
+		}
+
+		// dns, wins, dhcp4 and dhcp6 of the nic
+		for i := 0; i < 4; i++ {
+			w.uint32(0)
+		}
+	}
+
+	// routes, dns, wins, dhcp4 and dhcp6
+	for i := 0; i < 5; i++ {
+		w.uint32(0)
+	}
+
+	return w.Bytes()
+}
+
+// vmTools answers the TCLO commands of the host
+type vmTools struct {
+	transport rpcTransport
+	hostname  string
+
+	nics     func() []vmNic
+	shutdown func(cmd int)
+
+	tclo  rpcChannel
+	ping  bool
+	osSet bool
+	delay time.Duration
+}
+
+// request sends an RPCI request and logs failures
+func (t *vmTools) request(req string) {
+	if _, err := rpci(t.transport, req); err != nil {
+		logDebug("vmware request '%s' failed: %s", strings.Fields(req)[0], err.Error())
+	}
+}
+
+func (t *vmTools) stateChange(state int) {
+	t.request(fmt.Sprintf("tools.os.statechange.status 1 %d", state))
+}
+
+// updateGuestInfo sends hostname, uptime in hundredths of a second, the
+// addresses of all interfaces and the OS once
+func (t *vmTools) updateGuestInfo() {
+
+	t.request(fmt.Sprintf("SetGuestInfo  %d %s", vmGuestInfoDNSName, t.hostname))
+	t.request(fmt.Sprintf("SetGuestInfo  %d %d", vmGuestInfoUptime, int64(uptime()*100)))
+	t.request(fmt.Sprintf("SetGuestInfo  %d ", vmGuestInfoNicsV3) + string(nicInfo(t.nics())))
+
+	if !t.osSet {
+		t.request(fmt.Sprintf("SetGuestInfo  %d vorteil.io 1.0 amd64_x86", vmGuestInfoOSNameFull))
+		t.request(fmt.Sprintf("SetGuestInfo  %d other-64", vmGuestInfoOSName))
+		t.osSet = true
+	}
+}
+
+// broadcastIP sets guestinfo.ip to the first IPv4 address
+func (t *vmTools) broadcastIP() {
+
+	for _, nic := range t.nics() {
+		for _, a := range nic.addrs {
+			if a.IP.To4() != nil {
+				t.request("info-set guestinfo.ip " + a.IP.String())
+				return
+			}
+		}
+	}
+}
+
+// handle runs a TCLO command and returns the reply. The returned function
+// is called after the reply has been sent.
+func (t *vmTools) handle(cmd string) (string, func()) {
+
+	switch cmd {
+	case "reset":
+		return vmReplyReset, nil
+	case "ping":
+		t.updateGuestInfo()
+	case "Capabilities_Register":
+		t.request("vmx.capability.unified_loop toolbox")
+		// the trailing space is required
+		t.request("tools.capability.statechange ")
+		t.request(fmt.Sprintf("tools.set.version %d", vmVersionUnmanaged))
+	case "OS_PowerOn":
+		t.stateChange(vmStatePowerOn)
+		t.delay = vmToolsPoll
+	case "OS_Halt":
+		t.stateChange(vmStateHalt)
+		return vmReplyOK, func() { t.shutdown(syscall.LINUX_REBOOT_CMD_POWER_OFF) }
+	case "OS_Reboot":
+		t.stateChange(vmStateReboot)
+		return vmReplyOK, func() { t.shutdown(syscall.LINUX_REBOOT_CMD_RESTART) }
+	case "OS_Resume":
+		t.updateGuestInfo()
+		t.stateChange(vmStateResume)
+	case "OS_Suspend":
+		t.stateChange(vmStateSuspend)
+	case "Set_Option broadcastIP 1":
+		t.broadcastIP()
+	default:
+		logDebug("unknown vmware command '%s'", cmd)
+		return vmReplyError, nil
+	}
+
+	return vmReplyOK, nil
+}
+
+// poll opens the TCLO channel if required and handles one command. Without
+// command the next poll pings the host.
+func (t *vmTools) poll() error {
+
+	if t.tclo == nil {
+
+		c, err := t.transport.open(vmRPCOpenTCLO)
+		if err != nil {
+			return err
+		}
+
+		t.tclo = c
+		t.delay = 0
+
+		err = c.send([]byte(vmReplyReset))
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.ping {
+		err := t.tclo.send(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	msg, err := t.tclo.receive()
+	if err != nil {
+		return err
+	}
+
+	if len(msg) == 0 {
+		t.ping = true
+		return nil
+	}
+	t.ping = false
+
+	reply, after := t.handle(strings.TrimRight(string(msg), "\x00"))
+
+	err = t.tclo.send([]byte(reply))
+	if err != nil {
+		return err
+	}
+
+	if after != nil {
+		after()
+	}
+
+	return nil
+}
+
+// closeTCLO closes the channel after errors, it is opened again on the
+// next poll
+func (t *vmTools) closeTCLO() {
+
+	if t.tclo != nil {
+		t.tclo.close()
+	}
+
+	t.tclo = nil
+	t.ping = false
+}
+
+func (t *vmTools) run() {
+
+	for {
+
+		// slow down until the host sends the power on, prevents a busy
+		// loop if the host does not respond
+		delay := t.delay
+		if t.delay < vmToolsPoll {
+			t.delay += vmToolsPollStep
+		}
+
+		err := t.poll()
+		if err != nil {
+			logDebug("vmware tools: %s", err.Error())
+			t.closeTCLO()
+			delay = vmToolsOpenRetry
+		}
+
+		time.Sleep(delay)
+	}
+}
+
+// startVMTools answers the host's commands in the background
+func startVMTools(hostname string) {
+
+	t := &vmTools{
+		transport: newRPCTransport(),
+		hostname:  hostname,
+		nics:      vmwareNics,
+		shutdown:  shutdown,
+	}
+
+	go t.run()
+}
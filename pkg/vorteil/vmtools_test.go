@@ -0,0 +1,225 @@
+package vorteil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeChannel records sent messages and returns queued ones. RPCI
+// channels queue the reply of the transport.
+type fakeChannel struct {
+	t      *fakeTransport
+	proto  uint32
+	sent   []string
+	queue  []string
+	closed bool
+}
+
+func (c *fakeChannel) send(data []byte) error {
+	c.sent = append(c.sent, string(data))
+	if c.proto == vmRPCOpenRPCI {
+		c.queue = append(c.queue, c.t.reply(string(data)))
+	}
+	return nil
+}
+
+func (c *fakeChannel) receive() ([]byte, error) {
+	if len(c.queue) == 0 {
+		return nil, nil
+	}
+	m := c.queue[0]
+	c.queue = c.queue[1:]
+	return []byte(m), nil
+}
+
+func (c *fakeChannel) close() error {
+	c.closed = true
+	return nil
+}
+
+// fakeTransport answers RPCI requests with the guestinfo values
+type fakeTransport struct {
+	tclo      *fakeChannel
+	guestinfo map[string]string
+	requests  []string
+}
+
+func (t *fakeTransport) open(proto uint32) (rpcChannel, error) {
+	if proto == vmRPCOpenTCLO {
+		return t.tclo, nil
+	}
+	return &fakeChannel{t: t, proto: proto}, nil
+}
+
+func (t *fakeTransport) reply(req string) string {
+
+	t.requests = append(t.requests, req)
+
+	if k := strings.TrimPrefix(req, "info-get guestinfo."); k != req {
+		if val, ok := t.guestinfo[k]; ok {
+			return "1 " + val
+		}
+		return "0 No value found"
+	}
+
+	return "1 "
+}
+
+func TestNicInfo(t *testing.T) {
+
+	// one card of the former C implementation
+	expected, _ := hex.DecodeString("00000003" + "00000001" + "00000001" +
+		"00000011" + hex.EncodeToString([]byte("00:50:56:a1:be:f8")) + "000000" +
+		"00000001" + "00000001" + "00000004" + "0a00004f" + "00000018" +
+		"00000000" + "00000001" + "00000001" +
+		"00000000000000000000000000000000" +
+		"0000000000000000000000000000000000000000")
+
+	nic := vmNic{
+		mac:   "00:50:56:a1:be:f8",
+		addrs: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 79), Mask: net.CIDRMask(24, 32)}},
+	}
+
+	assert.Equal(t, expected, nicInfo([]vmNic{nic}))
+
+	// every interface and address is reported
+	nic6 := nic
+	nic6.addrs = append(nic6.addrs, &net.IPNet{IP: net.ParseIP("fd00::4f"), Mask: net.CIDRMask(64, 128)})
+	b := nicInfo([]vmNic{nic, nic6})
+	assert.Len(t, b, len(expected)+72+40)
+	assert.Equal(t, []byte{0, 0, 0, 2}, b[8:12])
+
+}
+
+func TestVMToolsTCLO(t *testing.T) {
+
+	tr := &fakeTransport{}
+	tr.tclo = &fakeChannel{t: tr, proto: vmRPCOpenTCLO, queue: []string{
+		"reset", "Capabilities_Register", "OS_PowerOn", "ping", "Set_Option broadcastIP 1", "unknown", "OS_Halt\x00",
+	}}
+
+	var shutdownCmd int
+
+	tools := &vmTools{
+		transport: tr,
+		hostname:  "vm",
+		nics: func() []vmNic {
+			return []vmNic{{mac: "00:50:56:a1:be:f8", addrs: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 79), Mask: net.CIDRMask(24, 32)}}}}
+		},
+		shutdown: func(cmd int) {
+			shutdownCmd = cmd
+		},
+	}
+
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, tools.poll())
+	}
+
+	assert.Equal(t, []string{vmReplyReset, vmReplyReset, vmReplyOK, vmReplyOK, vmReplyOK, vmReplyOK, vmReplyError, vmReplyOK}, tr.tclo.sent)
+	assert.Equal(t, syscall.LINUX_REBOOT_CMD_POWER_OFF, shutdownCmd)
+	assert.Equal(t, vmToolsPoll, tools.delay)
+
+	assert.Contains(t, tr.requests, "tools.capability.statechange ")
+	assert.Contains(t, tr.requests, "tools.os.statechange.status 1 3")
+	assert.Contains(t, tr.requests, "tools.os.statechange.status 1 1")
+	assert.Contains(t, tr.requests, "SetGuestInfo  1 vm")
+	assert.Contains(t, tr.requests, "SetGuestInfo  6 other-64")
+	assert.Contains(t, tr.requests, "info-set guestinfo.ip 10.0.0.79")
+
+	// the nic info is sent as version 3 with the matching type
+	var nics string
+	for _, r := range tr.requests {
+		if strings.HasPrefix(r, "SetGuestInfo  10 ") {
+			nics = strings.TrimPrefix(r, "SetGuestInfo  10 ")
+		}
+	}
+	if assert.Equal(t, string(nicInfo(tools.nics())), nics) {
+		assert.Equal(t, []byte{0, 0, 0, 3}, []byte(nics[:4]))
+	}
+
+	// no command, the next poll pings the host
+	assert.NoError(t, tools.poll())
+	assert.True(t, tools.ping)
+	assert.NoError(t, tools.poll())
+	assert.Equal(t, "", tr.tclo.sent[len(tr.tclo.sent)-1])
+
+	tools.closeTCLO()
+	assert.True(t, tr.tclo.closed)
+	assert.Nil(t, tools.tclo)
+
+}
+
+func TestVMwareProvider(t *testing.T) {
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(`{"MODE": "prod"}`))
+	w.Close()
+
+	tr := &fakeTransport{guestinfo: map[string]string{
+		"metadata": base64.StdEncoding.EncodeToString([]byte("instance-id: vm-42\nlocal-hostname: web1\n" +
+			"public-keys-data: |\n  ssh-rsa AAAA one\n  ssh-rsa BBBB two\nrole: web\nnetwork: {}\n")),
+		"metadata.encoding": "base64",
+		"userdata":          base64.StdEncoding.EncodeToString(gz.Bytes()),
+		"userdata.encoding": "gzip+base64",
+		"env.region":        "eu",
+		"owner":             base64.StdEncoding.EncodeToString([]byte("ops")),
+		"owner.encoding":    "base64",
+	}}
+
+	f, err := ioutil.TempFile("", "cmdline")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.Close()
+
+	defer func(s string) { cmdLineFile = s }(cmdLineFile)
+	cmdLineFile = f.Name()
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte("vinitd.guestinfo=guestinfo.env.region,owner,missing\n"), 0644))
+
+	p := newVMwareProvider(tr)
+	assert.True(t, p.Detect(CloudHints{SysVendor: "VMware, Inc."}))
+	assert.False(t, p.Detect(CloudHints{SysVendor: "QEMU"}))
+	assert.False(t, newVMwareProvider(&fakeTransport{}).Detect(CloudHints{SysVendor: "VMware, Inc."}))
+
+	v := &Vinitd{
+		ifcs:           map[string]*ifc{"eth0": {name: "eth0", idx: 0}},
+		hypervisorInfo: hv{envs: make(map[string]string)},
+	}
+	tr.requests = nil
+	probeCloud(p, v)
+
+	// the metadata is read once for all values
+	var reads int
+	for _, r := range tr.requests {
+		if r == "info-get guestinfo.metadata" {
+			reads++
+		}
+	}
+	assert.Equal(t, 1, reads)
+	assert.Nil(t, p.md)
+
+	envs := v.hypervisorInfo.envs
+	assert.Equal(t, "vm-42", envs[envInstanceID])
+	assert.Equal(t, "web1", envs[envExtHostname])
+	assert.Equal(t, "web", envs["CLOUD_TAG_ROLE"])
+	assert.NotContains(t, envs, "CLOUD_TAG_NETWORK")
+	assert.Equal(t, "eu", envs["CLOUD_TAG_ENV_REGION"])
+	assert.Equal(t, "ops", envs["CLOUD_TAG_OWNER"])
+	assert.NotContains(t, envs, "CLOUD_TAG_MISSING")
+	assert.Equal(t, "prod", envs["MODE"])
+	assert.Equal(t, "ssh-rsa AAAA one\nssh-rsa BBBB two", envs[envSSHKeys])
+
+	_, err = decodeGuestInfo("x", "rot13")
+	assert.Error(t, err)
+
+}
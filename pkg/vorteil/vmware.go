@@ -0,0 +1,276 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// comma separated guestinfo variables which are added as tags, the host
+// does not list the variables of a VM
+const guestInfoCmdLine = "vinitd.guestinfo"
+
+// vmwareProvider reads the metadata from guestinfo variables like
+// cloud-init's VMware datasource: guestinfo.metadata, guestinfo.userdata
+// and their .encoding
+type vmwareProvider struct {
+	transport rpcTransport
+
+	// guestinfo.metadata decoded once per cloudEnvs pass
+	mtx sync.Mutex
+	md  map[string]interface{}
+}
+
+// keys of guestinfo.metadata which are no tags
+var vmwareMetaKeys = []string{
+	"instance-id", "local-hostname", "hostname", "public-keys", "public-keys-data",
+	"network", "network.encoding", "local-ipv4", "local-ipv6",
+}
+
+func newVMwareProvider(t rpcTransport) *vmwareProvider {
+	return &vmwareProvider{transport: t}
+}
+
+// decodeGuestInfo decodes base64 and gzip+base64 encoded values
+func decodeGuestInfo(val, encoding string) (string, error) {
+
+	switch encoding {
+	case "":
+		return val, nil
+	case "base64", "b64", "gzip+base64", "gz+b64":
+	default:
+		return "", fmt.Errorf("unknown encoding %s", encoding)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return "", err
+	}
+
+	if encoding == "gzip+base64" || encoding == "gz+b64" {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return "", err
+		}
+		b, err = ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return string(b), nil
+}
+
+// value returns the decoded guestinfo variable
+func (p *vmwareProvider) value(key string) (string, error) {
+
+	val, err := guestInfo(p.transport, key)
+	if err != nil || val == "" {
+		return "", err
+	}
+
+	enc, err := guestInfo(p.transport, key+".encoding")
+	if err != nil {
+		return "", err
+	}
+
+	return decodeGuestInfo(val, enc)
+}
+
+// cacheMetadata reads guestinfo.metadata for the accessors of a pass,
+// every read is a round trip over the backdoor
+func (p *vmwareProvider) cacheMetadata() {
+
+	md, err := p.readMetadata()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	// without cache the accessors read it again and return the error
+	if err == nil {
+		p.md = md
+	}
+}
+
+func (p *vmwareProvider) clearMetadata() {
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.md = nil
+}
+
+// metadata returns the cached or current guestinfo.metadata
+func (p *vmwareProvider) metadata() (map[string]interface{}, error) {
+
+	p.mtx.Lock()
+	md := p.md
+	p.mtx.Unlock()
+
+	if md != nil {
+		return md, nil
+	}
+
+	return p.readMetadata()
+}
+
+// readMetadata returns guestinfo.metadata, JSON or YAML
+func (p *vmwareProvider) readMetadata() (map[string]interface{}, error) {
+
+	md := make(map[string]interface{})
+
+	s, err := p.value("metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal([]byte(s), &md)
+	if err != nil {
+		return nil, err
+	}
+
+	return md, nil
+}
+
+// metaString returns a string of the metadata
+func (p *vmwareProvider) metaString(keys ...string) (string, error) {
+
+	md, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+
+	for _, k := range keys {
+		if s, ok := md[k].(string); ok && s != "" {
+			return s, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (p *vmwareProvider) Name() string {
+	return cloudStrings[cpVMware]
+}
+
+// Detect requires metadata or userdata in the guestinfo, VMware without
+// is no cloud platform
+func (p *vmwareProvider) Detect(hints CloudHints) bool {
+
+	if hints.SysVendor != vmwareVendor {
+		return false
+	}
+
+	for _, k := range []string{"metadata", "userdata"} {
+		if s, err := guestInfo(p.transport, k); err == nil && s != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExternalIP is not available, the addresses are internal
+func (p *vmwareProvider) ExternalIP(idx int) (string, error) {
+	return "", nil
+}
+
+func (p *vmwareProvider) Userdata() (string, error) {
+	return p.value("userdata")
+}
+
+func (p *vmwareProvider) Hostname() (string, error) {
+	return p.metaString("local-hostname", "hostname")
+}
+
+// Region is not available
+func (p *vmwareProvider) Region() (string, error) {
+	return "", nil
+}
+
+func (p *vmwareProvider) InstanceID() (string, error) {
+	return p.metaString("instance-id")
+}
+
+// guestInfoKeys returns the guestinfo variables of the kernel command line
+func guestInfoKeys() []string {
+
+	s, ok := cmdLineValue(guestInfoCmdLine)
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimPrefix(strings.TrimSpace(k), "guestinfo."); k != "" {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// Tags are the other scalar values of the metadata and the guestinfo
+// variables of vinitd.guestinfo
+func (p *vmwareProvider) Tags() (map[string]string, error) {
+
+	md, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for k, val := range md {
+
+		if containsString(vmwareMetaKeys, k) {
+			continue
+		}
+
+		switch val.(type) {
+		case string, int, bool, float64:
+			tags[k] = fmt.Sprintf("%v", val)
+		}
+	}
+
+	for _, k := range guestInfoKeys() {
+
+		s, err := p.value(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if s != "" {
+			tags[k] = s
+		}
+	}
+
+	return tags, nil
+}
+
+func (p *vmwareProvider) SSHKeys() ([]string, error) {
+
+	md, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, k := range []string{"public-keys", "public-keys-data"} {
+		for _, s := range stringList(md[k]) {
+			keys = append(keys, lines(s)...)
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,98 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// primary volume descriptor of iso9660 in sector 16
+	isoDescriptorOffset = 16 * 2048
+	isoVolumeIDOffset   = isoDescriptorOffset + 40
+
+	fat16LabelOffset = 0x2b
+	fat16TypeOffset  = 0x36
+	fat32LabelOffset = 0x47
+	fat32TypeOffset  = 0x52
+)
+
+// readVolumeLabel returns label and type of an iso9660 or vfat filesystem
+func readVolumeLabel(r io.ReaderAt) (string, string) {
+
+	buf := make([]byte, 32)
+
+	if _, err := r.ReadAt(buf[:6], isoDescriptorOffset); err == nil &&
+		buf[0] == 1 && string(buf[1:6]) == "CD001" {
+		if _, err := r.ReadAt(buf, isoVolumeIDOffset); err == nil {
+			return strings.TrimSpace(string(buf)), "iso9660"
+		}
+	}
+
+	for _, off := range [][2]int64{
+		{fat32TypeOffset, fat32LabelOffset},
+		{fat16TypeOffset, fat16LabelOffset},
+	} {
+		if _, err := r.ReadAt(buf[:8], off[0]); err != nil ||
+			!bytes.HasPrefix(buf, []byte("FAT")) {
+			continue
+		}
+		if _, err := r.ReadAt(buf[:11], off[1]); err == nil {
+			label := strings.TrimSpace(string(buf[:11]))
+			if label == "NO NAME" {
+				label = ""
+			}
+			return label, "vfat"
+		}
+	}
+
+	return "", ""
+}
+
+// volume is a block device with a labelled filesystem
+type volume struct {
+	dev, fs string
+}
+
+// volumeLabels scans disks and partitions for iso9660 and vfat labels.
+// Labels are lower case.
+func volumeLabels() map[string]volume {
+
+	vols := make(map[string]volume)
+
+	fis, err := ioutil.ReadDir("/sys/class/block")
+	if err != nil {
+		return vols
+	}
+
+	for _, fi := range fis {
+
+		if strings.HasPrefix(fi.Name(), "loop") || strings.HasPrefix(fi.Name(), "ram") {
+			continue
+		}
+
+		dev := filepath.Join("/dev", fi.Name())
+		f, err := os.Open(dev)
+		if err != nil {
+			continue
+		}
+
+		label, fs := readVolumeLabel(f)
+		f.Close()
+
+		if label != "" {
+			logDebug("found %s volume %s on %s", fs, label, dev)
+			vols[strings.ToLower(label)] = volume{dev: dev, fs: fs}
+		}
+	}
+
+	return vols
+}
@@ -0,0 +1,39 @@
+package vorteil
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadVolumeLabel(t *testing.T) {
+
+	iso := make([]byte, isoDescriptorOffset+2048)
+	copy(iso[isoDescriptorOffset:], "\x01CD001")
+	copy(iso[isoVolumeIDOffset:], "config-2                        ")
+
+	label, fs := readVolumeLabel(bytes.NewReader(iso))
+	assert.Equal(t, "config-2", label)
+	assert.Equal(t, "iso9660", fs)
+
+	fat := make([]byte, 512)
+	copy(fat[fat32TypeOffset:], "FAT32   ")
+	copy(fat[fat32LabelOffset:], "CIDATA     ")
+
+	label, fs = readVolumeLabel(bytes.NewReader(fat))
+	assert.Equal(t, "CIDATA", label)
+	assert.Equal(t, "vfat", fs)
+
+	fat = make([]byte, 512)
+	copy(fat[fat16TypeOffset:], "FAT16   ")
+	copy(fat[fat16LabelOffset:], "NO NAME    ")
+
+	label, fs = readVolumeLabel(bytes.NewReader(fat))
+	assert.Equal(t, "", label)
+	assert.Equal(t, "vfat", fs)
+
+	label, _ = readVolumeLabel(bytes.NewReader(make([]byte, 1024)))
+	assert.Equal(t, "", label)
+
+}
@@ -0,0 +1,245 @@
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+package vorteil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	waitPortAll = "all"
+	waitPortAny = "any"
+
+	// time to wait for an icmp port unreachable after a udp probe
+	udpProbeWait = 500 * time.Millisecond
+
+	dialTimeout = 3 * time.Second
+)
+
+// portTarget is a network and address to dial
+type portTarget struct {
+	network string
+	addr    string
+}
+
+func (t portTarget) String() string {
+	return fmt.Sprintf("%s://%s", t.network, t.addr)
+}
+
+// interfaceAddress returns the ipv4 address of an interface or its first
+// ipv6 address if there is no ipv4 address
+func interfaceAddress(name string) (string, error) {
+
+	ifce, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch interface %s: %s", name, err)
+	}
+
+	addrs, err := ifce.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("unable to read addresses for %s: %s", name, err)
+	}
+
+	var ip6 string
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+		if ip6 == "" {
+			ip6 = ip.String()
+			if ip.IsLinkLocalUnicast() {
+				ip6 = fmt.Sprintf("%s%%%s", ip6, name)
+			}
+		}
+	}
+
+	if ip6 == "" {
+		return "", fmt.Errorf("no address configured on %s", name)
+	}
+
+	return ip6, nil
+}
+
+func checkPort(port string) error {
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("the value '%s' does not seem to be a port number", port)
+	}
+
+	return nil
+}
+
+// parsePortTarget parses port, host:port, [v6]:port, tcp://host:port,
+// udp://host:port and unix:///path. Plain ports use the local address.
+func parsePortTarget(s string, local func() (string, error)) (portTarget, error) {
+
+	t := portTarget{network: "tcp"}
+
+	if i := strings.Index(s, "://"); i >= 0 {
+		t.network = s[:i]
+		s = s[i+3:]
+	}
+
+	switch t.network {
+	case "unix":
+		if s == "" {
+			return t, fmt.Errorf("unix target needs a path")
+		}
+		t.addr = s
+		return t, nil
+	case "tcp", "udp":
+	default:
+		return t, fmt.Errorf("unknown network '%s'", t.network)
+	}
+
+	if checkPort(s) == nil {
+		ip, err := local()
+		if err != nil {
+			return t, err
+		}
+		t.addr = net.JoinHostPort(ip, s)
+		return t, nil
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return t, fmt.Errorf("can not parse target '%s': %v", s, err)
+	}
+
+	if err = checkPort(port); err != nil {
+		return t, err
+	}
+
+	if host == "" {
+		host, err = local()
+		if err != nil {
+			return t, err
+		}
+	}
+
+	t.addr = net.JoinHostPort(host, port)
+
+	return t, nil
+}
+
+// probe returns nil if the target accepts connections. UDP targets count as
+// open if no icmp port unreachable arrives.
+func (t portTarget) probe(ctx context.Context) error {
+
+	d := net.Dialer{Timeout: dialTimeout}
+
+	conn, err := d.DialContext(ctx, t.network, t.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if t.network != "udp" {
+		return nil
+	}
+
+	_, err = conn.Write([]byte{})
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(udpProbeWait))
+	_, err = conn.Read(make([]byte, 1))
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return nil
+}
+
+// bootstrapWaitForPort waits until the targets accept connections. With
+// mode=any the first reachable target ends the wait.
+func bootstrapWaitForPort(ctx context.Context, args []string, p *program) error {
+
+	args, kv := keyValues(args, "if", "mode")
+
+	if len(args) < 1 {
+		return fmt.Errorf("bootstrap 'WAIT_PORT' needs at least one value to listen out for")
+	}
+
+	mode := waitPortAll
+	if m, ok := kv["mode"]; ok {
+		if m != waitPortAll && m != waitPortAny {
+			return fmt.Errorf("unknown mode '%s'", m)
+		}
+		mode = m
+	}
+
+	ief := "eth0"
+	if i, ok := kv["if"]; ok {
+		ief = i
+	}
+
+	local := func() (string, error) {
+		return interfaceAddress(ief)
+	}
+
+	var targets []portTarget
+	for _, a := range args {
+		t, err := parsePortTarget(a, local)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, t)
+	}
+
+	return waitForTargets(ctx, targets, mode == waitPortAny)
+}
+
+func waitForTargets(ctx context.Context, targets []portTarget, first bool) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(targets))
+
+	for _, t := range targets {
+		go func(t portTarget) {
+			err := waitFor(ctx, bootstrapWaitPort, func() error {
+				return t.probe(ctx)
+			})
+			if err == nil {
+				logDebug("%s reachable", t)
+			} else {
+				err = fmt.Errorf("%s: %v", t, err)
+			}
+			errs <- err
+		}(t)
+	}
+
+	var failed []string
+	for range targets {
+		err := <-errs
+		if err == nil && first {
+			return nil
+		} else if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package vorteil
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortTarget(t *testing.T) {
+
+	local := func() (string, error) {
+		return "10.0.0.5", nil
+	}
+
+	for s, expected := range map[string]portTarget{
+		"8080":                 {"tcp", "10.0.0.5:8080"},
+		":8080":                {"tcp", "10.0.0.5:8080"},
+		"db.internal:5432":     {"tcp", "db.internal:5432"},
+		"[fd00::1]:5432":       {"tcp", "[fd00::1]:5432"},
+		"udp://10.0.0.1:53":    {"udp", "10.0.0.1:53"},
+		"tcp://8443":           {"tcp", "10.0.0.5:8443"},
+		"unix:///run/app.sock": {"unix", "/run/app.sock"},
+	} {
+		pt, err := parsePortTarget(s, local)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, pt, s)
+	}
+
+	for _, s := range []string{"http", "70000", "host:port", "sctp://1.2.3.4:1", "unix://"} {
+		_, err := parsePortTarget(s, local)
+		assert.Error(t, err, s)
+	}
+
+}
+
+func TestWaitForTargets(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "waitport")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	sock := filepath.Join(dir, "app.sock")
+	ul, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	defer ul.Close()
+
+	// a port nobody listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	open := []portTarget{{"tcp", l.Addr().String()}, {"unix", sock}}
+	assert.NoError(t, waitForTargets(context.Background(), open, false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mixed := append(open, portTarget{"tcp", closedAddr})
+	assert.NoError(t, waitForTargets(ctx, mixed, true))
+	assert.Error(t, waitForTargets(ctx, mixed, false))
+
+}